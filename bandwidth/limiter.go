@@ -0,0 +1,224 @@
+package bandwidth
+
+import (
+	"context"
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// Now is used, so we can fix the time within our tests.
+var Now = time.Now
+
+// Hosts that aren't read from for idleTimeout are forgotten, so the limiter doesn't keep every host it has ever seen.
+// A host's bucket fills back up within a second, so forgetting it doesn't let anything through sooner. Idle hosts are
+// looked for at most once every sweepInterval.
+const (
+	idleTimeout   = 10 * time.Minute
+	sweepInterval = time.Minute
+)
+
+// maxChunk is the most bytes a throttled read takes at once, so a slow limit is applied smoothly rather than in one
+// large burst.
+const maxChunk = 32 << 10
+
+// Limits are in bytes per second. Zero means no limit.
+type Limits struct {
+	// Global bounds everything we download put together.
+	Global int64
+	// PerHost bounds what we download from each host.
+	PerHost int64
+}
+
+// bucket returns the rate and burst of the token bucket for a limit of n bytes per second. The burst is also the most
+// a single read takes.
+func bucket(n int64) (rate.Limit, int) {
+	if n <= 0 {
+		return rate.Inf, maxChunk
+	}
+
+	burst := n
+	if burst > maxChunk {
+		burst = maxChunk
+	}
+
+	return rate.Limit(n), int(burst)
+}
+
+// Limiter throttles the bodies we download to a global and a per host number of bytes per second, and counts the
+// bytes that pass through it. A single Limiter is shared by everything that downloads so the limits hold across all of
+// them. The limits can be changed while downloads are running.
+type Limiter struct {
+	transferred atomic.Int64
+
+	mu     sync.Mutex
+	limits Limits
+	global *rate.Limiter
+	hosts  map[string]*host
+	swept  time.Time
+}
+
+// host is the limiter for a single host. holders is how many readers are reading from the host, used is when it was
+// last looked up or let go of. Both are guarded by the Limiter's mu.
+type host struct {
+	limiter *rate.Limiter
+	holders int
+	used    time.Time
+}
+
+// New returns a Limiter that applies the limits.
+func New(limits Limits) *Limiter {
+	return &Limiter{
+		limits: limits,
+		global: rate.NewLimiter(bucket(limits.Global)),
+		hosts:  make(map[string]*host),
+	}
+}
+
+// Limits returns the limits being applied.
+func (l *Limiter) Limits() Limits {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.limits
+}
+
+// SetLimits changes the limits, downloads that are running slow down or speed up from their next read.
+func (l *Limiter) SetLimits(limits Limits) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.limits = limits
+	set(l.global, limits.Global)
+	for _, host := range l.hosts {
+		set(host.limiter, limits.PerHost)
+	}
+}
+
+// set moves the limiter to a limit of n bytes per second.
+func set(limiter *rate.Limiter, n int64) {
+	limit, burst := bucket(n)
+	limiter.SetLimit(limit)
+	limiter.SetBurst(burst)
+}
+
+// Transferred returns how many bytes have been read through the limiter.
+func (l *Limiter) Transferred() int64 {
+	return l.transferred.Load()
+}
+
+// Len returns how many hosts the limiter is keeping track of.
+func (l *Limiter) Len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return len(l.hosts)
+}
+
+// Reader returns a reader that reads from r no faster than the limits allow for the host. Reads give up once ctx is
+// done. Closing the reader closes r and lets go of the host, so it can be forgotten once it is idle.
+func (l *Limiter) Reader(ctx context.Context, host string, r io.ReadCloser) io.ReadCloser {
+	return &reader{ctx: ctx, r: r, limiter: l, host: l.hold(host)}
+}
+
+// hold returns the host, creating it the first time the host is seen, and holds on to it until it is released. Idle
+// hosts are swept out along the way.
+func (l *Limiter) hold(name string) *host {
+	name = strings.ToLower(name)
+	now := Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now.Sub(l.swept) >= sweepInterval {
+		for name, host := range l.hosts {
+			if host.holders == 0 && now.Sub(host.used) >= idleTimeout {
+				delete(l.hosts, name)
+			}
+		}
+		l.swept = now
+	}
+
+	h, ok := l.hosts[name]
+	if !ok {
+		h = &host{limiter: rate.NewLimiter(bucket(l.limits.PerHost))}
+		l.hosts[name] = h
+	}
+	h.holders++
+	h.used = now
+
+	return h
+}
+
+// release lets go of a host held by a reader.
+func (l *Limiter) release(h *host) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	h.holders--
+	h.used = Now()
+}
+
+// reader is a throttled reader. Each read is only as big as both limiters allow at once, and once the bytes have been
+// read it waits for the limiters to let them through.
+type reader struct {
+	ctx     context.Context
+	r       io.ReadCloser
+	limiter *Limiter
+	host    *host
+	closed  sync.Once
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	// the limits can change between reads, so the size is worked out every time.
+	size := len(p)
+	for _, limiter := range []*rate.Limiter{r.limiter.global, r.host.limiter} {
+		if burst := limiter.Burst(); size > burst {
+			size = burst
+		}
+	}
+
+	n, err := r.r.Read(p[:size])
+	if n == 0 {
+		return n, err
+	}
+	r.limiter.transferred.Add(int64(n))
+
+	for _, limiter := range []*rate.Limiter{r.limiter.global, r.host.limiter} {
+		if waitErr := wait(r.ctx, limiter, n); waitErr != nil {
+			return n, waitErr
+		}
+	}
+
+	return n, err
+}
+
+// Close closes the underlying reader and lets go of the host, closing more than once only lets go of it once.
+func (r *reader) Close() error {
+	r.closed.Do(func() {
+		r.limiter.release(r.host)
+	})
+	return r.r.Close()
+}
+
+// wait waits for the limiter to let n bytes through. The burst may have shrunk since the bytes were read, so they are
+// waited for a burst at a time.
+func wait(ctx context.Context, limiter *rate.Limiter, n int) error {
+	for n > 0 {
+		chunk := n
+		if burst := limiter.Burst(); chunk > burst {
+			chunk = burst
+		}
+
+		if err := limiter.WaitN(ctx, chunk); err != nil {
+			return err
+		}
+		n -= chunk
+	}
+
+	return nil
+}
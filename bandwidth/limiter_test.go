@@ -0,0 +1,108 @@
+package bandwidth_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pocockn/downloader/bandwidth"
+)
+
+func TestLimiter(t *testing.T) {
+	body := bytes.Repeat([]byte("a"), 4<<10)
+
+	t.Run("Unlimited readers aren't slowed down and are counted", func(t *testing.T) {
+		limiter := bandwidth.New(bandwidth.Limits{})
+
+		start := time.Now()
+		read, err := io.ReadAll(limiter.Reader(context.Background(), "example.com", io.NopCloser(bytes.NewReader(body))))
+		require.NoError(t, err)
+		assert.Equal(t, body, read)
+		assert.Less(t, time.Since(start), 100*time.Millisecond)
+		assert.Equal(t, int64(len(body)), limiter.Transferred())
+	})
+
+	t.Run("Readers are held to the global limit", func(t *testing.T) {
+		limiter := bandwidth.New(bandwidth.Limits{Global: 8 << 10})
+
+		// the first second's worth is let through straight away, the rest takes half a second.
+		start := time.Now()
+		reader := limiter.Reader(context.Background(), "example.com", io.NopCloser(bytes.NewReader(bytes.Repeat(body, 3))))
+		_, err := io.ReadAll(reader)
+		require.NoError(t, err)
+		assert.GreaterOrEqual(t, time.Since(start), 400*time.Millisecond)
+	})
+
+	t.Run("Readers are held to the per host limit", func(t *testing.T) {
+		limiter := bandwidth.New(bandwidth.Limits{PerHost: 4 << 10})
+
+		start := time.Now()
+		_, err := io.ReadAll(limiter.Reader(context.Background(), "example.com", io.NopCloser(bytes.NewReader(body))))
+		require.NoError(t, err)
+		_, err = io.ReadAll(limiter.Reader(context.Background(), "example.org", io.NopCloser(bytes.NewReader(body))))
+		require.NoError(t, err)
+		assert.Less(t, time.Since(start), 100*time.Millisecond)
+
+		_, err = io.ReadAll(limiter.Reader(context.Background(), "EXAMPLE.com", io.NopCloser(bytes.NewReader(body[:2<<10]))))
+		require.NoError(t, err)
+		assert.GreaterOrEqual(t, time.Since(start), 400*time.Millisecond)
+	})
+
+	t.Run("Limits can be changed while reading", func(t *testing.T) {
+		limiter := bandwidth.New(bandwidth.Limits{Global: 1 << 10})
+		reader := limiter.Reader(context.Background(), "example.com", io.NopCloser(bytes.NewReader(bytes.Repeat(body, 4))))
+
+		limiter.SetLimits(bandwidth.Limits{})
+		assert.Equal(t, bandwidth.Limits{}, limiter.Limits())
+
+		start := time.Now()
+		_, err := io.ReadAll(reader)
+		require.NoError(t, err)
+		assert.Less(t, time.Since(start), 100*time.Millisecond)
+	})
+
+	t.Run("Throttled reads give up once the context is done", func(t *testing.T) {
+		limiter := bandwidth.New(bandwidth.Limits{Global: 1 << 10})
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+
+		_, err := io.ReadAll(limiter.Reader(ctx, "example.com", io.NopCloser(bytes.NewReader(body))))
+		assert.Error(t, err)
+	})
+}
+
+func TestLimiter_Idle(t *testing.T) {
+	defer func() { bandwidth.Now = time.Now }()
+
+	limiter := bandwidth.New(bandwidth.Limits{})
+	start := time.Now()
+	bandwidth.Now = func() time.Time { return start }
+
+	held := limiter.Reader(context.Background(), "held.com", io.NopCloser(bytes.NewReader(nil)))
+	idle := limiter.Reader(context.Background(), "idle.com", io.NopCloser(bytes.NewReader(nil)))
+	require.NoError(t, idle.Close())
+	require.NoError(t, idle.Close())
+
+	t.Run("Hosts that haven't been read from for long enough are forgotten", func(t *testing.T) {
+		bandwidth.Now = func() time.Time { return start.Add(11 * time.Minute) }
+
+		other := limiter.Reader(context.Background(), "other.com", io.NopCloser(bytes.NewReader(nil)))
+		require.NoError(t, other.Close())
+		assert.Equal(t, 2, limiter.Len())
+	})
+
+	t.Run("Hosts are only forgotten once their readers are closed", func(t *testing.T) {
+		require.NoError(t, held.Close())
+
+		bandwidth.Now = func() time.Time { return start.Add(22 * time.Minute) }
+		other := limiter.Reader(context.Background(), "other.com", io.NopCloser(bytes.NewReader(nil)))
+		require.NoError(t, other.Close())
+		assert.Equal(t, 1, limiter.Len())
+	})
+}
@@ -9,11 +9,199 @@ import (
 
 // Config struct for config.
 type Config struct {
-	Port          string        `yaml:"port"`
-	Host          string        `yaml:"host"`
-	Workers       int           `yaml:"workers"`
-	TableName     string        `yaml:"table_name"`
-	WatchInterval time.Duration `yaml:"watch_interval"`
+	Port            string             `yaml:"port"`
+	Host            string             `yaml:"host"`
+	Workers         int                `yaml:"workers"`
+	TableName       string             `yaml:"table_name"`
+	WatchInterval   time.Duration      `yaml:"watch_interval"`
+	OutputDir       string             `yaml:"output_dir"`
+	Store           StoreConfig        `yaml:"store"`
+	ShutdownTimeout time.Duration      `yaml:"shutdown_timeout"`
+	Download        DownloadConfig     `yaml:"download"`
+	Retry           RetryConfig        `yaml:"retry"`
+	Queue           QueueConfig        `yaml:"queue"`
+	Dedupe          DedupeConfig       `yaml:"dedupe"`
+	Hosts           HostsConfig        `yaml:"hosts"`
+	Robots          RobotsConfig       `yaml:"robots"`
+	Versions        VersionsConfig     `yaml:"versions"`
+	Bandwidth       BandwidthConfig    `yaml:"bandwidth"`
+	Destinations    DestinationsConfig `yaml:"destinations"`
+	URLs            URLsConfig         `yaml:"urls"`
+	Jobs            JobsConfig         `yaml:"jobs"`
+	Admin           AdminConfig        `yaml:"admin"`
+}
+
+// AdminConfig configures the listener serving the admin endpoints, which is kept apart from the public one so they
+// aren't reachable by anyone who can submit URLs.
+type AdminConfig struct {
+	// Address is where the admin endpoints are served, like 127.0.0.1:5001. Empty turns them off.
+	Address string `yaml:"address"`
+}
+
+// JobsConfig configures how long the state of finished jobs is kept.
+type JobsConfig struct {
+	// Retention is how long a succeeded or failed job is kept once it has finished, zero keeps them forever.
+	Retention time.Duration `yaml:"retention"`
+	// PruneInterval is how often jobs past the retention are removed, zero never removes them.
+	PruneInterval time.Duration `yaml:"prune_interval"`
+}
+
+// URLsConfig configures the normalisations of submitted URLs that can change which resource a URL points at on some
+// sites. The rest are always applied.
+type URLsConfig struct {
+	// SortQuery sorts the query params by name.
+	SortQuery bool `yaml:"sort_query"`
+	// TrackingParams are query params that are removed, like utm_source. A name ending in * removes every param
+	// starting with what comes before it.
+	TrackingParams []string `yaml:"tracking_params"`
+}
+
+// DestinationsConfig configures where we are allowed to download from. Private, loopback, link-local and metadata
+// addresses are blocked unless they are allowed here.
+type DestinationsConfig struct {
+	// AllowCIDRs are address ranges we connect to even though they would be blocked, like an internal artifact store.
+	AllowCIDRs []string `yaml:"allow_cidrs"`
+	// AllowHosts are host names we connect to wherever they resolve, an allowed host also allows its subdomains.
+	AllowHosts []string `yaml:"allow_hosts"`
+}
+
+// BandwidthConfig bounds how fast bodies are downloaded, in bytes per second, across both the workers and the
+// watcher. Zero means no limit. The limits can be changed at runtime through PUT /admin/bandwidth on
+// the admin listener.
+type BandwidthConfig struct {
+	// Global bounds everything downloaded at once.
+	Global int64 `yaml:"global"`
+	// PerHost bounds what is downloaded from each host at once.
+	PerHost int64 `yaml:"per_host"`
+}
+
+// VersionsConfig configures how much of each watched URL's version history is kept. Zero means no limit.
+type VersionsConfig struct {
+	// MaxVersions is the most versions kept for a URL.
+	MaxVersions int `yaml:"max_versions"`
+	// MaxAge is how long a version is kept once a newer one has replaced it.
+	MaxAge time.Duration `yaml:"max_age"`
+}
+
+// RobotsConfig configures how robots.txt is honoured.
+type RobotsConfig struct {
+	// Enabled checks every URL against its site's robots.txt before it is downloaded.
+	Enabled bool `yaml:"enabled"`
+	// TTL is how long a site's robots.txt is cached for.
+	TTL time.Duration `yaml:"ttl"`
+}
+
+// HostsConfig configures how hard we hit each host, across both the workers and the watcher.
+type HostsConfig struct {
+	// Default applies to every host without an override.
+	Default HostLimits `yaml:"default"`
+	// Overrides are keyed by domain, an override also applies to the domain's subdomains.
+	Overrides map[string]HostLimits `yaml:"overrides"`
+}
+
+// HostLimits bounds the requests made to a single host.
+type HostLimits struct {
+	// Concurrency is the most requests in flight to the host at once, zero means no limit.
+	Concurrency int `yaml:"concurrency"`
+	// Rate is how many requests per second are started against the host, zero means no limit.
+	Rate float64 `yaml:"rate"`
+	// Burst is how many requests can be started at once before Rate kicks in.
+	Burst int `yaml:"burst"`
+}
+
+// DedupeConfig configures how the worker pool deduplicates submissions of the same URL. Deduplicated submissions are
+// still counted.
+type DedupeConfig struct {
+	// Policy is "none" to download every submission, "in_flight" to share a download already in progress, or
+	// "window" to also reuse a successful download for Window afterwards. It defaults to "in_flight".
+	Policy string `yaml:"policy"`
+	// Window is how long the "window" policy reuses a successful download for.
+	Window time.Duration `yaml:"window"`
+	// Size is the most URLs the "window" policy remembers, the least recently used are forgotten first.
+	Size int `yaml:"size"`
+}
+
+// QueueConfig configures the queue of submitted URLs waiting to be downloaded.
+type QueueConfig struct {
+	// VisibilityTimeout is how long a job is leased to a worker before it is handed out again. Workers renew the
+	// lease every half timeout while they hold the job, so jobs are only replayed when a worker has died.
+	VisibilityTimeout time.Duration `yaml:"visibility_timeout"`
+	// Capacity is the most URLs that can be waiting or downloading at once, submissions past it are turned away with
+	// a 503. Zero means no limit.
+	Capacity int `yaml:"capacity"`
+	// MaxDeliveries is how many times a job can be handed out without finishing, because its worker died, before it
+	// is failed rather than replayed again. Zero means no limit.
+	MaxDeliveries int `yaml:"max_deliveries"`
+}
+
+// RetryConfig configures how the worker pool retries failed downloads.
+type RetryConfig struct {
+	// MaxAttempts is the most times a URL is tried, including the first attempt.
+	MaxAttempts int `yaml:"max_attempts"`
+	// BaseDelay is the wait before the first retry, it doubles on each retry after that.
+	BaseDelay time.Duration `yaml:"base_delay"`
+	// MaxDelay caps the exponential backoff. Failures the server asks us to wait longer than this for aren't retried.
+	MaxDelay time.Duration `yaml:"max_delay"`
+	// Jitter is the fraction, between 0 and 1, of each delay that is randomised.
+	Jitter float64 `yaml:"jitter"`
+	// RetryableStatus are the response status codes worth retrying.
+	RetryableStatus []int `yaml:"retryable_status"`
+}
+
+// DownloadConfig configures how URLs are downloaded. A zero timeout means no timeout.
+type DownloadConfig struct {
+	// UserAgent identifies us to the servers we download from, and picks the robots.txt rules that apply to us.
+	UserAgent string `yaml:"user_agent"`
+	// ConnectTimeout bounds how long we wait to establish a connection.
+	ConnectTimeout time.Duration `yaml:"connect_timeout"`
+	// HeaderTimeout bounds how long we wait for the response headers.
+	HeaderTimeout time.Duration `yaml:"header_timeout"`
+	// Timeout bounds the whole download, including reading the body.
+	Timeout time.Duration `yaml:"timeout"`
+	// Segments configures downloading large bodies over several connections.
+	Segments SegmentsConfig `yaml:"segments"`
+	// MaxSize is the biggest body in bytes we download, zero means no limit.
+	MaxSize int64 `yaml:"max_size"`
+	// ContentTypes restricts the content types of the bodies we download.
+	ContentTypes ContentTypesConfig `yaml:"content_types"`
+}
+
+// ContentTypesConfig lists the media types we will and won't download, like "text/html" or "image/*". A body without
+// a Content-Type is taken to be "application/octet-stream".
+type ContentTypesConfig struct {
+	// Allow is the only types downloaded if it isn't empty.
+	Allow []string `yaml:"allow"`
+	// Deny is never downloaded, even if it is allowed.
+	Deny []string `yaml:"deny"`
+}
+
+// SegmentsConfig configures segmented downloads, where a large body is split into byte ranges that are downloaded
+// concurrently.
+type SegmentsConfig struct {
+	// Threshold is the size in bytes a body must be to be downloaded in segments, zero turns segmenting off.
+	Threshold int64 `yaml:"threshold"`
+	// Count is how many segments a body is split into.
+	Count int `yaml:"count"`
+	// Connections is how many extra connections segmented downloads can open between them, it defaults to the number
+	// of workers.
+	Connections int `yaml:"connections"`
+}
+
+// StoreConfig configures the backend that URLs are stored in.
+type StoreConfig struct {
+	// Driver is one of "bolt", "sqlite" or "memory", it defaults to "bolt". The memory store doesn't persist anything
+	// between restarts.
+	Driver string `yaml:"driver"`
+	// Path is the database file.
+	Path string `yaml:"path"`
+	// Timeout is how long to wait for the lock on the database file, zero waits forever.
+	Timeout time.Duration `yaml:"timeout"`
+	// NoSync skips fsync after each Bolt commit.
+	NoSync bool `yaml:"no_sync"`
+	// FreelistType is the Bolt freelist backend, either "array" or "hashmap".
+	FreelistType string `yaml:"freelist_type"`
+	// ReadOnly opens the database without write access.
+	ReadOnly bool `yaml:"read_only"`
 }
 
 // New returns a new decoded Config struct
@@ -18,4 +18,54 @@ func TestNewConfig(t *testing.T) {
 	assert.Equal(t, "urls", cfg.TableName)
 	assert.Equal(t, "127.0.0.1", cfg.Host)
 	assert.Equal(t, 60*time.Second, cfg.WatchInterval)
+	assert.Equal(t, "downloads", cfg.OutputDir)
+	assert.Equal(t, 30*time.Second, cfg.ShutdownTimeout)
+	assert.Equal(t, 10*time.Second, cfg.Download.ConnectTimeout)
+	assert.Equal(t, 30*time.Second, cfg.Download.HeaderTimeout)
+	assert.Equal(t, 10*time.Minute, cfg.Download.Timeout)
+	assert.Equal(t, "downloader/1.0 (+https://github.com/pocockn/downloader)", cfg.Download.UserAgent)
+	assert.True(t, cfg.Robots.Enabled)
+	assert.Equal(t, 24*time.Hour, cfg.Robots.TTL)
+	assert.Equal(t, int64(100<<20), cfg.Download.Segments.Threshold)
+	assert.Equal(t, 4, cfg.Download.Segments.Count)
+	assert.Zero(t, cfg.Download.Segments.Connections)
+	assert.Equal(t, int64(1<<30), cfg.Download.MaxSize)
+	assert.Empty(t, cfg.Download.ContentTypes.Allow)
+	assert.Equal(t, []string{"application/x-msdownload", "application/x-dosexec"}, cfg.Download.ContentTypes.Deny)
+	assert.Equal(t, 20, cfg.Versions.MaxVersions)
+	assert.Equal(t, 720*time.Hour, cfg.Versions.MaxAge)
+	assert.Zero(t, cfg.Bandwidth.Global)
+	assert.Zero(t, cfg.Bandwidth.PerHost)
+	assert.Empty(t, cfg.Destinations.AllowCIDRs)
+	assert.Empty(t, cfg.Destinations.AllowHosts)
+	assert.False(t, cfg.URLs.SortQuery)
+	assert.Equal(t, 168*time.Hour, cfg.Jobs.Retention)
+	assert.Equal(t, time.Hour, cfg.Jobs.PruneInterval)
+	assert.Equal(t, "127.0.0.1:5001", cfg.Admin.Address)
+	assert.Equal(
+		t,
+		[]string{"utm_*", "fbclid", "gclid", "dclid", "msclkid", "mc_cid", "mc_eid", "yclid"},
+		cfg.URLs.TrackingParams,
+	)
+	assert.Equal(t, 3, cfg.Retry.MaxAttempts)
+	assert.Equal(t, time.Second, cfg.Retry.BaseDelay)
+	assert.Equal(t, 30*time.Second, cfg.Retry.MaxDelay)
+	assert.Equal(t, 0.2, cfg.Retry.Jitter)
+	assert.Equal(t, []int{429, 502, 503, 504}, cfg.Retry.RetryableStatus)
+	assert.Equal(t, 15*time.Minute, cfg.Queue.VisibilityTimeout)
+	assert.Equal(t, 1000, cfg.Queue.Capacity)
+	assert.Equal(t, 5, cfg.Queue.MaxDeliveries)
+	assert.Equal(t, "in_flight", cfg.Dedupe.Policy)
+	assert.Equal(t, 5*time.Minute, cfg.Dedupe.Window)
+	assert.Equal(t, 10000, cfg.Dedupe.Size)
+	assert.Equal(t, config.HostLimits{Concurrency: 2, Rate: 2, Burst: 2}, cfg.Hosts.Default)
+	assert.Equal(t, map[string]config.HostLimits{
+		"example.com": {Concurrency: 1, Rate: 0.5, Burst: 1},
+	}, cfg.Hosts.Overrides)
+	assert.Equal(t, "bolt", cfg.Store.Driver)
+	assert.Equal(t, "/data/my.db", cfg.Store.Path)
+	assert.Equal(t, 5*time.Second, cfg.Store.Timeout)
+	assert.False(t, cfg.Store.NoSync)
+	assert.Equal(t, "array", cfg.Store.FreelistType)
+	assert.False(t, cfg.Store.ReadOnly)
 }
@@ -0,0 +1,216 @@
+package content
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// partialDir is the directory, within the storage directory, that partial downloads are kept in.
+const partialDir = ".partial"
+
+// PartialTTL is how long a partial download is kept without being resumed before GC removes it.
+const PartialTTL = 24 * time.Hour
+
+// Partial is a body that has only been partly downloaded. It is kept on disk between attempts so the next download
+// can pick up where the last one left off. Validator is the ETag or Last-Modified of the response the body came from,
+// the rest of the body should only be appended if the server confirms it hasn't changed since.
+type Partial struct {
+	Size      int64
+	Validator string
+
+	path    string
+	name    string
+	key     string
+	storage *Storage
+}
+
+// Partial claims the partial download kept for key, with a zero Size if there isn't one. Only one download of a key
+// can hold its partial at a time, nil is returned while another download holds it. The partial must be closed once
+// the download is finished with it.
+func (s *Storage) Partial(key string) (*Partial, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sum := sha256.Sum256([]byte(key))
+	name := hex.EncodeToString(sum[:])
+	if s.partials[name] {
+		return nil, nil
+	}
+
+	p := &Partial{
+		path:    filepath.Join(s.dir, partialDir, name),
+		name:    name,
+		key:     key,
+		storage: s,
+	}
+
+	validator, err := os.ReadFile(p.path + ".validator")
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("unable to read partial download of %s: %w", key, err)
+	}
+
+	info, err := os.Stat(p.path)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+	case err != nil:
+		return nil, fmt.Errorf("unable to read partial download of %s: %w", key, err)
+	default:
+		p.Size = info.Size()
+		p.Validator = string(validator)
+	}
+
+	s.partials[name] = true
+	return p, nil
+}
+
+// Resumable reports whether there is a partial body to resume, it is false for a nil partial.
+func (p *Partial) Resumable() bool {
+	return p != nil && p.Size > 0 && p.Validator != ""
+}
+
+// Close hands the partial back so another download of the key can claim it. Closing a nil partial does nothing.
+func (p *Partial) Close() {
+	if p == nil {
+		return
+	}
+
+	p.storage.mu.Lock()
+	delete(p.storage.partials, p.name)
+	p.storage.mu.Unlock()
+}
+
+// Discard throws away the partial body so the next download starts from the beginning. Discarding a nil partial does
+// nothing.
+func (p *Partial) Discard() error {
+	if p == nil {
+		return nil
+	}
+
+	p.Size, p.Validator = 0, ""
+	for _, path := range []string{p.path, p.path + ".validator"} {
+		if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("unable to discard partial download of %s: %w", p.key, err)
+		}
+	}
+
+	return nil
+}
+
+// Copy writes the first n bytes of the partial body to w.
+func (p *Partial) Copy(w io.Writer, n int64) error {
+	if n == 0 {
+		return nil
+	}
+
+	file, err := os.Open(p.path)
+	if err != nil {
+		return fmt.Errorf("unable to open partial download of %s: %w", p.key, err)
+	}
+	defer file.Close()
+
+	if _, err := io.CopyN(w, file, n); err != nil {
+		return fmt.Errorf("unable to read partial download of %s: %w", p.key, err)
+	}
+
+	return nil
+}
+
+// SavePartial streams r into the partial body from offset, throwing away anything already written after it, and
+// moves the complete body into storage like Save does. If writing r fails the body written so far is kept, along with
+// the validator, so a later download can resume from p.Size.
+func (s *Storage) SavePartial(p *Partial, r io.Reader, offset int64, validator string) (Blob, error) {
+	if err := os.MkdirAll(filepath.Dir(p.path), 0755); err != nil {
+		return Blob{}, fmt.Errorf("unable to create partial directory: %w", err)
+	}
+
+	if err := os.WriteFile(p.path+".validator", []byte(validator), 0644); err != nil {
+		return Blob{}, fmt.Errorf("unable to write partial validator: %w", err)
+	}
+	p.Validator = validator
+
+	file, err := os.OpenFile(p.path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return Blob{}, fmt.Errorf("unable to open partial download: %w", err)
+	}
+
+	// the blob is named after the hash of the whole body, so the part we already have is hashed first.
+	h := sha256.New()
+	if _, err := io.CopyN(h, file, offset); err != nil {
+		file.Close()
+		return Blob{}, fmt.Errorf("unable to read partial download: %w", err)
+	}
+
+	if err := file.Truncate(offset); err != nil {
+		file.Close()
+		return Blob{}, fmt.Errorf("unable to truncate partial download: %w", err)
+	}
+
+	written, err := io.Copy(io.MultiWriter(file, h), r)
+	p.Size = offset + written
+	if err != nil {
+		file.Close()
+		return Blob{}, fmt.Errorf("unable to write body: %w", err)
+	}
+
+	if err := file.Close(); err != nil {
+		return Blob{}, fmt.Errorf("unable to close partial download: %w", err)
+	}
+
+	if err := os.Remove(p.path + ".validator"); err != nil {
+		return Blob{}, fmt.Errorf("unable to remove partial validator: %w", err)
+	}
+
+	blob, err := s.commit(p.path, h, p.Size)
+	p.Size, p.Validator = 0, ""
+
+	return blob, err
+}
+
+// collectPartials removes the partial downloads that haven't been written to since the cutoff and aren't held by a
+// download.
+func (s *Storage) collectPartials(cutoff time.Time) error {
+	entries, err := os.ReadDir(filepath.Join(s.dir, partialDir))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return fmt.Errorf("unable to read partial downloads: %w", err)
+	}
+
+	// hold the lock so a download can't claim a partial while we remove it.
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, entry := range entries {
+		if s.partials[strings.TrimSuffix(entry.Name(), ".validator")] {
+			continue
+		}
+
+		info, err := entry.Info()
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		if info.ModTime().After(cutoff) {
+			continue
+		}
+
+		err = os.Remove(filepath.Join(s.dir, partialDir, entry.Name()))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("unable to remove partial download %s: %w", entry.Name(), err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,99 @@
+package content_test
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pocockn/downloader/content"
+	"github.com/pocockn/downloader/store"
+)
+
+func TestPartial(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "downloads")
+
+	storage, err := content.New(dir, store.NewMemory())
+	require.NoError(t, err)
+
+	key := "http://www.example.com/large"
+
+	t.Run("Failed writes keep the body written so far", func(t *testing.T) {
+		partial, err := storage.Partial(key)
+		require.NoError(t, err)
+		defer partial.Close()
+		assert.False(t, partial.Resumable())
+
+		_, err = storage.SavePartial(partial, io.MultiReader(strings.NewReader("hello "), failingReader{}), 0, `"v1"`)
+		assert.Error(t, err)
+		assert.Equal(t, int64(6), partial.Size)
+		assert.True(t, partial.Resumable())
+	})
+
+	t.Run("Partials are held by one download at a time", func(t *testing.T) {
+		first, err := storage.Partial(key)
+		require.NoError(t, err)
+		require.NotNil(t, first)
+		assert.Equal(t, int64(6), first.Size)
+		assert.Equal(t, `"v1"`, first.Validator)
+
+		second, err := storage.Partial(key)
+		require.NoError(t, err)
+		assert.Nil(t, second)
+
+		first.Close()
+		second, err = storage.Partial(key)
+		require.NoError(t, err)
+		assert.NotNil(t, second)
+		second.Close()
+	})
+
+	t.Run("Resumed bodies are stored under the hash of the whole body", func(t *testing.T) {
+		partial, err := storage.Partial(key)
+		require.NoError(t, err)
+		defer partial.Close()
+
+		blob, err := storage.SavePartial(partial, strings.NewReader("world"), partial.Size, partial.Validator)
+		require.NoError(t, err)
+		assert.Equal(t, "b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9", blob.Hash)
+		assert.Equal(t, int64(11), blob.Size)
+		assert.False(t, partial.Resumable())
+
+		matches, err := filepath.Glob(filepath.Join(dir, ".partial", "*"))
+		require.NoError(t, err)
+		assert.Empty(t, matches)
+	})
+
+	t.Run("GC removes partials that haven't been resumed", func(t *testing.T) {
+		partial, err := storage.Partial(key)
+		require.NoError(t, err)
+		_, err = storage.SavePartial(partial, io.MultiReader(strings.NewReader("hello "), failingReader{}), 0, `"v2"`)
+		require.Error(t, err)
+
+		matches, err := filepath.Glob(filepath.Join(dir, ".partial", "*"))
+		require.NoError(t, err)
+		require.Len(t, matches, 2)
+
+		stale := time.Now().Add(-2 * content.PartialTTL)
+		for _, match := range matches {
+			require.NoError(t, os.Chtimes(match, stale, stale))
+		}
+
+		// held partials are left alone.
+		_, err = storage.GC(time.Hour)
+		require.NoError(t, err)
+		assert.FileExists(t, matches[0])
+
+		partial.Close()
+		_, err = storage.GC(time.Hour)
+		require.NoError(t, err)
+		for _, match := range matches {
+			assert.NoFileExists(t, match)
+		}
+	})
+}
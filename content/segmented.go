@@ -0,0 +1,79 @@
+package content
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Segmented is a body of a known size that is written in segments, in any order, into a temp file preallocated to
+// the full size.
+type Segmented struct {
+	file    *os.File
+	size    int64
+	storage *Storage
+}
+
+// Segmented creates the temp file for a body of size bytes that is written in segments.
+func (s *Storage) Segmented(size int64) (*Segmented, error) {
+	tmp, err := os.CreateTemp(s.dir, ".download-*")
+	if err != nil {
+		return nil, fmt.Errorf("unable to create temp file: %w", err)
+	}
+
+	if err := tmp.Truncate(size); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return nil, fmt.Errorf("unable to allocate %d bytes: %w", size, err)
+	}
+
+	return &Segmented{file: tmp, size: size, storage: s}, nil
+}
+
+// Writer returns a writer for the segment of the body starting at offset. Writers for different segments can be
+// used concurrently.
+func (b *Segmented) Writer(offset int64) io.Writer {
+	return io.NewOffsetWriter(b.file, offset)
+}
+
+// Reader returns a reader for the whole body, to be used once every segment has been written.
+func (b *Segmented) Reader() io.Reader {
+	return io.NewSectionReader(b.file, 0, b.size)
+}
+
+// Commit hashes the body and moves it into storage like Save does. The file was allocated at the full size, so a
+// segment that came up short leaves a hole rather than a shorter file, the caller checks each segment's length as it
+// is written. Commit only catches a body written past its allocation. The body is discarded if it can't be committed.
+func (b *Segmented) Commit() (Blob, error) {
+	info, err := b.file.Stat()
+	if err != nil {
+		b.Discard()
+		return Blob{}, fmt.Errorf("unable to stat body: %w", err)
+	}
+
+	if info.Size() != b.size {
+		b.Discard()
+		return Blob{}, fmt.Errorf("body is %d bytes, expected %d", info.Size(), b.size)
+	}
+
+	h := sha256.New()
+	size, err := io.Copy(h, io.NewSectionReader(b.file, 0, b.size))
+	if err != nil {
+		b.Discard()
+		return Blob{}, fmt.Errorf("unable to hash body: %w", err)
+	}
+
+	if err := b.file.Close(); err != nil {
+		os.Remove(b.file.Name())
+		return Blob{}, fmt.Errorf("unable to close temp file: %w", err)
+	}
+
+	return b.storage.commit(b.file.Name(), h, size)
+}
+
+// Discard removes the body.
+func (b *Segmented) Discard() {
+	b.file.Close()
+	os.Remove(b.file.Name())
+}
@@ -0,0 +1,49 @@
+package content_test
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pocockn/downloader/content"
+	"github.com/pocockn/downloader/store"
+)
+
+func TestSegmented(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "downloads")
+
+	storage, err := content.New(dir, store.NewMemory())
+	require.NoError(t, err)
+
+	t.Run("Segments written out of order make up the body", func(t *testing.T) {
+		body, err := storage.Segmented(11)
+		require.NoError(t, err)
+
+		_, err = body.Writer(6).Write([]byte("world"))
+		require.NoError(t, err)
+		_, err = body.Writer(0).Write([]byte("hello "))
+		require.NoError(t, err)
+
+		blob, err := body.Commit()
+		require.NoError(t, err)
+		assert.Equal(t, "b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9", blob.Hash)
+		assert.Equal(t, int64(11), blob.Size)
+	})
+
+	t.Run("Bodies that outgrow their allocation aren't committed", func(t *testing.T) {
+		body, err := storage.Segmented(5)
+		require.NoError(t, err)
+
+		_, err = body.Writer(0).Write([]byte("hello world"))
+		require.NoError(t, err)
+
+		_, err = body.Commit()
+		assert.Error(t, err)
+
+		matches, err := filepath.Glob(filepath.Join(dir, ".download-*"))
+		require.NoError(t, err)
+		assert.Empty(t, matches)
+	})
+}
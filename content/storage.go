@@ -0,0 +1,276 @@
+package content
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pocockn/downloader/store"
+)
+
+// GCGrace is how old an unreferenced blob must be before GC removes it. It stops a collection removing a blob that
+// has just been written but not yet referenced by a URL record.
+const GCGrace = 10 * time.Minute
+
+// Blob describes a body that has been written into storage.
+type Blob struct {
+	Hash string
+	Path string
+	Size int64
+}
+
+// Storage is a content addressable blob store. Bodies are stored under the hex SHA-256 of their content, fanned out
+// into two levels of sub directories, so identical bodies share a single file on disk. The number of URL records
+// pointing at each blob is tracked in the refs store.
+type Storage struct {
+	dir  string
+	refs store.Store
+	mu   sync.Mutex
+
+	// partials are the partial downloads held by a download, by file name.
+	partials map[string]bool
+}
+
+// New creates the output directory if it doesn't exist and returns a Storage that writes into it.
+func New(dir string, refs store.Store) (*Storage, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("unable to create output directory %s: %w", dir, err)
+	}
+
+	return &Storage{dir: dir, refs: refs, mu: sync.Mutex{}, partials: make(map[string]bool)}, nil
+}
+
+// Path returns where the blob with the given hash lives on disk. It returns an empty path if hash isn't a hex SHA-256
+// digest, so a hash we didn't compute can't point outside the output directory.
+func (s *Storage) Path(hash string) string {
+	if !isHash(hash) {
+		return ""
+	}
+
+	return filepath.Join(s.dir, hash[:2], hash[2:4], hash)
+}
+
+// Exists reports whether the blob with the given hash is on disk. Anything that isn't a hex SHA-256 digest doesn't
+// exist.
+func (s *Storage) Exists(hash string) bool {
+	if !isHash(hash) {
+		return false
+	}
+
+	_, err := os.Stat(s.Path(hash))
+	return err == nil
+}
+
+// Save streams r into storage and returns the blob it was written to. The body is written to a temp file first and
+// renamed into place once complete, so readers never see a partially written blob. If a blob with the same content
+// already exists the temp file is discarded.
+func (s *Storage) Save(r io.Reader) (Blob, error) {
+	tmp, err := os.CreateTemp(s.dir, ".download-*")
+	if err != nil {
+		return Blob{}, fmt.Errorf("unable to create temp file: %w", err)
+	}
+
+	h := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, h), r)
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return Blob{}, fmt.Errorf("unable to write body: %w", err)
+	}
+
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return Blob{}, fmt.Errorf("unable to close temp file: %w", err)
+	}
+
+	return s.commit(tmp.Name(), h, size)
+}
+
+// commit moves the temp file into its content addressed location.
+func (s *Storage) commit(tmp string, h hash.Hash, size int64) (Blob, error) {
+	blob := Blob{Hash: hex.EncodeToString(h.Sum(nil)), Size: size}
+	blob.Path = s.Path(blob.Hash)
+
+	// hold the lock so a concurrent GC can't remove the blob between us finding and touching it.
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := os.Stat(blob.Path); err == nil {
+		os.Remove(tmp)
+		// bump the modification time so the existing blob is covered by the GC grace period again.
+		now := time.Now()
+		if err := os.Chtimes(blob.Path, now, now); err != nil {
+			return Blob{}, fmt.Errorf("unable to touch blob %s: %w", blob.Hash, err)
+		}
+		return blob, nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(blob.Path), 0755); err != nil {
+		os.Remove(tmp)
+		return Blob{}, fmt.Errorf("unable to create blob directory: %w", err)
+	}
+
+	if err := os.Rename(tmp, blob.Path); err != nil {
+		os.Remove(tmp)
+		return Blob{}, fmt.Errorf("unable to move body into place: %w", err)
+	}
+
+	return blob, nil
+}
+
+// Retain records another reference to the blob.
+func (s *Storage) Retain(hash string) error {
+	return s.addRef(hash, 1)
+}
+
+// Release drops a reference to the blob. Blobs without references are removed by the next GC.
+func (s *Storage) Release(hash string) error {
+	return s.addRef(hash, -1)
+}
+
+// Swap moves a reference from the old blob to the new one. It is used when a URL record is pointed at a new body,
+// either hash may be empty.
+func (s *Storage) Swap(old, new string) error {
+	if old == new {
+		return nil
+	}
+
+	if new != "" {
+		if err := s.Retain(new); err != nil {
+			return err
+		}
+	}
+
+	if old != "" {
+		return s.Release(old)
+	}
+
+	return nil
+}
+
+// Refs returns how many references the blob has.
+func (s *Storage) Refs(hash string) (int, error) {
+	value, err := s.refs.Get(hash)
+	if err != nil {
+		return 0, fmt.Errorf("unable to fetch references for %s: %w", hash, err)
+	}
+
+	if value == nil {
+		return 0, nil
+	}
+
+	return strconv.Atoi(string(value))
+}
+
+// addRef adjusts the reference count for the blob. The lock is held so a concurrent GC can't collect the blob between
+// it being found unreferenced and removed.
+func (s *Storage) addRef(hash string, delta int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.refs.Update(hash, func(old []byte) ([]byte, error) {
+		var count int
+		if old != nil {
+			var err error
+			if count, err = strconv.Atoi(string(old)); err != nil {
+				return nil, fmt.Errorf("invalid reference count for %s: %w", hash, err)
+			}
+		}
+
+		count += delta
+		if count < 0 {
+			count = 0
+		}
+
+		return []byte(strconv.Itoa(count)), nil
+	})
+}
+
+// GC removes blobs that are no longer referenced by any URL record and are older than grace. It returns the number
+// of blobs removed. Partial downloads that haven't been resumed within PartialTTL are removed too.
+func (s *Storage) GC(grace time.Duration) (int, error) {
+	if err := s.collectPartials(time.Now().Add(-PartialTTL)); err != nil {
+		return 0, err
+	}
+
+	var removed int
+	cutoff := time.Now().Add(-grace)
+
+	err := filepath.WalkDir(s.dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if entry.IsDir() || !isHash(entry.Name()) || path != s.Path(entry.Name()) {
+			return nil
+		}
+
+		ok, err := s.collect(entry.Name(), cutoff)
+		if err != nil {
+			return err
+		}
+
+		if ok {
+			removed++
+		}
+
+		return nil
+	})
+	if err != nil {
+		return removed, err
+	}
+
+	return removed, nil
+}
+
+// collect removes the blob if it was last touched before the cutoff and has no references.
+func (s *Storage) collect(hash string, cutoff time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	info, err := os.Stat(s.Path(hash))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	if info.ModTime().After(cutoff) {
+		return false, nil
+	}
+
+	count, err := s.Refs(hash)
+	if err != nil {
+		return false, err
+	}
+
+	if count > 0 {
+		return false, nil
+	}
+
+	if err := os.Remove(s.Path(hash)); err != nil {
+		return false, fmt.Errorf("unable to remove blob %s: %w", hash, err)
+	}
+
+	return true, nil
+}
+
+// isHash reports whether name looks like a hex SHA-256 digest.
+func isHash(name string) bool {
+	if len(name) != sha256.Size*2 {
+		return false
+	}
+
+	_, err := hex.DecodeString(name)
+	return err == nil
+}
@@ -0,0 +1,102 @@
+package content_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pocockn/downloader/content"
+	"github.com/pocockn/downloader/store"
+)
+
+type failingReader struct{}
+
+func (failingReader) Read([]byte) (int, error) {
+	return 0, errors.New("connection reset")
+}
+
+func TestStorage(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "downloads")
+
+	storage, err := content.New(dir, store.NewMemory())
+	require.NoError(t, err)
+
+	t.Run("Bodies are stored under the hash of their content", func(t *testing.T) {
+		blob, err := storage.Save(strings.NewReader("hello world"))
+		require.NoError(t, err)
+
+		assert.Equal(t, "b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9", blob.Hash)
+		assert.Equal(t, filepath.Join(dir, "b9", "4d", blob.Hash), blob.Path)
+		assert.Equal(t, int64(11), blob.Size)
+
+		body, err := os.ReadFile(blob.Path)
+		require.NoError(t, err)
+		assert.Equal(t, "hello world", string(body))
+	})
+
+	t.Run("Hashes that aren't SHA-256 digests have no path", func(t *testing.T) {
+		for _, hash := range []string{"", "aaaa", "../../../../etc/passwd", strings.Repeat("zz", 32)} {
+			assert.Empty(t, storage.Path(hash), hash)
+			assert.False(t, storage.Exists(hash), hash)
+		}
+	})
+
+	t.Run("Identical bodies share a blob", func(t *testing.T) {
+		first, err := storage.Save(strings.NewReader("same body"))
+		require.NoError(t, err)
+
+		second, err := storage.Save(strings.NewReader("same body"))
+		require.NoError(t, err)
+
+		assert.Equal(t, first, second)
+	})
+
+	t.Run("Failed writes leave nothing behind", func(t *testing.T) {
+		_, err := storage.Save(failingReader{})
+		assert.Error(t, err)
+
+		matches, err := filepath.Glob(filepath.Join(dir, ".download-*"))
+		require.NoError(t, err)
+		assert.Empty(t, matches)
+	})
+
+	t.Run("References are moved between blobs", func(t *testing.T) {
+		require.NoError(t, storage.Swap("", "aaaa"))
+		require.NoError(t, storage.Swap("", "aaaa"))
+		require.NoError(t, storage.Swap("aaaa", "bbbb"))
+
+		refs, err := storage.Refs("aaaa")
+		require.NoError(t, err)
+		assert.Equal(t, 1, refs)
+
+		refs, err = storage.Refs("bbbb")
+		require.NoError(t, err)
+		assert.Equal(t, 1, refs)
+	})
+
+	t.Run("GC removes unreferenced blobs outside the grace period", func(t *testing.T) {
+		referenced, err := storage.Save(strings.NewReader("referenced"))
+		require.NoError(t, err)
+		require.NoError(t, storage.Retain(referenced.Hash))
+
+		unreferenced, err := storage.Save(strings.NewReader("unreferenced"))
+		require.NoError(t, err)
+
+		removed, err := storage.GC(time.Hour)
+		require.NoError(t, err)
+		assert.Equal(t, 0, removed)
+
+		removed, err = storage.GC(0)
+		require.NoError(t, err)
+		assert.Equal(t, 3, removed)
+
+		assert.FileExists(t, referenced.Path)
+		assert.NoFileExists(t, unreferenced.Path)
+	})
+}
@@ -0,0 +1,194 @@
+package destinations
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"syscall"
+)
+
+// ErrBlocked is returned when a connection to a blocked address is refused.
+var ErrBlocked = errors.New("destination is blocked")
+
+// reserved are the ranges we block on top of the private, loopback, link-local, multicast and unspecified addresses
+// netip already knows about.
+var reserved = []netip.Prefix{
+	// "this" network, which some systems route to the local host.
+	netip.MustParsePrefix("0.0.0.0/8"),
+	// carrier grade NAT, which some clouds host their metadata services in.
+	netip.MustParsePrefix("100.64.0.0/10"),
+	// IETF protocol assignments.
+	netip.MustParsePrefix("192.0.0.0/24"),
+	// benchmarking.
+	netip.MustParsePrefix("198.18.0.0/15"),
+	// reserved for future use, along with broadcast at the top of it.
+	netip.MustParsePrefix("240.0.0.0/4"),
+	// IPv4-compatible IPv6, NAT64, Teredo and 6to4, which carry an IPv4 address inside an IPv6 one and so can reach
+	// any of the above.
+	netip.MustParsePrefix("::/96"),
+	netip.MustParsePrefix("64:ff9b::/96"),
+	netip.MustParsePrefix("2001::/32"),
+	netip.MustParsePrefix("2002::/16"),
+}
+
+// Policy decides which addresses we are allowed to connect to. Private (RFC 1918 and IPv6 unique local), loopback,
+// link-local and other reserved addresses are blocked, which covers the cloud metadata services at 169.254.169.254,
+// unless they are in one of the allowed CIDRs or we are connecting to one of the allowed hosts.
+type Policy struct {
+	cidrs []netip.Prefix
+	hosts map[string]bool
+}
+
+// New returns a Policy that allows the CIDRs and hosts passed in on top of the public internet. An allowed host also
+// allows its subdomains.
+func New(cidrs, hosts []string) (*Policy, error) {
+	p := &Policy{hosts: make(map[string]bool, len(hosts))}
+
+	for _, cidr := range cidrs {
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q: %w", cidr, err)
+		}
+		p.cidrs = append(p.cidrs, prefix.Masked())
+	}
+
+	for _, host := range hosts {
+		p.hosts[normalise(host)] = true
+	}
+
+	return p, nil
+}
+
+// normalise lower cases a host name and strips any trailing dot.
+func normalise(host string) string {
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
+
+// Blocked reports whether connections to the address are refused.
+func (p *Policy) Blocked(addr netip.Addr) bool {
+	// an IPv4 address mapped into IPv6 is the IPv4 address as far as the network is concerned.
+	addr = addr.Unmap()
+
+	for _, prefix := range p.cidrs {
+		if prefix.Contains(addr) {
+			return false
+		}
+	}
+
+	if addr.IsPrivate() || addr.IsLoopback() || addr.IsLinkLocalUnicast() || addr.IsLinkLocalMulticast() ||
+		addr.IsInterfaceLocalMulticast() || addr.IsMulticast() || addr.IsUnspecified() {
+		return true
+	}
+
+	for _, prefix := range reserved {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// allowedHost reports whether the host, or a domain it is a subdomain of, is allowed.
+func (p *Policy) allowedHost(name string) bool {
+	name = normalise(name)
+	for {
+		if p.hosts[name] {
+			return true
+		}
+
+		i := strings.IndexByte(name, '.')
+		if i < 0 {
+			return false
+		}
+		name = name[i+1:]
+	}
+}
+
+// DialContext returns a dial function for an http.Transport that dials with dialer, refusing connections to blocked
+// addresses with ErrBlocked. Addresses are checked once the host name has been resolved, right before each connection
+// is made, so a name that resolves to somewhere else by the time we connect (DNS rebinding) and redirects to blocked
+// addresses are caught too. Behind a proxy it is the proxy's address that is dialled, so requests sent through a proxy
+// are checked by Proxied instead.
+func (p *Policy) DialContext(dialer *net.Dialer) func(ctx context.Context, network, address string) (net.Conn, error) {
+	guarded := *dialer
+	guarded.Control = func(_, address string, _ syscall.RawConn) error {
+		addrPort, err := netip.ParseAddrPort(address)
+		if err != nil {
+			return fmt.Errorf("%w: %s", ErrBlocked, address)
+		}
+
+		if p.Blocked(addrPort.Addr()) {
+			return fmt.Errorf("%w: %s", ErrBlocked, addrPort.Addr())
+		}
+
+		return nil
+	}
+
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		if host, _, err := net.SplitHostPort(address); err == nil && p.allowedHost(host) {
+			return dialer.DialContext(ctx, network, address)
+		}
+
+		return guarded.DialContext(ctx, network, address)
+	}
+}
+
+// Proxied returns a RoundTripper that checks the host of each request next sends through the proxy proxy picks for it,
+// refusing requests to blocked hosts with ErrBlocked. The proxy connects to the host for us, so DialContext only ever
+// sees the proxy's address. Host names are resolved and refused if any of their addresses are blocked, a name that
+// resolves somewhere else by the time the proxy connects isn't caught. Requests that don't go through a proxy are
+// left to DialContext.
+func (p *Policy) Proxied(next http.RoundTripper, proxy func(*http.Request) (*url.URL, error)) http.RoundTripper {
+	return &proxiedTransport{policy: p, next: next, proxy: proxy}
+}
+
+// proxiedTransport checks the hosts of requests sent through a proxy.
+type proxiedTransport struct {
+	policy *Policy
+	next   http.RoundTripper
+	proxy  func(*http.Request) (*url.URL, error)
+}
+
+func (t *proxiedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// a proxy that can't be picked fails the request in next.
+	if proxyURL, err := t.proxy(req); err == nil && proxyURL != nil {
+		if err := t.policy.checkHost(req.Context(), req.URL.Hostname()); err != nil {
+			return nil, err
+		}
+	}
+
+	return t.next.RoundTrip(req)
+}
+
+// checkHost returns ErrBlocked if the host isn't allowed and it, or any address it resolves to, is blocked.
+func (p *Policy) checkHost(ctx context.Context, host string) error {
+	if p.allowedHost(host) {
+		return nil
+	}
+
+	if addr, err := netip.ParseAddr(host); err == nil {
+		if p.Blocked(addr) {
+			return fmt.Errorf("%w: %s", ErrBlocked, addr)
+		}
+		return nil
+	}
+
+	addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return fmt.Errorf("unable to resolve %s: %w", host, err)
+	}
+
+	for _, addr := range addrs {
+		if p.Blocked(addr) {
+			return fmt.Errorf("%w: %s resolves to %s", ErrBlocked, host, addr)
+		}
+	}
+
+	return nil
+}
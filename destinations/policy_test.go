@@ -0,0 +1,125 @@
+package destinations_test
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pocockn/downloader/destinations"
+)
+
+func TestPolicy_Blocked(t *testing.T) {
+	policy, err := destinations.New([]string{"10.1.0.0/16"}, nil)
+	require.NoError(t, err)
+
+	for addr, blocked := range map[string]bool{
+		"93.184.216.34":          false,
+		"2606:2800:220:1::":      false,
+		"127.0.0.1":              true,
+		"::1":                    true,
+		"10.0.0.1":               true,
+		"172.16.5.4":             true,
+		"192.168.1.1":            true,
+		"169.254.169.254":        true,
+		"100.100.100.200":        true,
+		"0.0.0.0":                true,
+		"fe80::1":                true,
+		"fd00:ec2::254":          true,
+		"::ffff:169.254.169.254": true,
+		"10.1.2.3":               false,
+		"64:ff9b::a9fe:a9fe":     true,
+		"2002:a9fe:a9fe::":       true,
+		"::a9fe:a9fe":            true,
+		"2001:0:4136:e378::":     true,
+		"240.0.0.1":              true,
+		"255.255.255.255":        true,
+		"2001:db9::1":            false,
+	} {
+		assert.Equal(t, blocked, policy.Blocked(netip.MustParseAddr(addr)), addr)
+	}
+
+	_, err = destinations.New([]string{"10.0.0.0"}, nil)
+	assert.Error(t, err)
+}
+
+func TestPolicy_DialContext(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	serverURL, err := url.Parse(server.URL)
+	require.NoError(t, err)
+	_, port, err := net.SplitHostPort(serverURL.Host)
+	require.NoError(t, err)
+
+	t.Run("Connections to blocked addresses are refused", func(t *testing.T) {
+		policy, err := destinations.New(nil, nil)
+		require.NoError(t, err)
+
+		_, err = policy.DialContext(&net.Dialer{})(context.Background(), "tcp", serverURL.Host)
+		assert.ErrorIs(t, err, destinations.ErrBlocked)
+	})
+
+	t.Run("Allowed CIDRs can be connected to", func(t *testing.T) {
+		policy, err := destinations.New([]string{"127.0.0.0/8"}, nil)
+		require.NoError(t, err)
+
+		conn, err := policy.DialContext(&net.Dialer{})(context.Background(), "tcp", serverURL.Host)
+		require.NoError(t, err)
+		conn.Close()
+	})
+
+	t.Run("Allowed hosts can be connected to wherever they resolve", func(t *testing.T) {
+		policy, err := destinations.New(nil, []string{"LOCALHOST."})
+		require.NoError(t, err)
+
+		conn, err := policy.DialContext(&net.Dialer{})(context.Background(), "tcp", net.JoinHostPort("localhost", port))
+		require.NoError(t, err)
+		conn.Close()
+
+		// the host name is what is allowed, not the address it resolves to.
+		_, err = policy.DialContext(&net.Dialer{})(context.Background(), "tcp", serverURL.Host)
+		assert.ErrorIs(t, err, destinations.ErrBlocked)
+	})
+}
+
+func TestPolicy_Proxied(t *testing.T) {
+	var proxied []string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied = append(proxied, r.URL.Host)
+	}))
+	defer proxy.Close()
+
+	proxyURL, err := url.Parse(proxy.URL)
+	require.NoError(t, err)
+
+	policy, err := destinations.New(nil, []string{"example.com"})
+	require.NoError(t, err)
+
+	client := &http.Client{Transport: policy.Proxied(
+		&http.Transport{Proxy: http.ProxyURL(proxyURL)},
+		http.ProxyURL(proxyURL),
+	)}
+
+	t.Run("Requests through a proxy to blocked hosts are refused", func(t *testing.T) {
+		for _, target := range []string{"http://169.254.169.254/latest/meta-data/", "http://localhost:5000/", "http://[::1]/"} {
+			_, err := client.Get(target)
+			assert.ErrorIs(t, err, destinations.ErrBlocked, target)
+		}
+		assert.Empty(t, proxied)
+	})
+
+	t.Run("Requests through a proxy to allowed hosts are sent", func(t *testing.T) {
+		resp, err := client.Get("http://www.example.com/")
+		require.NoError(t, err)
+		resp.Body.Close()
+
+		assert.Equal(t, []string{"www.example.com"}, proxied)
+	})
+}
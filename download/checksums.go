@@ -0,0 +1,203 @@
+package download
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/pocockn/downloader/models"
+)
+
+// checksumFileSuffix is appended to a URL's path to find the sibling file holding its SHA-256.
+const checksumFileSuffix = ".sha256"
+
+// maxChecksumFile is the most of a checksum file we read, it only needs to hold a line per file.
+const maxChecksumFile = 64 << 10
+
+// verifier hashes a body as it is written to it and checks the digests against the ones expected.
+type verifier struct {
+	digests []digest
+}
+
+// digest is a single expected checksum and the hash that works it out.
+type digest struct {
+	name     string
+	expected string
+	hash     hash.Hash
+}
+
+// newVerifier returns a verifier for the checksums, or nil if there is nothing to check.
+func newVerifier(checksums models.Checksums) *verifier {
+	var v verifier
+	for _, d := range []struct {
+		name     string
+		expected string
+		hash     func() hash.Hash
+	}{
+		{name: "SHA-256", expected: checksums.SHA256, hash: sha256.New},
+		{name: "SHA-512", expected: checksums.SHA512, hash: sha512.New},
+		{name: "MD5", expected: checksums.MD5, hash: md5.New},
+	} {
+		if d.expected != "" {
+			v.digests = append(v.digests, digest{name: d.name, expected: strings.ToLower(d.expected), hash: d.hash()})
+		}
+	}
+
+	if len(v.digests) == 0 {
+		return nil
+	}
+
+	return &v
+}
+
+func (v *verifier) Write(p []byte) (int, error) {
+	for _, d := range v.digests {
+		d.hash.Write(p)
+	}
+	return len(p), nil
+}
+
+// check returns an error wrapping errChecksumMismatch if any digest of what has been written isn't the one expected.
+func (v *verifier) check() error {
+	for _, d := range v.digests {
+		if actual := hex.EncodeToString(d.hash.Sum(nil)); actual != d.expected {
+			return fmt.Errorf("%w: %s is %s, expected %s", errChecksumMismatch, d.name, actual, d.expected)
+		}
+	}
+	return nil
+}
+
+// verifyingReader feeds everything read from r to the verifier. Once r is exhausted it returns the verifier's error in
+// place of io.EOF, so a body that doesn't match fails to be written rather than being committed to storage.
+type verifyingReader struct {
+	r        io.Reader
+	verifier *verifier
+}
+
+func (r *verifyingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.verifier.Write(p[:n])
+	if err == io.EOF {
+		if checkErr := r.verifier.check(); checkErr != nil {
+			return n, checkErr
+		}
+	}
+	return n, err
+}
+
+// Verify checks the body result describes against the checksums url expects. Downloads check their own bodies as they
+// are streamed, Verify is for results that were downloaded for someone else, like a download shared by another
+// submission of the URL. A mismatch fails with ReasonChecksum.
+func (d *Downloader) Verify(ctx context.Context, url models.URL, result *Result) error {
+	checksums, err := d.checksums(ctx, url)
+	if err != nil {
+		return err
+	}
+
+	return verifyFile(url.URL, result.Path, newVerifier(checksums))
+}
+
+// verifyFile checks the file at path against the verifier, a nil verifier passes everything.
+func verifyFile(url, path string, v *verifier) error {
+	if v == nil {
+		return nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return newError(url, ReasonStorage, err)
+	}
+	defer file.Close()
+
+	if _, err := io.Copy(v, file); err != nil {
+		return newError(url, ReasonStorage, err)
+	}
+
+	if err := v.check(); err != nil {
+		return newError(url, ReasonChecksum, err)
+	}
+
+	return nil
+}
+
+// checksums returns the checksums url expects its body to have, fetching the SHA-256 from the sibling checksum file
+// if it is asked for and wasn't given.
+func (d *Downloader) checksums(ctx context.Context, url models.URL) (models.Checksums, error) {
+	checksums := url.Checksums
+	if !checksums.FetchSHA256 || checksums.SHA256 != "" {
+		return checksums, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url.URL, http.NoBody)
+	if err != nil {
+		return checksums, newError(url.URL, ReasonNetwork, err)
+	}
+
+	// the sibling sits next to the file, so the suffix goes on the path rather than after any query.
+	name := path.Base(req.URL.Path)
+	req.URL.Path += checksumFileSuffix
+	if req.URL.RawPath != "" {
+		req.URL.RawPath += checksumFileSuffix
+	}
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return checksums, newError(url.URL, ReasonNetwork, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		statusErr := statusError(url.URL, resp)
+		statusErr.Err = fmt.Errorf("fetching %s: %w", req.URL, statusErr.Err)
+		return checksums, statusErr
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxChecksumFile))
+	if err != nil {
+		return checksums, newError(url.URL, ReasonNetwork, err)
+	}
+
+	checksums.SHA256 = parseChecksumFile(body, name)
+	if err := checksums.Validate(); err != nil || checksums.SHA256 == "" {
+		return checksums, newError(url.URL, ReasonChecksum, fmt.Errorf("%s has no SHA-256 for %s", req.URL, name))
+	}
+
+	return checksums, nil
+}
+
+// parseChecksumFile returns the digest for the file called name from a checksum file in the format sha256sum writes,
+// a digest followed by the file name on each line. A file holding a single digest, with or without a name, is taken
+// to be for name.
+func parseChecksumFile(body []byte, name string) string {
+	var lines [][]string
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	for scanner.Scan() {
+		if fields := strings.Fields(scanner.Text()); len(fields) > 0 {
+			lines = append(lines, fields)
+		}
+	}
+
+	if len(lines) == 1 {
+		return lines[0][0]
+	}
+
+	for _, fields := range lines {
+		// sha256sum marks files it read in binary mode with a *.
+		if len(fields) > 1 && strings.TrimPrefix(fields[1], "*") == name {
+			return fields[0]
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,193 @@
+package download_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pocockn/downloader/content"
+	"github.com/pocockn/downloader/download"
+	"github.com/pocockn/downloader/models"
+	"github.com/pocockn/downloader/store"
+)
+
+func TestDownload_Checksums(t *testing.T) {
+	body := "hello world"
+	sha256 := "b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9"
+	sum512 := sha512.Sum512([]byte(body))
+	sumMD5 := md5.Sum([]byte(body))
+
+	interrupted := make(map[string]bool)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/artifact.tar.gz.sha256":
+			fmt.Fprintf(w, "%s  other.tar.gz\n%s *artifact.tar.gz\n", strings.Repeat("0", 64), sha256)
+		case "/wrong.tar.gz.sha256":
+			fmt.Fprintln(w, strings.Repeat("0", 64))
+		case "/interrupted", "/ranged":
+			// the first response is cut short, the body is then resumed from where it stopped.
+			w.Header().Set("ETag", `"v1"`)
+			if r.URL.Path == "/interrupted" && !interrupted[r.URL.RawQuery] {
+				interrupted[r.URL.RawQuery] = true
+				w.Header().Set("Accept-Ranges", "bytes")
+				w.Header().Set("Content-Length", fmt.Sprint(len(body)))
+				_, _ = w.Write([]byte(body[:6]))
+				w.(http.Flusher).Flush()
+				panic(http.ErrAbortHandler)
+			}
+			http.ServeContent(w, r, "", time.Time{}, strings.NewReader(body))
+		case "/missing.tar.gz.sha256":
+			http.NotFound(w, r)
+		default:
+			_, _ = w.Write([]byte(body))
+		}
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	storage, err := content.New(dir, store.NewMemory())
+	require.NoError(t, err)
+
+	d := download.New(storage, http.DefaultClient, nil, nil, nil, nil)
+
+	t.Run("Bodies matching every checksum are downloaded", func(t *testing.T) {
+		result, err := d.Download(context.Background(), models.URL{
+			URL: server.URL + "/artifact.tar.gz",
+			Checksums: models.Checksums{
+				SHA256: strings.ToUpper(sha256),
+				SHA512: hex.EncodeToString(sum512[:]),
+				MD5:    hex.EncodeToString(sumMD5[:]),
+			},
+		})
+		require.NoError(t, err)
+		assert.Equal(t, sha256, result.Hash)
+	})
+
+	t.Run("Mismatched bodies fail and aren't stored", func(t *testing.T) {
+		before := files(t, dir)
+
+		_, err := d.Download(context.Background(), models.URL{
+			URL:       server.URL + "/tampered.tar.gz",
+			Checksums: models.Checksums{SHA256: sha256, MD5: strings.Repeat("0", 32)},
+		})
+		require.Error(t, err)
+		assert.Equal(t, download.ReasonChecksum, download.ReasonFor(err))
+		assert.Contains(t, err.Error(), "MD5")
+		assert.Equal(t, before, files(t, dir))
+	})
+
+	t.Run("Resumed bodies are checked as a whole", func(t *testing.T) {
+		url := models.URL{URL: server.URL + "/interrupted?matching", Checksums: models.Checksums{SHA256: sha256}}
+		_, err := d.Download(context.Background(), url)
+		require.Error(t, err)
+		assert.Equal(t, download.ReasonNetwork, download.ReasonFor(err))
+
+		result, err := d.Download(context.Background(), url)
+		require.NoError(t, err)
+		assert.Equal(t, sha256, result.Hash)
+	})
+
+	t.Run("Mismatched resumed bodies throw the partial away", func(t *testing.T) {
+		url := models.URL{
+			URL:       server.URL + "/interrupted?mismatched",
+			Checksums: models.Checksums{SHA256: strings.Repeat("0", 64)},
+		}
+		_, err := d.Download(context.Background(), url)
+		require.Error(t, err)
+
+		partials, err := filepath.Glob(filepath.Join(dir, ".partial", "*"))
+		require.NoError(t, err)
+		require.NotEmpty(t, partials)
+
+		_, err = d.Download(context.Background(), url)
+		require.Error(t, err)
+		assert.Equal(t, download.ReasonChecksum, download.ReasonFor(err))
+
+		partials, err = filepath.Glob(filepath.Join(dir, ".partial", "*"))
+		require.NoError(t, err)
+		assert.Empty(t, partials)
+	})
+
+	t.Run("The SHA-256 can be fetched from the sibling checksum file", func(t *testing.T) {
+		result, err := d.Download(context.Background(), models.URL{
+			URL:       server.URL + "/artifact.tar.gz?token=secret",
+			Checksums: models.Checksums{FetchSHA256: true},
+		})
+		require.NoError(t, err)
+		assert.Equal(t, sha256, result.Hash)
+
+		_, err = d.Download(context.Background(), models.URL{
+			URL:       server.URL + "/wrong.tar.gz",
+			Checksums: models.Checksums{FetchSHA256: true},
+		})
+		require.Error(t, err)
+		assert.Equal(t, download.ReasonChecksum, download.ReasonFor(err))
+	})
+
+	t.Run("Missing checksum files fail the download", func(t *testing.T) {
+		_, err := d.Download(context.Background(), models.URL{
+			URL:       server.URL + "/missing.tar.gz",
+			Checksums: models.Checksums{FetchSHA256: true},
+		})
+		require.Error(t, err)
+		assert.Equal(t, download.ReasonStatus, download.ReasonFor(err))
+		assert.Contains(t, err.Error(), "/missing.tar.gz.sha256")
+	})
+
+	t.Run("Segmented bodies are checked before they are stored", func(t *testing.T) {
+		segmented := download.New(storage, http.DefaultClient, nil, nil, download.NewSegmenter(1, 2, 1), nil)
+		before := files(t, dir)
+
+		_, err := segmented.Download(context.Background(), models.URL{
+			URL:       server.URL + "/ranged",
+			Checksums: models.Checksums{SHA256: strings.Repeat("0", 64)},
+		})
+		require.Error(t, err)
+		assert.Equal(t, download.ReasonChecksum, download.ReasonFor(err))
+		assert.Equal(t, before, files(t, dir))
+	})
+
+	t.Run("Shared results are verified against the submission's own checksums", func(t *testing.T) {
+		result, err := d.Download(context.Background(), models.URL{URL: server.URL + "/shared"})
+		require.NoError(t, err)
+
+		require.NoError(t, d.Verify(context.Background(), models.URL{
+			URL:       server.URL + "/shared",
+			Checksums: models.Checksums{SHA256: sha256},
+		}, result))
+
+		err = d.Verify(context.Background(), models.URL{
+			URL:       server.URL + "/shared",
+			Checksums: models.Checksums{SHA512: hex.EncodeToString(bytes.Repeat([]byte{0}, 64))},
+		}, result)
+		require.Error(t, err)
+		assert.Equal(t, download.ReasonChecksum, download.ReasonFor(err))
+	})
+}
+
+// files returns the paths of the files within dir.
+func files(t *testing.T, dir string) []string {
+	var paths []string
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err == nil && !entry.IsDir() {
+			paths = append(paths, path)
+		}
+		return err
+	})
+	require.NoError(t, err)
+
+	return paths
+}
@@ -0,0 +1,466 @@
+package download
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pocockn/downloader/bandwidth"
+	"github.com/pocockn/downloader/content"
+	"github.com/pocockn/downloader/destinations"
+	"github.com/pocockn/downloader/hosts"
+	"github.com/pocockn/downloader/models"
+	"github.com/pocockn/downloader/robots"
+)
+
+// Result describes a body that has been downloaded and written to storage. ETag and LastModified are the validators
+// the server sent with the body. Unchanged is true when the server told us the copy we already had is current, the
+// rest of the result then describes that copy.
+type Result struct {
+	Hash         string
+	Path         string
+	Size         int64
+	ContentType  string
+	ETag         string
+	LastModified string
+	Unchanged    bool
+}
+
+// Options configures the HTTP client used for downloads. A zero timeout means no timeout.
+type Options struct {
+	// UserAgent identifies us to the servers we download from, Go's default is used if it is empty.
+	UserAgent string
+	// ConnectTimeout bounds how long we wait to establish a connection.
+	ConnectTimeout time.Duration
+	// HeaderTimeout bounds how long we wait for the response headers once the request has been sent.
+	HeaderTimeout time.Duration
+	// Timeout bounds the whole download, including reading the body.
+	Timeout time.Duration
+	// Bandwidth throttles the response bodies we read, nil doesn't throttle them.
+	Bandwidth *bandwidth.Limiter
+	// Destinations refuses connections to addresses it blocks, nil connects anywhere.
+	Destinations *destinations.Policy
+}
+
+// NewClient returns an HTTP client with the timeouts, User-Agent, bandwidth limits and destination policy from the
+// options.
+func NewClient(opts Options) *http.Client {
+	dialer := &net.Dialer{
+		Timeout:   opts.ConnectTimeout,
+		KeepAlive: 30 * time.Second,
+	}
+
+	proxy := http.ProxyFromEnvironment
+	dial := dialer.DialContext
+	if opts.Destinations != nil {
+		dial = opts.Destinations.DialContext(dialer)
+	}
+
+	var transport http.RoundTripper = &http.Transport{
+		Proxy:                 proxy,
+		DialContext:           dial,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+		ResponseHeaderTimeout: opts.HeaderTimeout,
+	}
+
+	// the proxy connects to the host for us, so hosts reached through it are checked before the request is sent.
+	if opts.Destinations != nil {
+		transport = opts.Destinations.Proxied(transport, proxy)
+	}
+
+	if opts.Bandwidth != nil {
+		transport = &bandwidthTransport{next: transport, limiter: opts.Bandwidth}
+	}
+
+	if opts.UserAgent != "" {
+		transport = &userAgentTransport{next: transport, userAgent: opts.UserAgent}
+	}
+
+	return &http.Client{Transport: transport, Timeout: opts.Timeout}
+}
+
+// userAgentTransport sets the User-Agent on requests that don't already have one.
+type userAgentTransport struct {
+	next      http.RoundTripper
+	userAgent string
+}
+
+func (t *userAgentTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Header.Get("User-Agent") == "" {
+		// a RoundTripper mustn't modify the request it is given.
+		req = req.Clone(req.Context())
+		req.Header.Set("User-Agent", t.userAgent)
+	}
+
+	return t.next.RoundTrip(req)
+}
+
+// bandwidthTransport throttles response bodies to the limiter's limits for the host they come from.
+type bandwidthTransport struct {
+	next    http.RoundTripper
+	limiter *bandwidth.Limiter
+}
+
+func (t *bandwidthTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	resp.Body = t.limiter.Reader(req.Context(), req.URL.Hostname(), resp.Body)
+
+	return resp, nil
+}
+
+// Downloader performs GET requests and streams the response bodies into storage.
+type Downloader struct {
+	storage   *content.Storage
+	client    *http.Client
+	scheduler *hosts.Scheduler
+	robots    *robots.Checker
+	segmenter *Segmenter
+	policy    *Policy
+}
+
+// New returns a Downloader that uses client to write bodies into the storage passed in. Requests wait for the
+// scheduler to allow them to start and are only made if the site's robots.txt allows them. Large bodies are downloaded
+// in segments by the segmenter, and bodies the policy rejects aren't downloaded at all. A nil scheduler doesn't limit
+// requests at all, a nil checker ignores robots.txt, a nil segmenter downloads every body over a single connection and
+// a nil policy allows every body.
+func New(
+	storage *content.Storage,
+	client *http.Client,
+	scheduler *hosts.Scheduler,
+	checker *robots.Checker,
+	segmenter *Segmenter,
+	policy *Policy,
+) *Downloader {
+	return &Downloader{
+		storage:   storage,
+		client:    client,
+		scheduler: scheduler,
+		robots:    checker,
+		segmenter: segmenter,
+		policy:    policy,
+	}
+}
+
+// Storage returns the storage bodies are written into.
+func (d *Downloader) Storage() *content.Storage {
+	return d.storage
+}
+
+// Download performs a GET request against the URL and streams the body into storage. The request is abandoned if
+// ctx is cancelled, including while it waits for the scheduler. URLs the site's robots.txt disallows fail with
+// ReasonRobots without a request being made. If we still have the body url describes, its validators are sent and a
+// 304 Not Modified returns an Unchanged result without downloading the body again.
+//
+// Bodies from servers that accept byte ranges are kept if the download fails partway through, and the next download
+// of the URL resumes from where it stopped with a Range request. If-Range makes sure the server only sends the rest of
+// the body if it hasn't changed, otherwise it sends the whole body and we start again. With a segmenter, bodies the
+// server says are over its threshold are downloaded in byte ranges over several connections instead.
+//
+// Bodies are checked against the checksums url expects, fetching the SHA-256 from the sibling checksum file if url
+// asks for it. A body that doesn't match fails with ReasonChecksum and is thrown away, along with any partial body, and
+// an unchanged body is checked against the copy we already have.
+//
+// Bodies the policy rejects fail with ReasonTooLarge or ReasonContentType, without the body being read if the headers
+// give it away and as soon as it passes the maximum size otherwise. Failures, including responses with a non 2xx
+// status, are returned as an *Error.
+func (d *Downloader) Download(ctx context.Context, url models.URL) (*Result, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url.URL, http.NoBody)
+	if err != nil {
+		return nil, newError(url.URL, ReasonNetwork, err)
+	}
+
+	if d.robots != nil {
+		rules, err := d.robots.Rules(ctx, req.URL)
+		if err != nil {
+			return nil, newError(url.URL, ReasonNetwork, err)
+		}
+
+		if !rules.Allowed(req.URL.RequestURI()) {
+			return nil, newError(url.URL, ReasonRobots, errDisallowed)
+		}
+
+		if d.scheduler != nil {
+			d.scheduler.SetCrawlDelay(req.URL.Hostname(), rules.CrawlDelay())
+		}
+	}
+
+	if d.scheduler != nil {
+		release, err := d.scheduler.Acquire(ctx, req.URL.Hostname())
+		if err != nil {
+			return nil, newError(url.URL, ReasonNetwork, err)
+		}
+		defer release()
+	}
+
+	checksums, err := d.checksums(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+	verifier := newVerifier(checksums)
+
+	// partial is nil while another download of the URL holds it, this download then can't be resumed.
+	partial, err := d.storage.Partial(url.URL)
+	if err != nil {
+		return nil, newError(url.URL, ReasonStorage, err)
+	}
+	defer partial.Close()
+
+	sent, conditional := d.prepare(req, url, partial)
+
+	if d.segmenter != nil && !partial.Resumable() {
+		if result, ok, err := d.segmented(req, sent, url, conditional, verifier); ok || err != nil {
+			return result, err
+		}
+	}
+
+	resp, err := d.client.Do(sent)
+	if err != nil {
+		return nil, newError(url.URL, ReasonNetwork, err)
+	}
+
+	if resp.StatusCode == http.StatusRequestedRangeNotSatisfiable && partial.Resumable() {
+		// the partial body doesn't fit the body the server has now, start again from the beginning.
+		resp.Body.Close()
+		if err := partial.Discard(); err != nil {
+			return nil, newError(url.URL, ReasonStorage, err)
+		}
+
+		sent, conditional = d.prepare(req, url, partial)
+		if resp, err = d.client.Do(sent); err != nil {
+			return nil, newError(url.URL, ReasonNetwork, err)
+		}
+	}
+	defer resp.Body.Close()
+
+	if conditional && resp.StatusCode == http.StatusNotModified {
+		return d.unchanged(url, resp, verifier)
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, statusError(url.URL, resp)
+	}
+
+	if err := d.policy.check(url.URL, resp); err != nil {
+		// a body we won't download isn't worth resuming either.
+		if discardErr := partial.Discard(); discardErr != nil {
+			return nil, newError(url.URL, ReasonStorage, discardErr)
+		}
+		return nil, err
+	}
+
+	// a body we didn't know was big enough to segment is dropped once its headers say it is, and fetched in segments.
+	if !partial.Resumable() {
+		if validator, ok := d.segmentable(resp); ok {
+			resp.Body.Close()
+			return d.fromSegments(req, url.URL, resp, validator, verifier)
+		}
+	}
+
+	blob, err := d.save(url, resp, partial, verifier)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Result{
+		Hash:         blob.Hash,
+		Path:         blob.Path,
+		Size:         blob.Size,
+		ContentType:  resp.Header.Get("Content-Type"),
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+	}, nil
+}
+
+// unchanged returns the result for a 304, it describes the body we already have. That body is checked against the
+// verifier, since the checksums expected of it may have changed since it was downloaded.
+func (d *Downloader) unchanged(url models.URL, resp *http.Response, v *verifier) (*Result, error) {
+	result := &Result{
+		Hash:         url.ContentHash,
+		Path:         d.storage.Path(url.ContentHash),
+		Size:         url.Size,
+		ContentType:  url.ContentType,
+		ETag:         header(resp, "ETag", url.ETag),
+		LastModified: header(resp, "Last-Modified", url.LastModified),
+		Unchanged:    true,
+	}
+
+	if err := verifyFile(url.URL, result.Path, v); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// prepare returns the request to send for url. If there is a partial body it asks for the rest of it, otherwise if we
+// still have the body url describes it asks whether it has changed, conditional reports whether it does.
+func (d *Downloader) prepare(
+	req *http.Request,
+	url models.URL,
+	partial *content.Partial,
+) (sent *http.Request, conditional bool) {
+	sent = req.Clone(req.Context())
+
+	if partial.Resumable() {
+		sent.Header.Set("Range", fmt.Sprintf("bytes=%d-", partial.Size))
+		sent.Header.Set("If-Range", partial.Validator)
+		return sent, false
+	}
+
+	// only ask whether the body has changed if we can still serve the copy we have when it hasn't.
+	if (url.ETag == "" && url.LastModified == "") || !d.storage.Exists(url.ContentHash) {
+		return sent, false
+	}
+
+	if url.ETag != "" {
+		sent.Header.Set("If-None-Match", url.ETag)
+	}
+	if url.LastModified != "" {
+		sent.Header.Set("If-Modified-Since", url.LastModified)
+	}
+
+	return sent, true
+}
+
+// save streams the response body into storage. A 206 is appended to the partial body it resumes. Other bodies are
+// written into the partial if the server would let us resume them, so a failure partway through isn't wasted, and
+// into a temp file otherwise. With a verifier the body is checked before it is committed to storage, a body that
+// doesn't match is thrown away rather than kept to be resumed, as is a body that turns out to be over the policy's
+// maximum size.
+func (d *Downloader) save(
+	url models.URL,
+	resp *http.Response,
+	partial *content.Partial,
+	v *verifier,
+) (content.Blob, error) {
+	var offset int64
+	validator := resumeValidator(resp)
+
+	if resp.StatusCode == http.StatusPartialContent {
+		start, ok := rangeStart(resp)
+		if !partial.Resumable() || !ok || start != partial.Size {
+			if err := partial.Discard(); err != nil {
+				return content.Blob{}, newError(url.URL, ReasonStorage, err)
+			}
+			return content.Blob{}, newError(url.URL, ReasonNetwork, errUnexpectedRange)
+		}
+		offset, validator = start, partial.Validator
+	}
+
+	body := &bodyReader{r: resp.Body}
+
+	r := d.policy.limit(body, offset)
+	if v != nil {
+		// the part of a resumed body we already have is checked along with the rest of it.
+		if err := partial.Copy(v, offset); err != nil {
+			return content.Blob{}, newError(url.URL, ReasonStorage, err)
+		}
+		r = &verifyingReader{r: r, verifier: v}
+	}
+
+	var blob content.Blob
+	var err error
+	if partial != nil && validator != "" {
+		blob, err = d.storage.SavePartial(partial, r, offset, validator)
+	} else {
+		if err := partial.Discard(); err != nil {
+			return content.Blob{}, newError(url.URL, ReasonStorage, err)
+		}
+		blob, err = d.storage.Save(r)
+	}
+
+	if reason, rejected := rejection(err); rejected {
+		if err := partial.Discard(); err != nil {
+			return content.Blob{}, newError(url.URL, ReasonStorage, err)
+		}
+		return content.Blob{}, newError(url.URL, reason, err)
+	}
+
+	if err != nil {
+		// failures reading the body are network failures, anything else went wrong writing it to disk.
+		if body.err != nil {
+			return content.Blob{}, newError(url.URL, ReasonNetwork, body.err)
+		}
+		return content.Blob{}, newError(url.URL, ReasonStorage, err)
+	}
+
+	return blob, nil
+}
+
+// rejection returns the reason a body was rejected while it was being written, rejected is false if it wasn't.
+func rejection(err error) (reason Reason, rejected bool) {
+	switch {
+	case errors.Is(err, errChecksumMismatch):
+		return ReasonChecksum, true
+	case errors.Is(err, errTooLarge):
+		return ReasonTooLarge, true
+	default:
+		return "", false
+	}
+}
+
+// resumeValidator returns the validator to resume the body of resp with, empty if it can't be resumed. Resuming
+// needs the server to accept byte ranges and a strong validator, a weak ETag can't be used with If-Range.
+func resumeValidator(resp *http.Response) string {
+	if resp.Header.Get("Accept-Ranges") != "bytes" {
+		return ""
+	}
+
+	if etag := resp.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		return etag
+	}
+
+	return resp.Header.Get("Last-Modified")
+}
+
+// rangeStart returns the offset a 206 response's body starts at, from its Content-Range header.
+func rangeStart(resp *http.Response) (int64, bool) {
+	unit, spec, ok := strings.Cut(resp.Header.Get("Content-Range"), " ")
+	if !ok || unit != "bytes" {
+		return 0, false
+	}
+
+	first, _, ok := strings.Cut(spec, "-")
+	if !ok {
+		return 0, false
+	}
+
+	start, err := strconv.ParseInt(first, 10, 64)
+	return start, err == nil
+}
+
+// header returns the response header with the given name, or fallback if the server didn't send it. A 304 only has
+// to repeat the validators that changed.
+func header(resp *http.Response, name, fallback string) string {
+	if value := resp.Header.Get(name); value != "" {
+		return value
+	}
+	return fallback
+}
+
+// bodyReader remembers the error returned reading the response body.
+type bodyReader struct {
+	r   io.Reader
+	err error
+}
+
+func (b *bodyReader) Read(p []byte) (int, error) {
+	n, err := b.r.Read(p)
+	if err != nil && err != io.EOF {
+		b.err = err
+	}
+	return n, err
+}
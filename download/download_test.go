@@ -0,0 +1,388 @@
+package download_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jarcoal/httpmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pocockn/downloader/content"
+	"github.com/pocockn/downloader/destinations"
+	"github.com/pocockn/downloader/download"
+	"github.com/pocockn/downloader/hosts"
+	"github.com/pocockn/downloader/models"
+	"github.com/pocockn/downloader/robots"
+	"github.com/pocockn/downloader/store"
+)
+
+func TestDownload(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	storage, err := content.New(t.TempDir(), store.NewMemory())
+	require.NoError(t, err)
+
+	d := download.New(storage, http.DefaultClient, nil, nil, nil, nil)
+
+	t.Run("Bodies are streamed into storage", func(t *testing.T) {
+		url := models.URL{URL: "http://www.example.com"}
+
+		resp := httpmock.NewStringResponse(200, "<html></html>")
+		resp.Header.Set("Content-Type", "text/html")
+		httpmock.RegisterResponder("GET", url.URL, httpmock.ResponderFromResponse(resp))
+
+		result, err := d.Download(context.Background(), url)
+		require.NoError(t, err)
+
+		assert.Equal(t, storage.Path(result.Hash), result.Path)
+		assert.Equal(t, int64(13), result.Size)
+		assert.Equal(t, "text/html", result.ContentType)
+
+		body, err := os.ReadFile(result.Path)
+		require.NoError(t, err)
+		assert.Equal(t, "<html></html>", string(body))
+	})
+
+	t.Run("Unsuccessful statuses are returned as errors", func(t *testing.T) {
+		url := models.URL{URL: "http://www.unavailable.com"}
+
+		resp := httpmock.NewStringResponse(http.StatusServiceUnavailable, "")
+		resp.Header.Set("Retry-After", "120")
+		httpmock.RegisterResponder(http.MethodGet, url.URL, httpmock.ResponderFromResponse(resp))
+
+		_, err := d.Download(context.Background(), url)
+		require.Error(t, err)
+
+		var downloadErr *download.Error
+		require.ErrorAs(t, err, &downloadErr)
+		assert.Equal(t, download.ReasonStatus, downloadErr.Reason)
+		assert.Equal(t, http.StatusServiceUnavailable, downloadErr.StatusCode)
+		assert.Equal(t, 2*time.Minute, downloadErr.RetryAfter)
+	})
+
+	t.Run("Request errors are returned", func(t *testing.T) {
+		url := models.URL{URL: "http://www.error.com"}
+
+		httpmock.RegisterResponder(
+			http.MethodGet,
+			url.URL,
+			httpmock.NewErrorResponder(fmt.Errorf("big error")),
+		)
+
+		_, err := d.Download(context.Background(), url)
+		assert.Error(t, err)
+	})
+}
+
+func TestDownload_Failures(t *testing.T) {
+	storage, err := content.New(t.TempDir(), store.NewMemory())
+	require.NoError(t, err)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(time.Second):
+		case <-r.Context().Done():
+		}
+	}))
+	defer server.Close()
+
+	t.Run("Slow responses time out", func(t *testing.T) {
+		client := download.NewClient(download.Options{HeaderTimeout: 50 * time.Millisecond})
+		d := download.New(storage, client, nil, nil, nil, nil)
+
+		_, err := d.Download(context.Background(), models.URL{URL: server.URL})
+		require.Error(t, err)
+		assert.Equal(t, download.ReasonTimeout, download.ReasonFor(err))
+	})
+
+	t.Run("Cancelled downloads are abandoned", func(t *testing.T) {
+		d := download.New(storage, download.NewClient(download.Options{}), nil, nil, nil, nil)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(50*time.Millisecond, cancel)
+
+		_, err := d.Download(ctx, models.URL{URL: server.URL})
+		require.Error(t, err)
+		assert.Equal(t, download.ReasonCanceled, download.ReasonFor(err))
+	})
+
+	t.Run("Downloads waiting for the scheduler are abandoned", func(t *testing.T) {
+		scheduler := hosts.New(hosts.Limits{Concurrency: 1}, nil)
+		release, err := scheduler.Acquire(context.Background(), "127.0.0.1")
+		require.NoError(t, err)
+		defer release()
+
+		d := download.New(storage, download.NewClient(download.Options{}), scheduler, nil, nil, nil)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(50*time.Millisecond, cancel)
+
+		_, err = d.Download(ctx, models.URL{URL: server.URL})
+		require.Error(t, err)
+		assert.Equal(t, download.ReasonCanceled, download.ReasonFor(err))
+	})
+
+	t.Run("Failures are recorded on the URL's record", func(t *testing.T) {
+		db := store.NewMemory()
+		bytes, err := json.Marshal(models.URL{URL: server.URL, Submitted: 1})
+		require.NoError(t, err)
+		require.NoError(t, db.Set(server.URL, bytes))
+
+		downloadErr := &download.Error{URL: server.URL, Reason: download.ReasonTimeout, Err: context.DeadlineExceeded}
+		require.NoError(t, download.RecordFailure(db, server.URL, downloadErr, 2))
+		require.NoError(t, download.RecordFailure(db, "http://www.unseen.com", downloadErr, 2))
+
+		bytes, err = db.Get(server.URL)
+		require.NoError(t, err)
+
+		var url models.URL
+		require.NoError(t, json.Unmarshal(bytes, &url))
+		assert.Equal(t, 1, url.Submitted)
+		assert.Equal(t, "timeout", url.FailureReason)
+		assert.Equal(t, downloadErr.Error(), url.LastError)
+		assert.Equal(t, 2, url.Attempts)
+
+		bytes, err = db.Get("http://www.unseen.com")
+		require.NoError(t, err)
+		require.NotNil(t, bytes)
+
+		var unseen models.URL
+		require.NoError(t, json.Unmarshal(bytes, &unseen))
+		assert.Equal(t, "http://www.unseen.com", unseen.URL)
+		assert.Zero(t, unseen.Submitted)
+		assert.Equal(t, "timeout", unseen.FailureReason)
+		assert.Equal(t, 2, unseen.Attempts)
+	})
+}
+
+func TestDownload_Robots(t *testing.T) {
+	storage, err := content.New(t.TempDir(), store.NewMemory())
+	require.NoError(t, err)
+
+	var agents []string
+	var mu sync.Mutex
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		agents = append(agents, r.URL.Path+" "+r.UserAgent())
+		mu.Unlock()
+
+		if r.URL.Path == "/robots.txt" {
+			_, _ = w.Write([]byte("User-agent: downloader\nDisallow: /private\nCrawl-delay: 1\n"))
+			return
+		}
+		_, _ = w.Write([]byte(`hello`))
+	}))
+	defer server.Close()
+
+	client := download.NewClient(download.Options{UserAgent: "downloader/1.0"})
+	scheduler := hosts.New(hosts.Limits{}, nil)
+	d := download.New(storage, client, scheduler, robots.NewChecker(client, "downloader/1.0", time.Hour), nil, nil)
+
+	t.Run("Allowed URLs are downloaded with our User-Agent", func(t *testing.T) {
+		result, err := d.Download(context.Background(), models.URL{URL: server.URL + "/public"})
+		require.NoError(t, err)
+		assert.Equal(t, int64(5), result.Size)
+		assert.Equal(t, []string{"/robots.txt downloader/1.0", "/public downloader/1.0"}, agents)
+	})
+
+	t.Run("The crawl delay is applied to the host", func(t *testing.T) {
+		start := time.Now()
+		_, err := d.Download(context.Background(), models.URL{URL: server.URL + "/public"})
+		require.NoError(t, err)
+		assert.GreaterOrEqual(t, time.Since(start), 900*time.Millisecond)
+	})
+
+	t.Run("Disallowed URLs fail without a request", func(t *testing.T) {
+		_, err := d.Download(context.Background(), models.URL{URL: server.URL + "/private/file"})
+		require.Error(t, err)
+		assert.Equal(t, download.ReasonRobots, download.ReasonFor(err))
+		assert.Len(t, agents, 3)
+	})
+}
+
+func TestDownload_Destinations(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/redirect" {
+			http.Redirect(w, r, "http://169.254.169.254/latest/meta-data/", http.StatusFound)
+			return
+		}
+		_, _ = w.Write([]byte("hello"))
+	}))
+	defer server.Close()
+
+	storage, err := content.New(t.TempDir(), store.NewMemory())
+	require.NoError(t, err)
+
+	t.Run("URLs on blocked addresses fail with the blocked reason", func(t *testing.T) {
+		policy, err := destinations.New(nil, nil)
+		require.NoError(t, err)
+
+		d := download.New(storage, download.NewClient(download.Options{Destinations: policy}), nil, nil, nil, nil)
+		_, err = d.Download(context.Background(), models.URL{URL: server.URL})
+		require.Error(t, err)
+		assert.Equal(t, download.ReasonBlocked, download.ReasonFor(err))
+	})
+
+	t.Run("Redirects to blocked addresses are refused", func(t *testing.T) {
+		// the test server is on loopback, so it has to be allowed.
+		policy, err := destinations.New([]string{"127.0.0.1/32"}, nil)
+		require.NoError(t, err)
+
+		d := download.New(storage, download.NewClient(download.Options{Destinations: policy}), nil, nil, nil, nil)
+		result, err := d.Download(context.Background(), models.URL{URL: server.URL})
+		require.NoError(t, err)
+		assert.Equal(t, int64(5), result.Size)
+
+		_, err = d.Download(context.Background(), models.URL{URL: server.URL + "/redirect"})
+		require.Error(t, err)
+		assert.Equal(t, download.ReasonBlocked, download.ReasonFor(err))
+		assert.Contains(t, err.Error(), "169.254.169.254")
+	})
+}
+
+func TestDownload_Conditional(t *testing.T) {
+	storage, err := content.New(t.TempDir(), store.NewMemory())
+	require.NoError(t, err)
+
+	var conditions []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conditions = append(conditions, r.Header.Get("If-None-Match")+"|"+r.Header.Get("If-Modified-Since"))
+
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Last-Modified", "Wed, 21 Oct 2015 07:28:00 GMT")
+		_, _ = w.Write([]byte(`hello`))
+	}))
+	defer server.Close()
+
+	d := download.New(storage, http.DefaultClient, nil, nil, nil, nil)
+
+	first, err := d.Download(context.Background(), models.URL{URL: server.URL})
+	require.NoError(t, err)
+
+	t.Run("Validators are returned with the body", func(t *testing.T) {
+		assert.False(t, first.Unchanged)
+		assert.Equal(t, `"v1"`, first.ETag)
+		assert.Equal(t, "Wed, 21 Oct 2015 07:28:00 GMT", first.LastModified)
+	})
+
+	t.Run("Unchanged bodies aren't downloaded again", func(t *testing.T) {
+		url := models.URL{
+			URL:          server.URL,
+			ContentHash:  first.Hash,
+			Size:         first.Size,
+			ETag:         first.ETag,
+			LastModified: first.LastModified,
+		}
+
+		result, err := d.Download(context.Background(), url)
+		require.NoError(t, err)
+		assert.True(t, result.Unchanged)
+		assert.Equal(t, first.Hash, result.Hash)
+		assert.Equal(t, first.Path, result.Path)
+		assert.Equal(t, int64(5), result.Size)
+		assert.Equal(t, `"v1"`, result.ETag)
+		assert.Equal(t, `"v1"|Wed, 21 Oct 2015 07:28:00 GMT`, conditions[1])
+	})
+
+	t.Run("Validators aren't sent if we no longer have the body", func(t *testing.T) {
+		url := models.URL{URL: server.URL, ContentHash: "0000missing", ETag: first.ETag}
+
+		result, err := d.Download(context.Background(), url)
+		require.NoError(t, err)
+		assert.False(t, result.Unchanged)
+		assert.Equal(t, "|", conditions[2])
+	})
+}
+
+func TestDownload_Resume(t *testing.T) {
+	storage, err := content.New(t.TempDir(), store.NewMemory())
+	require.NoError(t, err)
+
+	body := "hello world"
+	etag := `"v1"`
+
+	// every path drops the connection halfway through its first response.
+	ranges := make(map[string][]string)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		first := len(ranges[r.URL.Path]) == 0
+		ranges[r.URL.Path] = append(ranges[r.URL.Path], r.Header.Get("Range")+"|"+r.Header.Get("If-Range"))
+
+		w.Header().Set("Accept-Ranges", "bytes")
+		w.Header().Set("ETag", etag)
+
+		switch {
+		case r.URL.Path == "/unsatisfiable" && r.Header.Get("Range") != "":
+			w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+		case r.Header.Get("Range") != "" && r.Header.Get("If-Range") == etag:
+			var start int
+			_, err := fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-", &start)
+			assert.NoError(t, err)
+
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, len(body)-1, len(body)))
+			w.WriteHeader(http.StatusPartialContent)
+			_, _ = w.Write([]byte(body[start:]))
+		case first:
+			w.Header().Set("Content-Length", fmt.Sprint(len(body)))
+			_, _ = w.Write([]byte(body[:6]))
+			w.(http.Flusher).Flush()
+			panic(http.ErrAbortHandler)
+		default:
+			_, _ = w.Write([]byte(body))
+		}
+	}))
+	defer server.Close()
+
+	d := download.New(storage, http.DefaultClient, nil, nil, nil, nil)
+
+	t.Run("Interrupted downloads resume where they stopped", func(t *testing.T) {
+		_, err := d.Download(context.Background(), models.URL{URL: server.URL + "/resume"})
+		require.Error(t, err)
+		assert.Equal(t, download.ReasonNetwork, download.ReasonFor(err))
+
+		result, err := d.Download(context.Background(), models.URL{URL: server.URL + "/resume"})
+		require.NoError(t, err)
+		assert.Equal(t, int64(11), result.Size)
+		assert.Equal(t, []string{"|", `bytes=6-|"v1"`}, ranges["/resume"])
+
+		bytes, err := os.ReadFile(result.Path)
+		require.NoError(t, err)
+		assert.Equal(t, body, string(bytes))
+	})
+
+	t.Run("Changed bodies are downloaded in full", func(t *testing.T) {
+		_, err := d.Download(context.Background(), models.URL{URL: server.URL + "/changed"})
+		require.Error(t, err)
+
+		// the server has a new version of the body, so it ignores the range and sends all of it.
+		etag = `"v2"`
+		defer func() { etag = `"v1"` }()
+
+		result, err := d.Download(context.Background(), models.URL{URL: server.URL + "/changed"})
+		require.NoError(t, err)
+		assert.Equal(t, int64(11), result.Size)
+		assert.Equal(t, []string{"|", `bytes=6-|"v1"`}, ranges["/changed"])
+	})
+
+	t.Run("Unsatisfiable ranges fall back to a full download", func(t *testing.T) {
+		_, err := d.Download(context.Background(), models.URL{URL: server.URL + "/unsatisfiable"})
+		require.Error(t, err)
+
+		result, err := d.Download(context.Background(), models.URL{URL: server.URL + "/unsatisfiable"})
+		require.NoError(t, err)
+		assert.Equal(t, int64(11), result.Size)
+		assert.Equal(t, []string{"|", `bytes=6-|"v1"`, "|"}, ranges["/unsatisfiable"])
+	})
+}
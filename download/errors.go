@@ -0,0 +1,156 @@
+package download
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/pocockn/downloader/destinations"
+	"github.com/pocockn/downloader/models"
+	"github.com/pocockn/downloader/store"
+)
+
+// Reason describes why a download failed.
+type Reason string
+
+// Reasons a download can fail for.
+const (
+	ReasonTimeout  Reason = "timeout"
+	ReasonCanceled Reason = "canceled"
+	ReasonNetwork  Reason = "network"
+	ReasonStorage  Reason = "storage"
+	ReasonStatus   Reason = "status"
+	// ReasonRobots is used when the site's robots.txt disallows the URL.
+	ReasonRobots Reason = "robots"
+	// ReasonChecksum is used when the body doesn't have the checksums it was expected to have.
+	ReasonChecksum Reason = "checksum"
+	// ReasonTooLarge is used when the body is bigger than the maximum size we download.
+	ReasonTooLarge Reason = "too_large"
+	// ReasonContentType is used when the body's content type isn't one we download.
+	ReasonContentType Reason = "content_type"
+	// ReasonBlocked is used when the URL, or a redirect it led to, points somewhere we don't connect to.
+	ReasonBlocked Reason = "blocked"
+)
+
+var (
+	// errDisallowed is returned for URLs the site's robots.txt disallows.
+	errDisallowed = errors.New("disallowed by robots.txt")
+	// errUnexpectedRange is returned when a server resumes a download from somewhere other than where we asked.
+	errUnexpectedRange = errors.New("unexpected content range")
+	// errChanged is returned when a body changes while it is being downloaded in segments.
+	errChanged = errors.New("body changed during the download")
+	// errChecksumMismatch is returned when a body doesn't have the checksum it was expected to have.
+	errChecksumMismatch = errors.New("checksum mismatch")
+	// errTooLarge is returned when a body is bigger than the maximum size.
+	errTooLarge = errors.New("body too large")
+	// errContentType is returned when a body's content type isn't allowed.
+	errContentType = errors.New("content type not allowed")
+)
+
+// Error is returned when a download fails, it records why so failures can be reported by reason. StatusCode and
+// RetryAfter are set when the server responded with an unsuccessful status.
+type Error struct {
+	URL        string
+	Reason     Reason
+	Err        error
+	StatusCode int
+	RetryAfter time.Duration
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("downloading %s failed (%s): %v", e.URL, e.Reason, e.Err)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// ReasonFor returns the reason err was returned for, or an empty reason if it isn't a download Error.
+func ReasonFor(err error) Reason {
+	var downloadErr *Error
+	if errors.As(err, &downloadErr) {
+		return downloadErr.Reason
+	}
+
+	return ""
+}
+
+// newError wraps err in an Error, classifying timeouts, cancellations and blocked destinations separately from other
+// failures.
+func newError(url string, fallback Reason, err error) *Error {
+	reason := fallback
+
+	var netErr net.Error
+	switch {
+	case errors.Is(err, destinations.ErrBlocked):
+		reason = ReasonBlocked
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		reason = ReasonTimeout
+	case errors.Is(err, context.Canceled):
+		reason = ReasonCanceled
+	}
+
+	return &Error{URL: url, Reason: reason, Err: err}
+}
+
+// statusError builds the Error for an unsuccessful response, reading any Retry-After header.
+func statusError(url string, resp *http.Response) *Error {
+	return &Error{
+		URL:        url,
+		Reason:     ReasonStatus,
+		Err:        fmt.Errorf("unexpected status %s", resp.Status),
+		StatusCode: resp.StatusCode,
+		RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()),
+	}
+}
+
+// parseRetryAfter parses a Retry-After header, which is either a number of seconds or an HTTP date. Missing or
+// invalid values return zero.
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	if value == "" {
+		return 0
+	}
+
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+
+	if at, err := http.ParseTime(value); err == nil && at.After(now) {
+		return at.Sub(now)
+	}
+
+	return 0
+}
+
+// RecordFailure stores why the last download of the URL under key failed, and how many attempts were made, on its
+// record. URLs that have never been downloaded successfully are given a record holding only the failure, their
+// Submitted count is left at zero until a download succeeds.
+func RecordFailure(s store.Store, key string, err error, attempts int) error {
+	return s.Update(key, func(old []byte) ([]byte, error) {
+		url := models.URL{URL: key}
+		if old != nil {
+			if err := json.Unmarshal(old, &url); err != nil {
+				return nil, fmt.Errorf("unable to unmarshal bytes into URL")
+			}
+		}
+
+		url.FailureReason = string(ReasonFor(err))
+		url.LastError = err.Error()
+		url.Attempts = attempts
+
+		bytes, err := json.Marshal(url)
+		if err != nil {
+			return nil, fmt.Errorf("unable to marshal URL into bytes")
+		}
+
+		return bytes, nil
+	})
+}
@@ -0,0 +1,151 @@
+package download
+
+import (
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// defaultContentType is what a body without a Content-Type is taken to be.
+const defaultContentType = "application/octet-stream"
+
+// Policy restricts what we are willing to download, by the size of the body and its content type. A nil Policy
+// allows everything.
+type Policy struct {
+	maxSize int64
+	allow   []string
+	deny    []string
+}
+
+// NewPolicy returns a Policy that rejects bodies over maxSize bytes, zero meaning no limit, and bodies whose content
+// type is denied or, if there is an allow list, isn't allowed. Types are media types without parameters, like
+// "text/html", and "image/*" covers every image type.
+func NewPolicy(maxSize int64, allow, deny []string) (*Policy, error) {
+	p := &Policy{maxSize: maxSize}
+
+	var err error
+	if p.allow, err = mediaTypes(allow); err != nil {
+		return nil, err
+	}
+	if p.deny, err = mediaTypes(deny); err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// mediaTypes checks and normalises a list of media types.
+func mediaTypes(types []string) ([]string, error) {
+	normalised := make([]string, 0, len(types))
+	for _, t := range types {
+		mediaType, params, err := mime.ParseMediaType(t)
+		if err != nil || len(params) > 0 || !strings.Contains(mediaType, "/") {
+			return nil, fmt.Errorf("invalid content type %q", t)
+		}
+		normalised = append(normalised, mediaType)
+	}
+
+	return normalised, nil
+}
+
+// check rejects a response whose content type isn't allowed or whose body the headers say is too big, before any of
+// the body is read.
+func (p *Policy) check(url string, resp *http.Response) error {
+	if p == nil {
+		return nil
+	}
+
+	if size := declaredSize(resp); p.maxSize > 0 && size > p.maxSize {
+		return newError(url, ReasonTooLarge, fmt.Errorf("%w: %d bytes, the limit is %d", errTooLarge, size, p.maxSize))
+	}
+
+	header := resp.Header.Get("Content-Type")
+	mediaType := defaultContentType
+	if header != "" {
+		var err error
+		if mediaType, _, err = mime.ParseMediaType(header); err != nil {
+			return newError(url, ReasonContentType, fmt.Errorf("%w: %q", errContentType, header))
+		}
+	}
+
+	if matches(p.deny, mediaType) || (len(p.allow) > 0 && !matches(p.allow, mediaType)) {
+		return newError(url, ReasonContentType, fmt.Errorf("%w: %s", errContentType, mediaType))
+	}
+
+	return nil
+}
+
+// matches reports whether the media type is one of the types, or covered by a wildcard.
+func matches(types []string, mediaType string) bool {
+	for _, t := range types {
+		if t == mediaType || t == "*/*" {
+			return true
+		}
+		if prefix, ok := strings.CutSuffix(t, "/*"); ok && strings.HasPrefix(mediaType, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// declaredSize returns the size of the whole body from the response headers, or -1 if they don't say. A 206 only
+// declares the size of the rest of the body, from where its range starts.
+func declaredSize(resp *http.Response) int64 {
+	if resp.ContentLength < 0 {
+		return -1
+	}
+
+	if resp.StatusCode == http.StatusPartialContent {
+		start, ok := rangeStart(resp)
+		if !ok {
+			return -1
+		}
+		return start + resp.ContentLength
+	}
+
+	return resp.ContentLength
+}
+
+// limit returns a reader for the body from offset on that fails with errTooLarge once the whole body passes the
+// maximum size, for servers that don't declare the size or send more than they declared. A body resumed from at or
+// past the maximum size, kept from before the maximum was lowered, fails before anything is read, since the server
+// only answers a range with more of the body.
+func (p *Policy) limit(r io.Reader, offset int64) io.Reader {
+	if p == nil || p.maxSize <= 0 {
+		return r
+	}
+
+	left := p.maxSize - offset
+	if left <= 0 {
+		left = -1
+	}
+	return &limitedReader{r: r, left: left, max: p.maxSize}
+}
+
+// limitedReader reads from r until more than left bytes have been read.
+type limitedReader struct {
+	r    io.Reader
+	left int64
+	max  int64
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if l.left < 0 {
+		return 0, fmt.Errorf("%w: the limit is %d bytes", errTooLarge, l.max)
+	}
+
+	// read one byte past the limit, so a body of exactly the limit still gets to io.EOF.
+	if int64(len(p)) > l.left+1 {
+		p = p[:l.left+1]
+	}
+
+	n, err := l.r.Read(p)
+	l.left -= int64(n)
+	if l.left < 0 {
+		return n, fmt.Errorf("%w: the limit is %d bytes", errTooLarge, l.max)
+	}
+
+	return n, err
+}
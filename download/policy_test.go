@@ -0,0 +1,158 @@
+package download_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pocockn/downloader/content"
+	"github.com/pocockn/downloader/download"
+	"github.com/pocockn/downloader/models"
+	"github.com/pocockn/downloader/store"
+)
+
+func TestDownload_Policy(t *testing.T) {
+	var gets int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			atomic.AddInt32(&gets, 1)
+		}
+
+		size := 1024
+		switch r.URL.Path {
+		case "/declared", "/streamed":
+			size = 2048
+		}
+
+		w.Header().Set("Content-Type", strings.TrimPrefix(r.URL.Query().Get("type"), "none"))
+		if r.URL.Query().Get("type") == "none" {
+			// stop the server sniffing a content type for us.
+			w.Header()["Content-Type"] = nil
+		}
+
+		switch r.URL.Path {
+		case "/streamed", "/exact":
+			// without a Content-Length the body is sent in chunks, so the size is only known once it is read.
+			for i := 0; i < size; i += 256 {
+				_, _ = w.Write([]byte(strings.Repeat("a", 256)))
+				w.(http.Flusher).Flush()
+			}
+		default:
+			w.Header().Set("Content-Length", fmt.Sprint(size))
+			_, _ = w.Write([]byte(strings.Repeat("a", size)))
+		}
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	storage, err := content.New(dir, store.NewMemory())
+	require.NoError(t, err)
+
+	policy, err := download.NewPolicy(1024, []string{"text/*", "image/png"}, []string{"text/csv"})
+	require.NoError(t, err)
+
+	d := download.New(storage, http.DefaultClient, nil, nil, nil, policy)
+
+	t.Run("Allowed bodies within the maximum size are downloaded", func(t *testing.T) {
+		for _, path := range []string{"/small?type=text/html%3B+charset%3Dutf-8", "/exact?type=image/png"} {
+			result, err := d.Download(context.Background(), models.URL{URL: server.URL + path})
+			require.NoError(t, err, path)
+			assert.Equal(t, int64(1024), result.Size)
+		}
+	})
+
+	t.Run("Bodies over the maximum size are rejected", func(t *testing.T) {
+		before := files(t, dir)
+
+		for _, path := range []string{"/declared?type=text/plain", "/streamed?type=text/plain"} {
+			_, err := d.Download(context.Background(), models.URL{URL: server.URL + path})
+			require.Error(t, err, path)
+			assert.Equal(t, download.ReasonTooLarge, download.ReasonFor(err), path)
+		}
+
+		assert.Equal(t, before, files(t, dir))
+	})
+
+	t.Run("Bodies with content types that aren't allowed are rejected", func(t *testing.T) {
+		for _, path := range []string{"/small?type=text/csv", "/small?type=application/json", "/small?type=none"} {
+			_, err := d.Download(context.Background(), models.URL{URL: server.URL + path})
+			require.Error(t, err, path)
+			assert.Equal(t, download.ReasonContentType, download.ReasonFor(err), path)
+		}
+	})
+
+	t.Run("Segmented downloads are rejected from the HEAD response", func(t *testing.T) {
+		segmented := download.New(storage, http.DefaultClient, nil, nil, download.NewSegmenter(1, 2, 1), policy)
+		atomic.StoreInt32(&gets, 0)
+
+		// the URL's last body was big enough to segment, so it is asked about with a HEAD request.
+		url := models.URL{URL: server.URL + "/declared?type=text/plain", Size: 2048}
+		_, err := segmented.Download(context.Background(), url)
+		require.Error(t, err)
+		assert.Equal(t, download.ReasonTooLarge, download.ReasonFor(err))
+		assert.Zero(t, atomic.LoadInt32(&gets))
+	})
+
+	t.Run("Invalid content types are refused", func(t *testing.T) {
+		_, err := download.NewPolicy(0, []string{"text"}, nil)
+		assert.Error(t, err)
+	})
+}
+
+func TestDownload_PolicyResume(t *testing.T) {
+	body := "hello world"
+	etag := `"v1"`
+
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Accept-Ranges", "bytes")
+		w.Header().Set("ETag", etag)
+
+		if atomic.AddInt32(&requests, 1) == 1 {
+			// drop the connection partway through, leaving a partial body to resume.
+			w.Header().Set("Content-Length", fmt.Sprint(len(body)))
+			_, _ = w.Write([]byte(body[:6]))
+			w.(http.Flusher).Flush()
+			panic(http.ErrAbortHandler)
+		}
+
+		var start int
+		_, err := fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-", &start)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		// without a Content-Length the rest of the body is sent in chunks, so its size isn't declared.
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, len(body)-1, len(body)))
+		w.WriteHeader(http.StatusPartialContent)
+		w.(http.Flusher).Flush()
+		_, _ = w.Write([]byte(body[start:]))
+	}))
+	defer server.Close()
+
+	storage, err := content.New(t.TempDir(), store.NewMemory())
+	require.NoError(t, err)
+
+	_, err = download.New(storage, http.DefaultClient, nil, nil, nil, nil).
+		Download(context.Background(), models.URL{URL: server.URL})
+	require.Error(t, err)
+
+	t.Run("Resuming a partial body already past a lowered maximum size is rejected", func(t *testing.T) {
+		policy, err := download.NewPolicy(4, nil, nil)
+		require.NoError(t, err)
+
+		_, err = download.New(storage, http.DefaultClient, nil, nil, nil, policy).
+			Download(context.Background(), models.URL{URL: server.URL})
+		require.Error(t, err)
+		assert.Equal(t, download.ReasonTooLarge, download.ReasonFor(err))
+		assert.Equal(t, int32(2), atomic.LoadInt32(&requests))
+	})
+}
@@ -0,0 +1,288 @@
+package download
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+
+	"github.com/pocockn/downloader/content"
+	"github.com/pocockn/downloader/models"
+)
+
+// Segmenter splits large bodies into byte ranges that are downloaded concurrently. The extra connections segments
+// are downloaded over come from a budget shared by every segmented download, so however many large bodies are
+// downloaded at once the number of connections stays bounded.
+type Segmenter struct {
+	threshold int64
+	segments  int
+	slots     chan struct{}
+}
+
+// NewSegmenter returns a Segmenter that downloads bodies of at least threshold bytes in the given number of segments.
+// The download's own connection fetches segments too, connections is how many extra connections segmented downloads
+// can open between them. Passing the worker pool's size keeps segmented downloads within the pool's concurrency
+// budget.
+func NewSegmenter(threshold int64, segments, connections int) *Segmenter {
+	return &Segmenter{threshold: threshold, segments: segments, slots: make(chan struct{}, connections)}
+}
+
+// take claims up to n extra connections without waiting and returns how many it got.
+func (s *Segmenter) take(n int) int {
+	for i := 0; i < n; i++ {
+		select {
+		case s.slots <- struct{}{}:
+		default:
+			return i
+		}
+	}
+	return n
+}
+
+// give hands back n extra connections.
+func (s *Segmenter) give(n int) {
+	for i := 0; i < n; i++ {
+		<-s.slots
+	}
+}
+
+// segment is a byte range of a body, end is inclusive like it is in a Range header.
+type segment struct {
+	start int64
+	end   int64
+}
+
+// split divides a body of size bytes into n segments, the last segment takes any remainder.
+func split(size int64, n int) []segment {
+	if int64(n) > size {
+		n = int(size)
+	}
+
+	length := size / int64(n)
+	segments := make([]segment, n)
+	for i := range segments {
+		segments[i] = segment{start: int64(i) * length, end: int64(i+1)*length - 1}
+	}
+	segments[n-1].end = size - 1
+
+	return segments
+}
+
+// segmented downloads the body of url in segments if the server says it is big enough and lets us fetch it in byte
+// ranges. It only asks, with a HEAD request, for URLs whose last body was big enough, anything else is decided from
+// the headers of its GET by segmentable so most downloads stay a single request. sent is the request for the whole
+// body, the HEAD request asks the same question it does so a 304 returns an Unchanged result. The body is checked
+// against the verifier before it is committed. ok is false if the body should be downloaded with a single GET
+// instead.
+func (d *Downloader) segmented(
+	req, sent *http.Request,
+	url models.URL,
+	conditional bool,
+	v *verifier,
+) (result *Result, ok bool, err error) {
+	if url.Size < d.segmenter.threshold {
+		return nil, false, nil
+	}
+
+	head := sent.Clone(sent.Context())
+	head.Method = http.MethodHead
+	resp, err := d.client.Do(head)
+	if err != nil {
+		return nil, false, newError(url.URL, ReasonNetwork, err)
+	}
+	resp.Body.Close()
+
+	if conditional && resp.StatusCode == http.StatusNotModified {
+		result, err := d.unchanged(url, resp, v)
+		return result, true, err
+	}
+
+	// the headers are enough to reject the body without a request for any of it.
+	if resp.StatusCode == http.StatusOK {
+		if err := d.policy.check(url.URL, resp); err != nil {
+			return nil, true, err
+		}
+	}
+
+	validator, ok := d.segmentable(resp)
+	if !ok {
+		return nil, false, nil
+	}
+
+	result, err = d.fromSegments(req, url.URL, resp, validator, v)
+	return result, true, err
+}
+
+// segmentable returns the validator to fetch the body of resp in segments with, ok is false if the body is too small
+// or the server won't let us fetch it in byte ranges.
+func (d *Downloader) segmentable(resp *http.Response) (validator string, ok bool) {
+	if d.segmenter == nil || resp.StatusCode != http.StatusOK || resp.ContentLength < d.segmenter.threshold {
+		return "", false
+	}
+
+	validator = resumeValidator(resp)
+	return validator, validator != ""
+}
+
+// fromSegments downloads the body described by resp, the response to a HEAD or a GET for the whole body, in segments.
+// The body of resp isn't read.
+func (d *Downloader) fromSegments(
+	req *http.Request,
+	url string,
+	resp *http.Response,
+	validator string,
+	v *verifier,
+) (*Result, error) {
+	blob, err := d.fetchSegments(req, url, resp.ContentLength, validator, v)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Result{
+		Hash:         blob.Hash,
+		Path:         blob.Path,
+		Size:         blob.Size,
+		ContentType:  resp.Header.Get("Content-Type"),
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+	}, nil
+}
+
+// fetchSegments downloads a body of size bytes in segments into a preallocated file and moves it into storage. Every
+// segment is requested with If-Range set to validator, so a body that changes partway through fails the download
+// rather than being stitched together from two versions. The calling goroutine fetches segments itself, extra
+// goroutines are only started for the connections the budget has spare, and each of those waits for the host's
+// scheduler like any other request. Once every segment is in, the whole body is checked against the verifier.
+func (d *Downloader) fetchSegments(
+	req *http.Request,
+	url string,
+	size int64,
+	validator string,
+	v *verifier,
+) (content.Blob, error) {
+	body, err := d.storage.Segmented(size)
+	if err != nil {
+		return content.Blob{}, newError(url, ReasonStorage, err)
+	}
+
+	segments := split(size, d.segmenter.segments)
+	queue := make(chan segment, len(segments))
+	for _, s := range segments {
+		queue <- s
+	}
+	close(queue)
+
+	// ctx stops every segment once one fails, waiting stops the extra connections waiting for the scheduler once the
+	// calling goroutine has run out of segments to fetch.
+	ctx, cancel := context.WithCancel(req.Context())
+	defer cancel()
+	waiting, stopWaiting := context.WithCancel(ctx)
+	defer stopWaiting()
+
+	var once sync.Once
+	var failure error
+	fetch := func() {
+		for s := range queue {
+			if err := d.fetchSegment(ctx, req, url, s, validator, body); err != nil {
+				once.Do(func() {
+					failure = err
+					cancel()
+				})
+				return
+			}
+		}
+	}
+
+	extra := d.segmenter.take(len(segments) - 1)
+	var wg sync.WaitGroup
+	for i := 0; i < extra; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			if d.scheduler != nil {
+				release, err := d.scheduler.Acquire(waiting, req.URL.Hostname())
+				if err != nil {
+					return
+				}
+				defer release()
+			}
+
+			fetch()
+		}()
+	}
+
+	fetch()
+	stopWaiting()
+	wg.Wait()
+	d.segmenter.give(extra)
+
+	if failure == nil && v != nil {
+		if _, err := io.Copy(v, body.Reader()); err != nil {
+			failure = newError(url, ReasonStorage, err)
+		} else if err := v.check(); err != nil {
+			failure = newError(url, ReasonChecksum, err)
+		}
+	}
+
+	if failure != nil {
+		body.Discard()
+		return content.Blob{}, failure
+	}
+
+	blob, err := body.Commit()
+	if err != nil {
+		return content.Blob{}, newError(url, ReasonStorage, err)
+	}
+
+	return blob, nil
+}
+
+// fetchSegment downloads a single segment of the body into its place in the file. A segment that comes up short fails
+// the download, it is what checks the body is the size we asked for since the file is already allocated at that size.
+func (d *Downloader) fetchSegment(
+	ctx context.Context,
+	req *http.Request,
+	url string,
+	s segment,
+	validator string,
+	body *content.Segmented,
+) error {
+	sent := req.Clone(ctx)
+	sent.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", s.start, s.end))
+	sent.Header.Set("If-Range", validator)
+
+	resp, err := d.client.Do(sent)
+	if err != nil {
+		return newError(url, ReasonNetwork, err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		// the server sends the whole body when it has changed since we asked for its size.
+		return newError(url, ReasonNetwork, errChanged)
+	default:
+		return statusError(url, resp)
+	}
+
+	if start, ok := rangeStart(resp); !ok || start != s.start {
+		return newError(url, ReasonNetwork, errUnexpectedRange)
+	}
+
+	length := s.end - s.start + 1
+	reader := &bodyReader{r: io.LimitReader(resp.Body, length)}
+	written, err := io.Copy(body.Writer(s.start), reader)
+	switch {
+	case reader.err != nil:
+		return newError(url, ReasonNetwork, reader.err)
+	case err != nil:
+		return newError(url, ReasonStorage, err)
+	case written != length:
+		return newError(url, ReasonNetwork, io.ErrUnexpectedEOF)
+	}
+
+	return nil
+}
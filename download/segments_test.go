@@ -0,0 +1,179 @@
+package download_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pocockn/downloader/content"
+	"github.com/pocockn/downloader/download"
+	"github.com/pocockn/downloader/models"
+	"github.com/pocockn/downloader/store"
+)
+
+func TestDownload_Segments(t *testing.T) {
+	storage, err := content.New(t.TempDir(), store.NewMemory())
+	require.NoError(t, err)
+
+	body := bytes.Repeat([]byte("0123456789"), 100)
+	etag := `"v1"`
+
+	var mu sync.Mutex
+	var requests []string
+	var active, peak int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests = append(requests, r.Method+" "+r.Header.Get("Range"))
+		active++
+		if active > peak {
+			peak = active
+		}
+		mu.Unlock()
+
+		defer func() {
+			mu.Lock()
+			active--
+			mu.Unlock()
+		}()
+
+		// hold each request so concurrent segments overlap.
+		time.Sleep(20 * time.Millisecond)
+
+		w.Header().Set("ETag", etag)
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(body))
+	}))
+	defer server.Close()
+
+	reset := func() {
+		mu.Lock()
+		requests, peak = nil, 0
+		mu.Unlock()
+	}
+
+	// the URL's last body was big enough to segment, so it is asked about with a HEAD request first.
+	known := models.URL{URL: server.URL, Size: int64(len(body))}
+
+	t.Run("Large bodies are downloaded in segments over several connections", func(t *testing.T) {
+		reset()
+		d := download.New(storage, http.DefaultClient, nil, nil, download.NewSegmenter(100, 4, 3), nil)
+
+		result, err := d.Download(context.Background(), known)
+		require.NoError(t, err)
+		assert.Equal(t, int64(len(body)), result.Size)
+		assert.Equal(t, etag, result.ETag)
+
+		saved, err := os.ReadFile(result.Path)
+		require.NoError(t, err)
+		assert.Equal(t, body, saved)
+
+		assert.ElementsMatch(t, []string{
+			"HEAD ",
+			"GET bytes=0-249",
+			"GET bytes=250-499",
+			"GET bytes=500-749",
+			"GET bytes=750-999",
+		}, requests)
+		assert.Equal(t, 4, peak)
+	})
+
+	t.Run("Segments only use the connections the budget has spare", func(t *testing.T) {
+		reset()
+		d := download.New(storage, http.DefaultClient, nil, nil, download.NewSegmenter(100, 4, 0), nil)
+
+		result, err := d.Download(context.Background(), known)
+		require.NoError(t, err)
+		assert.Equal(t, int64(len(body)), result.Size)
+		assert.Len(t, requests, 5)
+		assert.Equal(t, 1, peak)
+	})
+
+	t.Run("Bodies we don't know are large are decided from the GET", func(t *testing.T) {
+		reset()
+		d := download.New(storage, http.DefaultClient, nil, nil, download.NewSegmenter(100, 4, 3), nil)
+
+		result, err := d.Download(context.Background(), models.URL{URL: server.URL})
+		require.NoError(t, err)
+
+		saved, err := os.ReadFile(result.Path)
+		require.NoError(t, err)
+		assert.Equal(t, body, saved)
+
+		assert.ElementsMatch(t, []string{
+			"GET ",
+			"GET bytes=0-249",
+			"GET bytes=250-499",
+			"GET bytes=500-749",
+			"GET bytes=750-999",
+		}, requests)
+	})
+
+	t.Run("Bodies under the threshold are downloaded with a single request", func(t *testing.T) {
+		reset()
+		d := download.New(storage, http.DefaultClient, nil, nil, download.NewSegmenter(int64(len(body)+1), 4, 3), nil)
+
+		_, err := d.Download(context.Background(), models.URL{URL: server.URL})
+		require.NoError(t, err)
+		assert.Equal(t, []string{"GET "}, requests)
+
+		reset()
+		_, err = d.Download(context.Background(), known)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"GET "}, requests)
+	})
+
+	t.Run("Bodies that change partway through fail", func(t *testing.T) {
+		// every segment sees a different ETag to the HEAD request, so the server sends the whole body instead.
+		changing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == http.MethodGet {
+				w.Header().Set("ETag", `"v2"`)
+			} else {
+				w.Header().Set("ETag", etag)
+			}
+			http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(body))
+		}))
+		defer changing.Close()
+
+		d := download.New(storage, http.DefaultClient, nil, nil, download.NewSegmenter(100, 4, 3), nil)
+		_, err := d.Download(context.Background(), models.URL{URL: changing.URL, Size: int64(len(body))})
+		require.Error(t, err)
+		assert.Equal(t, download.ReasonNetwork, download.ReasonFor(err))
+	})
+
+	t.Run("Bodies with a short segment fail", func(t *testing.T) {
+		// every segment is cut short, which would otherwise leave a hole in the preallocated file.
+		short := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("ETag", etag)
+			if r.Method == http.MethodHead {
+				w.Header().Set("Accept-Ranges", "bytes")
+				w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+				return
+			}
+
+			var start, end int
+			if _, err := fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-%d", &start, &end); err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(body)))
+			w.WriteHeader(http.StatusPartialContent)
+			_, _ = w.Write(body[start:end])
+		}))
+		defer short.Close()
+
+		d := download.New(storage, http.DefaultClient, nil, nil, download.NewSegmenter(100, 4, 3), nil)
+		_, err := d.Download(context.Background(), models.URL{URL: short.URL, Size: int64(len(body))})
+		require.Error(t, err)
+		assert.Equal(t, download.ReasonNetwork, download.ReasonFor(err))
+	})
+}
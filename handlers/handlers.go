@@ -2,49 +2,165 @@ package handlers
 
 import (
 	"encoding/json"
+	"errors"
 	"net/http"
+	"net/url"
+	"strconv"
+	"time"
 
 	"github.com/labstack/echo/v4"
 
+	"github.com/pocockn/downloader/bandwidth"
+	"github.com/pocockn/downloader/jobs"
 	"github.com/pocockn/downloader/models"
+	"github.com/pocockn/downloader/queue"
 	"github.com/pocockn/downloader/store"
+	"github.com/pocockn/downloader/urls"
+	"github.com/pocockn/downloader/versions"
 	"github.com/pocockn/downloader/worker"
 )
 
+// HeaderQueueDepth is the response header that tells the caller how many URLs are waiting to be downloaded.
+const HeaderQueueDepth = "X-Queue-Depth"
+
+// queueFullRetryAfter is how long callers are asked to wait before resubmitting when the queue is full.
+const queueFullRetryAfter = 5 * time.Second
+
 // Handlers deals with the incoming requests to the API.
 type Handlers struct {
-	store store.Store
-	pool  *worker.Pool
+	store      store.Store
+	pool       *worker.Pool
+	history    *versions.History
+	bandwidth  *bandwidth.Limiter
+	normalizer *urls.Normalizer
 }
 
-// New creates a new Handlers instance to handle requests to the API.
-func New(s store.Store, pool *worker.Pool) *Handlers {
+// New creates a new Handlers instance to handle requests to the API. URLs are put into their canonical form by the
+// normalizer before they are used as keys.
+func New(
+	s store.Store,
+	pool *worker.Pool,
+	history *versions.History,
+	limiter *bandwidth.Limiter,
+	normalizer *urls.Normalizer,
+) *Handlers {
 	return &Handlers{
-		store: s,
-		pool:  pool,
+		store:      s,
+		pool:       pool,
+		history:    history,
+		bandwidth:  limiter,
+		normalizer: normalizer,
 	}
 }
 
-// URLStore takes a URL and stores it for later processing.
+// submission is what a caller gives when submitting a URL. The rest of the URL record is filled in by the workers, so
+// callers can't claim a body or validators for a URL that we never downloaded.
+type submission struct {
+	URL       string `query:"url"`
+	Checksums models.Checksums
+}
+
+// URLStore takes a URL, along with the checksums its body is expected to have, and queues it for later processing
+// under its canonical form. URLs we can't download are turned away with a 400 saying why. Once it has been queued we
+// respond with 202 Accepted and the job tracking it, the job takes the request ID where there is one.
 func (h *Handlers) URLStore(c echo.Context) error {
-	var url models.URL
-	err := c.Bind(&url)
+	var submitted submission
+	err := c.Bind(&submitted)
 	if err != nil {
 		return c.String(http.StatusBadRequest, "bad request")
 	}
+	url := models.URL{URL: submitted.URL, Checksums: submitted.Checksums}
 
 	if url.URL == "" {
 		return c.String(http.StatusBadRequest, "path must contain url query param")
 	}
 
-	h.pool.AddURL(url)
+	if url.URL, err = h.normalizer.Normalize(url.URL); err != nil {
+		return c.String(http.StatusBadRequest, err.Error())
+	}
+
+	if err := url.Checksums.Validate(); err != nil {
+		return c.String(http.StatusBadRequest, err.Error())
+	}
+
+	id := c.Response().Header().Get(echo.HeaderXRequestID)
+	if id == "" {
+		id = c.Request().Header.Get(echo.HeaderXRequestID)
+	}
+
+	job, err := h.pool.AddURL(id, url)
+	if depth, _, depthErr := h.pool.QueueDepth(); depthErr == nil {
+		c.Response().Header().Set(HeaderQueueDepth, strconv.Itoa(depth))
+	}
+
+	switch {
+	case errors.Is(err, queue.ErrFull):
+		c.Response().Header().Set(echo.HeaderRetryAfter, strconv.Itoa(int(queueFullRetryAfter.Seconds())))
+		return c.String(http.StatusServiceUnavailable, "queue is full, retry later")
+	case errors.Is(err, worker.ErrStopped):
+		return c.String(http.StatusServiceUnavailable, "server is shutting down")
+	case err != nil:
+		return c.String(http.StatusInternalServerError, "unable to queue url")
+	}
+
+	c.Response().Header().Set(echo.HeaderLocation, "/jobs/"+job.ID)
+	return c.JSON(http.StatusAccepted, job)
+}
+
+// Job returns the state of the job with the ID in the path.
+func (h *Handlers) Job(c echo.Context) error {
+	job, err := h.pool.Jobs().Get(c.Param("id"))
+	switch {
+	case errors.Is(err, jobs.ErrNotFound):
+		return c.String(http.StatusNotFound, "job not found")
+	case err != nil:
+		return c.String(http.StatusInternalServerError, "unable to fetch job from the db")
+	}
+
+	return c.JSON(http.StatusOK, job)
+}
+
+// listedJobs is how many jobs the Jobs endpoint returns.
+const listedJobs = 100
+
+// Jobs returns the latest 100 jobs, optionally filtered by the state query param.
+func (h *Handlers) Jobs(c echo.Context) error {
+	state := jobs.State(c.QueryParam("state"))
+	if state != "" && !state.Valid() {
+		return c.String(http.StatusBadRequest, "state must be one of queued, downloading, succeeded or failed")
+	}
+
+	results, err := h.pool.Jobs().List(state, listedJobs)
+	if err != nil {
+		return c.String(http.StatusInternalServerError, "unable to fetch jobs from the db")
+	}
+
+	return c.JSON(http.StatusOK, results)
+}
+
+// QueueStats describes how full the queue of URLs waiting to be downloaded is.
+type QueueStats struct {
+	Depth    int
+	Capacity int
+}
 
-	return nil
+// Queue returns the number of URLs queued or being downloaded and the capacity of the queue, a capacity of 0 means
+// the queue is unbounded.
+func (h *Handlers) Queue(c echo.Context) error {
+	depth, capacity, err := h.pool.QueueDepth()
+	if err != nil {
+		return c.String(http.StatusInternalServerError, "unable to fetch the queue depth")
+	}
+
+	return c.JSON(http.StatusOK, QueueStats{Depth: depth, Capacity: capacity})
 }
 
+// latestURLs is how many URLs the URLs endpoint returns.
+const latestURLs = 50
+
 // URLs returns the latest 50 URLs that the API has received.
 func (h *Handlers) URLs(c echo.Context) error {
-	bytes, err := h.store.GetAll()
+	bytes, err := h.store.Latest(latestURLs)
 	if err != nil {
 		return c.String(http.StatusInternalServerError, "unable fetch urls from the db")
 	}
@@ -60,9 +176,55 @@ func (h *Handlers) URLs(c echo.Context) error {
 		urls = append(urls, url)
 	}
 
-	if len(urls) <= 50 {
-		return c.JSON(http.StatusOK, urls)
+	return c.JSON(http.StatusOK, urls)
+}
+
+// Versions returns the version history of the URL in the path, newest first. The URL has to be escaped to fit in the
+// path, /urls/http%3A%2F%2Fwww.example.com/versions for http://www.example.com. It is looked up in its canonical form,
+// so any way of writing the URL finds it.
+func (h *Handlers) Versions(c echo.Context) error {
+	key, err := url.PathUnescape(c.Param("url"))
+	if err != nil {
+		return c.String(http.StatusBadRequest, "url must be escaped")
+	}
+
+	if key, err = h.normalizer.Normalize(key); err != nil {
+		return c.String(http.StatusBadRequest, err.Error())
+	}
+
+	bytes, err := h.store.Get(key)
+	if err != nil {
+		return c.String(http.StatusInternalServerError, "unable to fetch url from the db")
+	}
+	if bytes == nil {
+		return c.String(http.StatusNotFound, "url not found")
+	}
+
+	history, err := h.history.List(key)
+	if err != nil {
+		return c.String(http.StatusInternalServerError, "unable to fetch versions from the db")
+	}
+
+	return c.JSON(http.StatusOK, history)
+}
+
+// Bandwidth returns the bandwidth limits being applied to downloads, in bytes per second.
+func (h *Handlers) Bandwidth(c echo.Context) error {
+	return c.JSON(http.StatusOK, h.bandwidth.Limits())
+}
+
+// SetBandwidth changes the bandwidth limits applied to downloads, including those already running. The limits are in
+// bytes per second and zero means no limit.
+func (h *Handlers) SetBandwidth(c echo.Context) error {
+	var limits bandwidth.Limits
+	if err := c.Bind(&limits); err != nil {
+		return c.String(http.StatusBadRequest, "bad request")
+	}
+
+	if limits.Global < 0 || limits.PerHost < 0 {
+		return c.String(http.StatusBadRequest, "limits must not be negative")
 	}
 
-	return c.JSON(http.StatusOK, urls[:49])
+	h.bandwidth.SetLimits(limits)
+	return c.JSON(http.StatusOK, limits)
 }
@@ -1,19 +1,31 @@
 package handlers_test
 
 import (
+	"context"
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/golang/mock/gomock"
+	"github.com/jarcoal/httpmock"
 	"github.com/labstack/echo/v4"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
+	"github.com/pocockn/downloader/bandwidth"
+	"github.com/pocockn/downloader/content"
+	"github.com/pocockn/downloader/download"
 	"github.com/pocockn/downloader/handlers"
+	"github.com/pocockn/downloader/jobs"
 	"github.com/pocockn/downloader/mocks"
 	"github.com/pocockn/downloader/models"
+	"github.com/pocockn/downloader/queue"
+	"github.com/pocockn/downloader/store"
+	"github.com/pocockn/downloader/versions"
 	"github.com/pocockn/downloader/worker"
 )
 
@@ -21,10 +33,14 @@ func TestURLStore(t *testing.T) {
 	ctrl := gomock.NewController(t)
 	defer ctrl.Finish()
 
+	q := queue.New(store.NewMemory(), queue.Options{VisibilityTimeout: time.Minute})
+	tracker := jobs.NewTracker(store.NewMemory(), 0)
 	store := mocks.NewMockStore(ctrl)
-	urlsChan := make(chan models.URL, 10)
 
-	h := handlers.New(store, worker.NewPool(3, store, urlsChan))
+	storage, err := content.New(t.TempDir(), store)
+	require.NoError(t, err)
+
+	h := handlers.New(store, worker.NewPool(3, store, download.New(storage, http.DefaultClient, nil, nil, nil, nil), worker.RetryPolicy{}, nil, q, tracker), nil, nil, nil)
 
 	t.Run("store endpoint must contain url query param", func(t *testing.T) {
 		req, err := http.NewRequest("GET", "/store", http.NoBody)
@@ -38,7 +54,40 @@ func TestURLStore(t *testing.T) {
 		assert.Equal(t, http.StatusBadRequest, rec.Code)
 	})
 
-	t.Run("URL is passed to a worker", func(t *testing.T) {
+	t.Run("URLs we can't download are rejected with the reason", func(t *testing.T) {
+		for raw, reason := range map[string]string{
+			"example.com":          "url must be absolute, like http://example.com/",
+			"ftp://example.com":    "url scheme must be http or https",
+			"http:///path":         "url must have a host",
+			"http://example.com:0": "url port must be between 1 and 65535",
+		} {
+			req, err := http.NewRequest("GET", "/store?url="+url.QueryEscape(raw), http.NoBody)
+			assert.NoError(t, err)
+
+			e := echo.New()
+			rec := httptest.NewRecorder()
+			c := e.NewContext(req, rec)
+			err = h.URLStore(c)
+			assert.NoError(t, err)
+			assert.Equal(t, http.StatusBadRequest, rec.Code, raw)
+			assert.Equal(t, reason, rec.Body.String(), raw)
+		}
+	})
+
+	t.Run("Checksums must be hex of the right length", func(t *testing.T) {
+		req, err := http.NewRequest("GET", "/store?url=http://www.example.com&md5=not-hex", http.NoBody)
+		assert.NoError(t, err)
+
+		e := echo.New()
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		err = h.URLStore(c)
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+		assert.Equal(t, "MD5 must be 32 hex characters", rec.Body.String())
+	})
+
+	t.Run("URL is queued for the workers", func(t *testing.T) {
 		req, err := http.NewRequest("GET", "/store?url=http://www.example.com", http.NoBody)
 		assert.NoError(t, err)
 
@@ -47,7 +96,45 @@ func TestURLStore(t *testing.T) {
 		c := e.NewContext(req, rec)
 		err = h.URLStore(c)
 		assert.NoError(t, err)
+		assert.Equal(t, http.StatusAccepted, rec.Code)
+	})
+}
+
+func TestURLStore_QueueFull(t *testing.T) {
+	storage, err := content.New(t.TempDir(), store.NewMemory())
+	require.NoError(t, err)
+
+	q := queue.New(store.NewMemory(), queue.Options{VisibilityTimeout: time.Minute, Capacity: 1})
+	tracker := jobs.NewTracker(store.NewMemory(), 0)
+	h := handlers.New(store.NewMemory(), worker.NewPool(3, store.NewMemory(), download.New(storage, http.DefaultClient, nil, nil, nil, nil), worker.RetryPolicy{}, nil, q, tracker), nil, nil, nil)
+	e := echo.New()
+
+	t.Run("URLs are accepted while there is room in the queue", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/store?url=http://www.example.com", http.NoBody)
+		rec := httptest.NewRecorder()
+		require.NoError(t, h.URLStore(e.NewContext(req, rec)))
+		assert.Equal(t, http.StatusAccepted, rec.Code)
+		assert.Equal(t, "1", rec.Header().Get(handlers.HeaderQueueDepth))
+	})
+
+	t.Run("URLs are turned away once the queue is full", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/store?url=http://www.example1.com", http.NoBody)
+		rec := httptest.NewRecorder()
+		require.NoError(t, h.URLStore(e.NewContext(req, rec)))
+		assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+		assert.Equal(t, "5", rec.Header().Get(echo.HeaderRetryAfter))
+		assert.Equal(t, "1", rec.Header().Get(handlers.HeaderQueueDepth))
+	})
+
+	t.Run("Queue endpoint returns the depth and capacity", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/queue", http.NoBody)
+		rec := httptest.NewRecorder()
+		require.NoError(t, h.Queue(e.NewContext(req, rec)))
 		assert.Equal(t, http.StatusOK, rec.Code)
+
+		var stats handlers.QueueStats
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &stats))
+		assert.Equal(t, handlers.QueueStats{Depth: 1, Capacity: 1}, stats)
 	})
 }
 
@@ -55,10 +142,14 @@ func TestURLs(t *testing.T) {
 	ctrl := gomock.NewController(t)
 	defer ctrl.Finish()
 
+	q := queue.New(store.NewMemory(), queue.Options{VisibilityTimeout: time.Minute})
+	tracker := jobs.NewTracker(store.NewMemory(), 0)
 	store := mocks.NewMockStore(ctrl)
-	urlsChan := make(chan models.URL, 10)
 
-	h := handlers.New(store, worker.NewPool(3, store, urlsChan))
+	storage, err := content.New(t.TempDir(), store)
+	require.NoError(t, err)
+
+	h := handlers.New(store, worker.NewPool(3, store, download.New(storage, http.DefaultClient, nil, nil, nil, nil), worker.RetryPolicy{}, nil, q, tracker), nil, nil, nil)
 
 	t.Run("URLs endpoint returns up to 50 of the latest URLs", func(t *testing.T) {
 		req, err := http.NewRequest("GET", "/urls", http.NoBody)
@@ -80,7 +171,7 @@ func TestURLs(t *testing.T) {
 
 		results := marshalURLs(urls, t)
 
-		store.EXPECT().GetAll().Return(results, nil)
+		store.EXPECT().Latest(50).Return(results, nil)
 
 		e := echo.New()
 		rec := httptest.NewRecorder()
@@ -91,6 +182,157 @@ func TestURLs(t *testing.T) {
 	})
 }
 
+func TestSubmitAndList(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	db := store.NewMemory()
+	refs, err := db.Bucket("blobs")
+	require.NoError(t, err)
+
+	storage, err := content.New(t.TempDir(), refs)
+	require.NoError(t, err)
+
+	pending, err := db.Bucket("queue")
+	require.NoError(t, err)
+
+	states, err := db.Bucket("jobs")
+	require.NoError(t, err)
+
+	q := queue.New(pending, queue.Options{VisibilityTimeout: time.Minute})
+	pool := worker.NewPool(3, db, download.New(storage, http.DefaultClient, nil, nil, nil, nil), worker.RetryPolicy{}, nil, q, jobs.NewTracker(states, 0))
+	go pool.Run()
+	defer pool.Stop(context.Background())
+
+	h := handlers.New(db, pool, nil, nil, nil)
+	e := echo.New()
+
+	httpmock.RegisterResponder("GET", "http://www.example.com/", httpmock.NewStringResponder(200, `hello`))
+
+	// both ways of writing the URL are stored under the same key.
+	var submitted []jobs.Job
+	for _, submission := range []string{"http://www.example.com", "HTTP://WWW.Example.com:80/#top"} {
+		req := httptest.NewRequest(http.MethodPost, "/store", strings.NewReader(`{"url":"`+submission+`"}`))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		rec := httptest.NewRecorder()
+		require.NoError(t, h.URLStore(e.NewContext(req, rec)))
+		assert.Equal(t, http.StatusAccepted, rec.Code)
+
+		var job jobs.Job
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &job))
+		assert.Equal(t, "/jobs/"+job.ID, rec.Header().Get(echo.HeaderLocation))
+		submitted = append(submitted, job)
+	}
+	assert.NotEqual(t, submitted[0].ID, submitted[1].ID)
+
+	var urls []models.URL
+	require.Eventually(t, func() bool {
+		req := httptest.NewRequest(http.MethodGet, "/urls", http.NoBody)
+		rec := httptest.NewRecorder()
+		require.NoError(t, h.URLs(e.NewContext(req, rec)))
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &urls))
+		return len(urls) == 1 && urls[0].Submitted == 2
+	}, 5*time.Second, 50*time.Millisecond)
+
+	assert.Equal(t, "http://www.example.com/", urls[0].URL)
+	assert.Equal(t, int64(5), urls[0].Size)
+	assert.FileExists(t, urls[0].FilePath)
+
+	var finished []jobs.Job
+	require.Eventually(t, func() bool {
+		req := httptest.NewRequest(http.MethodGet, "/jobs?state=queued", http.NoBody)
+		rec := httptest.NewRecorder()
+		require.NoError(t, h.Jobs(e.NewContext(req, rec)))
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &finished))
+		return len(finished) == 0
+	}, 5*time.Second, 50*time.Millisecond)
+
+	req := httptest.NewRequest(http.MethodGet, "/jobs", http.NoBody)
+	rec := httptest.NewRecorder()
+	require.NoError(t, h.Jobs(e.NewContext(req, rec)))
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &finished))
+	assert.Len(t, finished, 2)
+}
+
+func TestJobs(t *testing.T) {
+	storage, err := content.New(t.TempDir(), store.NewMemory())
+	require.NoError(t, err)
+
+	q := queue.New(store.NewMemory(), queue.Options{VisibilityTimeout: time.Minute})
+	tracker := jobs.NewTracker(store.NewMemory(), 0)
+	h := handlers.New(store.NewMemory(), worker.NewPool(3, store.NewMemory(), download.New(storage, http.DefaultClient, nil, nil, nil, nil), worker.RetryPolicy{}, nil, q, tracker), nil, nil, nil)
+	e := echo.New()
+
+	t.Run("Jobs take the request ID", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/store?url=http://www.example.com", http.NoBody)
+		req.Header.Set(echo.HeaderXRequestID, "request-id")
+		rec := httptest.NewRecorder()
+		require.NoError(t, h.URLStore(e.NewContext(req, rec)))
+		assert.Equal(t, http.StatusAccepted, rec.Code)
+		assert.Equal(t, "/jobs/request-id", rec.Header().Get(echo.HeaderLocation))
+	})
+
+	t.Run("Reused request IDs are given a new job ID", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/store?url=http://www.example1.com", http.NoBody)
+		req.Header.Set(echo.HeaderXRequestID, "request-id")
+		rec := httptest.NewRecorder()
+		require.NoError(t, h.URLStore(e.NewContext(req, rec)))
+		assert.Equal(t, http.StatusAccepted, rec.Code)
+		assert.NotEqual(t, "/jobs/request-id", rec.Header().Get(echo.HeaderLocation))
+	})
+
+	t.Run("Job endpoint returns the job", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/jobs/request-id", http.NoBody)
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		c.SetParamNames("id")
+		c.SetParamValues("request-id")
+		require.NoError(t, h.Job(c))
+		assert.Equal(t, http.StatusOK, rec.Code)
+
+		var job jobs.Job
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &job))
+		assert.Equal(t, "http://www.example.com/", job.URL)
+		assert.Equal(t, jobs.StateQueued, job.State)
+	})
+
+	t.Run("Job endpoint returns 404 for unknown jobs", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/jobs/missing", http.NoBody)
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		c.SetParamNames("id")
+		c.SetParamValues("missing")
+		require.NoError(t, h.Job(c))
+		assert.Equal(t, http.StatusNotFound, rec.Code)
+	})
+
+	t.Run("Jobs endpoint filters by state", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/jobs?state=queued", http.NoBody)
+		rec := httptest.NewRecorder()
+		require.NoError(t, h.Jobs(e.NewContext(req, rec)))
+		assert.Equal(t, http.StatusOK, rec.Code)
+
+		var queued []jobs.Job
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &queued))
+		assert.Len(t, queued, 2)
+
+		req = httptest.NewRequest(http.MethodGet, "/jobs?state=failed", http.NoBody)
+		rec = httptest.NewRecorder()
+		require.NoError(t, h.Jobs(e.NewContext(req, rec)))
+
+		var failed []jobs.Job
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &failed))
+		assert.Empty(t, failed)
+	})
+
+	t.Run("Jobs endpoint rejects unknown states", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/jobs?state=unknown", http.NoBody)
+		rec := httptest.NewRecorder()
+		require.NoError(t, h.Jobs(e.NewContext(req, rec)))
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+	})
+}
+
 func marshalURLs(urls []models.URL, t *testing.T) [][]byte {
 	var results [][]byte
 	for _, url := range urls {
@@ -101,3 +343,85 @@ func marshalURLs(urls []models.URL, t *testing.T) [][]byte {
 
 	return results
 }
+
+func TestVersions(t *testing.T) {
+	db := store.NewMemory()
+	storage, err := content.New(t.TempDir(), store.NewMemory())
+	require.NoError(t, err)
+
+	history := versions.NewHistory(store.NewMemory(), storage, versions.Retention{})
+
+	bytes, err := json.Marshal(models.URL{URL: "http://www.example.com/page?id=1", Submitted: 1})
+	require.NoError(t, err)
+	require.NoError(t, db.Set("http://www.example.com/page?id=1", bytes))
+
+	blob, err := storage.Save(strings.NewReader("hello"))
+	require.NoError(t, err)
+	_, err = history.Record("http://www.example.com/page?id=1", &download.Result{Hash: blob.Hash, Path: blob.Path, Size: blob.Size})
+	require.NoError(t, err)
+
+	q := queue.New(store.NewMemory(), queue.Options{VisibilityTimeout: time.Minute})
+	tracker := jobs.NewTracker(store.NewMemory(), 0)
+	h := handlers.New(db, worker.NewPool(3, db, download.New(storage, http.DefaultClient, nil, nil, nil, nil), worker.RetryPolicy{}, nil, q, tracker), history, nil, nil)
+
+	e := echo.New()
+	e.GET("urls/:url/versions", h.Versions)
+
+	t.Run("Versions endpoint returns the history of the escaped URL", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/urls/"+url.PathEscape("http://www.example.com/page?id=1")+"/versions", http.NoBody)
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusOK, rec.Code)
+
+		var list []versions.Version
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &list))
+		require.Len(t, list, 1)
+		assert.Equal(t, blob.Hash, list[0].Hash)
+		assert.Equal(t, versions.StatusNew, list[0].Status)
+	})
+
+	t.Run("Versions endpoint returns 404 for unknown URLs", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/urls/"+url.PathEscape("http://www.missing.com")+"/versions", http.NoBody)
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusNotFound, rec.Code)
+	})
+}
+
+func TestBandwidth(t *testing.T) {
+	limiter := bandwidth.New(bandwidth.Limits{Global: 1 << 20})
+	h := handlers.New(store.NewMemory(), nil, nil, limiter, nil)
+
+	e := echo.New()
+	e.GET("admin/bandwidth", h.Bandwidth)
+	e.PUT("admin/bandwidth", h.SetBandwidth)
+
+	t.Run("Bandwidth endpoint returns the limits", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/admin/bandwidth", http.NoBody)
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusOK, rec.Code)
+
+		var limits bandwidth.Limits
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &limits))
+		assert.Equal(t, bandwidth.Limits{Global: 1 << 20}, limits)
+	})
+
+	t.Run("Bandwidth limits can be changed at runtime", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPut, "/admin/bandwidth", strings.NewReader(`{"Global":2048,"PerHost":1024}`))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, bandwidth.Limits{Global: 2048, PerHost: 1024}, limiter.Limits())
+	})
+
+	t.Run("Negative limits are rejected", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPut, "/admin/bandwidth", strings.NewReader(`{"Global":-1}`))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+		assert.Equal(t, bandwidth.Limits{Global: 2048, PerHost: 1024}, limiter.Limits())
+	})
+}
@@ -0,0 +1,226 @@
+package hosts
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// Now is used, so we can fix the time within our tests.
+var Now = time.Now
+
+// Hosts that go without requests for idleTimeout are forgotten, so the scheduler doesn't keep every host it has ever
+// seen. Idle hosts are looked for at most once every sweepInterval.
+const (
+	idleTimeout   = 10 * time.Minute
+	sweepInterval = time.Minute
+)
+
+// Limits bounds how hard we hit a single host.
+type Limits struct {
+	// Concurrency is the most requests in flight to the host at once. Zero means no limit.
+	Concurrency int
+	// Rate is how many requests per second are started against the host. Zero means no limit.
+	Rate float64
+	// Burst is how many requests can be started at once before Rate kicks in, it defaults to 1.
+	Burst int
+}
+
+// bucket returns the rate and burst of the token bucket for the limits.
+func (l Limits) bucket() (rate.Limit, int) {
+	if l.Rate <= 0 {
+		return rate.Inf, 0
+	}
+
+	burst := l.Burst
+	if burst <= 0 {
+		burst = 1
+	}
+
+	return rate.Limit(l.Rate), burst
+}
+
+// host tracks the requests in flight to and started against a single host.
+type host struct {
+	limits  Limits
+	slots   chan struct{}
+	limiter *rate.Limiter
+
+	// holders is how many requests are waiting for or holding a slot, used is when the host was last looked up or
+	// released. Both are guarded by the scheduler's mu.
+	holders int
+	used    time.Time
+}
+
+// idle returns how long the host has to go without requests before it can be forgotten. That is at least long enough
+// for its token bucket to fill back up, so forgetting it never lets a request start sooner than it would have.
+func (h *host) idle() time.Duration {
+	limit := h.limiter.Limit()
+	if limit == rate.Inf || limit <= 0 {
+		return idleTimeout
+	}
+
+	refill := time.Duration(float64(h.limiter.Burst()) / float64(limit) * float64(time.Second))
+	if refill > idleTimeout {
+		return refill
+	}
+	return idleTimeout
+}
+
+// Scheduler decides when a request to a host may start, so that no host is sent more requests at once, or more
+// requests per second, than its limits allow. A single Scheduler is shared by everything that downloads so the limits
+// hold across all of them.
+type Scheduler struct {
+	defaults  Limits
+	overrides map[string]Limits
+
+	mu    sync.Mutex
+	hosts map[string]*host
+	swept time.Time
+}
+
+// New returns a Scheduler that applies the default limits to every host, other than those with an override. An
+// override for a domain also applies to its subdomains, the most specific override wins.
+func New(defaults Limits, overrides map[string]Limits) *Scheduler {
+	normalised := make(map[string]Limits, len(overrides))
+	for domain, limits := range overrides {
+		normalised[strings.ToLower(strings.TrimSuffix(domain, "."))] = limits
+	}
+
+	return &Scheduler{
+		defaults:  defaults,
+		overrides: normalised,
+		hosts:     make(map[string]*host),
+	}
+}
+
+// Limits returns the limits that apply to the host.
+func (s *Scheduler) Limits(name string) Limits {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	for {
+		if limits, ok := s.overrides[name]; ok {
+			return limits
+		}
+
+		i := strings.IndexByte(name, '.')
+		if i < 0 {
+			return s.defaults
+		}
+		name = name[i+1:]
+	}
+}
+
+// Len returns how many hosts the scheduler is keeping track of.
+func (s *Scheduler) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.hosts)
+}
+
+// Acquire waits until a request to the host may start, or until ctx is done. The release function returned must be
+// called once the request, including reading its body, has finished.
+func (s *Scheduler) Acquire(ctx context.Context, name string) (release func(), err error) {
+	h := s.host(name, true)
+
+	release = func() { s.release(h) }
+	if h.slots != nil {
+		select {
+		case h.slots <- struct{}{}:
+			release = func() {
+				<-h.slots
+				s.release(h)
+			}
+		case <-ctx.Done():
+			s.release(h)
+			return nil, ctx.Err()
+		}
+	}
+
+	reservation := h.limiter.Reserve()
+	delay := reservation.Delay()
+	if delay == 0 {
+		return release, nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return release, nil
+	case <-ctx.Done():
+		reservation.Cancel()
+		release()
+		return nil, ctx.Err()
+	}
+}
+
+// SetCrawlDelay slows requests to the host down to one per delay, if its limits don't already keep it slower than
+// that. A zero delay puts the host back to its limits.
+func (s *Scheduler) SetCrawlDelay(name string, delay time.Duration) {
+	h := s.host(name, false)
+
+	limit, burst := h.limits.bucket()
+	if delay > 0 && rate.Every(delay) < limit {
+		limit, burst = rate.Every(delay), 1
+	}
+
+	if h.limiter.Limit() != limit || h.limiter.Burst() != burst {
+		h.limiter.SetLimit(limit)
+		h.limiter.SetBurst(burst)
+	}
+}
+
+// host returns the state for the host, creating it the first time the host is seen. A held host isn't forgotten until
+// it is released. Idle hosts are swept out along the way.
+func (s *Scheduler) host(name string, hold bool) *host {
+	name = strings.ToLower(name)
+	now := Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if now.Sub(s.swept) >= sweepInterval {
+		s.sweep(now)
+	}
+
+	h, ok := s.hosts[name]
+	if !ok {
+		limits := s.Limits(name)
+		h = &host{limits: limits, limiter: rate.NewLimiter(limits.bucket())}
+		if limits.Concurrency > 0 {
+			h.slots = make(chan struct{}, limits.Concurrency)
+		}
+		s.hosts[name] = h
+	}
+
+	h.used = now
+	if hold {
+		h.holders++
+	}
+
+	return h
+}
+
+// release lets go of a host held by Acquire.
+func (s *Scheduler) release(h *host) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	h.holders--
+	h.used = Now()
+}
+
+// sweep forgets the hosts nobody is holding that have been idle for long enough, s.mu must be held.
+func (s *Scheduler) sweep(now time.Time) {
+	for name, h := range s.hosts {
+		if h.holders == 0 && now.Sub(h.used) >= h.idle() {
+			delete(s.hosts, name)
+		}
+	}
+	s.swept = now
+}
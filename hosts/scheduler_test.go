@@ -0,0 +1,107 @@
+package hosts_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pocockn/downloader/hosts"
+)
+
+func TestScheduler_Limits(t *testing.T) {
+	defaults := hosts.Limits{Concurrency: 2}
+	s := hosts.New(defaults, map[string]hosts.Limits{
+		"example.com":     {Concurrency: 1},
+		"api.example.com": {Concurrency: 3},
+	})
+
+	assert.Equal(t, defaults, s.Limits("www.test.com"))
+	assert.Equal(t, hosts.Limits{Concurrency: 1}, s.Limits("example.com"))
+	assert.Equal(t, hosts.Limits{Concurrency: 1}, s.Limits("WWW.Example.com"), "overrides apply to subdomains")
+	assert.Equal(t, hosts.Limits{Concurrency: 3}, s.Limits("v1.api.example.com"), "the most specific override wins")
+	assert.Equal(t, defaults, s.Limits("notexample.com"))
+}
+
+func TestScheduler_Concurrency(t *testing.T) {
+	s := hosts.New(hosts.Limits{Concurrency: 1}, nil)
+
+	release, err := s.Acquire(context.Background(), "www.example.com")
+	require.NoError(t, err)
+
+	t.Run("Other hosts aren't held up", func(t *testing.T) {
+		other, err := s.Acquire(context.Background(), "www.test.com")
+		require.NoError(t, err)
+		other()
+	})
+
+	t.Run("Requests wait for a free slot", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+
+		_, err := s.Acquire(ctx, "www.example.com")
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+		release()
+		release, err = s.Acquire(context.Background(), "www.example.com")
+		require.NoError(t, err)
+		release()
+	})
+}
+
+func TestScheduler_Rate(t *testing.T) {
+	s := hosts.New(hosts.Limits{Rate: 10, Burst: 1}, nil)
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		release, err := s.Acquire(context.Background(), "www.example.com")
+		require.NoError(t, err)
+		release()
+	}
+	assert.GreaterOrEqual(t, time.Since(start), 150*time.Millisecond)
+
+	t.Run("Waiting for a token is abandoned once ctx is done", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		_, err := s.Acquire(ctx, "www.example.com")
+		assert.ErrorIs(t, err, context.Canceled)
+	})
+}
+
+func TestScheduler_Idle(t *testing.T) {
+	defer func() { hosts.Now = time.Now }()
+
+	s := hosts.New(hosts.Limits{Concurrency: 1}, nil)
+	start := time.Now()
+	hosts.Now = func() time.Time { return start }
+
+	held, err := s.Acquire(context.Background(), "held.com")
+	require.NoError(t, err)
+	release, err := s.Acquire(context.Background(), "idle.com")
+	require.NoError(t, err)
+	release()
+	// a crawl delay of an hour takes an hour to fill the host's bucket back up.
+	s.SetCrawlDelay("slow.com", time.Hour)
+
+	t.Run("Hosts that have been idle for long enough are forgotten", func(t *testing.T) {
+		hosts.Now = func() time.Time { return start.Add(11 * time.Minute) }
+
+		release, err := s.Acquire(context.Background(), "other.com")
+		require.NoError(t, err)
+		release()
+		assert.Equal(t, 3, s.Len())
+	})
+
+	t.Run("Held hosts are only forgotten once they are released", func(t *testing.T) {
+		held()
+
+		hosts.Now = func() time.Time { return start.Add(22 * time.Minute) }
+		release, err := s.Acquire(context.Background(), "other.com")
+		require.NoError(t, err)
+		release()
+		assert.Equal(t, 2, s.Len())
+	})
+}
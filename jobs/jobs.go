@@ -0,0 +1,283 @@
+package jobs
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/pocockn/downloader/store"
+)
+
+// State is where a job is in its lifecycle.
+type State string
+
+// States a job moves through. A job starts queued, moves to downloading when a worker picks it up and finishes
+// succeeded or failed. Jobs handed back to the queue on shutdown return to queued.
+const (
+	StateQueued      State = "queued"
+	StateDownloading State = "downloading"
+	StateSucceeded   State = "succeeded"
+	StateFailed      State = "failed"
+)
+
+// Valid reports whether s is one of the known states.
+func (s State) Valid() bool {
+	switch s {
+	case StateQueued, StateDownloading, StateSucceeded, StateFailed:
+		return true
+	}
+	return false
+}
+
+var (
+	// ErrNotFound is returned when there is no job with the given ID.
+	ErrNotFound = errors.New("job not found")
+	// ErrExists is returned when a job is created with an ID that is already in use.
+	ErrExists = errors.New("job already exists")
+)
+
+// Now is used, so we can fix the time within our tests.
+var Now = time.Now
+
+// Job is the status of a single submission of a URL. Reason and Error describe why a failed job failed, FilePath and
+// ContentHash point at the body a succeeded job downloaded.
+type Job struct {
+	ID          string
+	URL         string
+	State       State
+	Reason      string
+	Error       string
+	ContentHash string
+	FilePath    string
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+}
+
+// NewID returns a random job ID.
+func NewID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		// crypto/rand only fails if the OS can't give us randomness, fall back to something unique enough.
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
+
+// Tracker persists the state of every job in a store bucket so callers can poll for the outcome of a submission.
+type Tracker struct {
+	store     store.Store
+	retention time.Duration
+}
+
+// NewTracker returns a Tracker that keeps jobs in s. Finished jobs are kept for retention after they finish, until
+// Prune removes them. Zero keeps them forever.
+func NewTracker(s store.Store, retention time.Duration) *Tracker {
+	return &Tracker{store: s, retention: retention}
+}
+
+// Create records a new queued job for the URL. It returns ErrExists if the ID is already in use.
+func (t *Tracker) Create(id, url string) (Job, error) {
+	now := Now().UTC()
+	job := Job{
+		ID:        id,
+		URL:       url,
+		State:     StateQueued,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+
+	err := t.store.Update(id, func(old []byte) ([]byte, error) {
+		if old != nil {
+			return nil, ErrExists
+		}
+		return marshal(job)
+	})
+	if err != nil {
+		return Job{}, err
+	}
+
+	return job, nil
+}
+
+// Start marks the job as downloading.
+func (t *Tracker) Start(id string) error {
+	return t.update(id, func(job *Job) {
+		job.State = StateDownloading
+	})
+}
+
+// Requeue marks the job as queued again, for jobs handed back to the queue before they finished.
+func (t *Tracker) Requeue(id string) error {
+	return t.update(id, func(job *Job) {
+		job.State = StateQueued
+	})
+}
+
+// Succeed marks the job as succeeded, recording where the downloaded body was written.
+func (t *Tracker) Succeed(id, contentHash, filePath string) error {
+	return t.update(id, func(job *Job) {
+		job.State = StateSucceeded
+		job.Reason = ""
+		job.Error = ""
+		job.ContentHash = contentHash
+		job.FilePath = filePath
+	})
+}
+
+// Fail marks the job as failed for the reason given.
+func (t *Tracker) Fail(id, reason string, err error) error {
+	return t.update(id, func(job *Job) {
+		job.State = StateFailed
+		job.Reason = reason
+		job.Error = err.Error()
+	})
+}
+
+// Delete removes the job, for submissions that were never queued.
+func (t *Tracker) Delete(id string) error {
+	return t.store.Delete(id)
+}
+
+// Get returns the job with the given ID, or ErrNotFound.
+func (t *Tracker) Get(id string) (Job, error) {
+	bytes, err := t.store.Get(id)
+	if err != nil {
+		return Job{}, fmt.Errorf("unable to fetch job %s: %w", id, err)
+	}
+	if bytes == nil {
+		return Job{}, ErrNotFound
+	}
+
+	var job Job
+	if err := json.Unmarshal(bytes, &job); err != nil {
+		return Job{}, fmt.Errorf("unable to unmarshal bytes into job")
+	}
+
+	return job, nil
+}
+
+// List returns up to n jobs in the given state, most recently created first. An empty state lists jobs in every
+// state.
+func (t *Tracker) List(state State, n int) ([]Job, error) {
+	results, err := t.store.GetAll()
+	if err != nil {
+		return nil, fmt.Errorf("unable to fetch jobs: %w", err)
+	}
+
+	jobs := []Job{}
+	for _, result := range results {
+		var job Job
+		if err := json.Unmarshal(result, &job); err != nil {
+			return nil, fmt.Errorf("unable to unmarshal bytes into job")
+		}
+		if state == "" || job.State == state {
+			jobs = append(jobs, job)
+		}
+	}
+
+	sort.SliceStable(jobs, func(i, j int) bool {
+		return jobs[i].CreatedAt.After(jobs[j].CreatedAt)
+	})
+	if len(jobs) > n {
+		jobs = jobs[:n]
+	}
+
+	return jobs, nil
+}
+
+// Prune removes the succeeded and failed jobs that finished longer than the retention ago, so the jobs bucket and
+// every List doesn't grow forever. Queued and downloading jobs are kept however old they are. It returns how many jobs
+// were removed.
+func (t *Tracker) Prune() (int, error) {
+	if t.retention <= 0 {
+		return 0, nil
+	}
+
+	results, err := t.store.GetAll()
+	if err != nil {
+		return 0, fmt.Errorf("unable to fetch jobs: %w", err)
+	}
+
+	cutoff := Now().UTC().Add(-t.retention)
+
+	var removed int
+	for _, result := range results {
+		var job Job
+		if err := json.Unmarshal(result, &job); err != nil {
+			return removed, fmt.Errorf("unable to unmarshal bytes into job")
+		}
+
+		if (job.State != StateSucceeded && job.State != StateFailed) || !job.UpdatedAt.Before(cutoff) {
+			continue
+		}
+
+		if err := t.store.Delete(job.ID); err != nil {
+			return removed, fmt.Errorf("unable to remove job %s: %w", job.ID, err)
+		}
+		removed++
+	}
+
+	return removed, nil
+}
+
+// PruneEvery prunes the finished jobs past the retention every interval until ctx is done. It does nothing if the
+// interval or the retention is zero.
+func (t *Tracker) PruneEvery(ctx context.Context, interval time.Duration) {
+	if interval <= 0 || t.retention <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			pruned, err := t.Prune()
+			if err != nil {
+				fmt.Printf("unable to prune jobs: %+v \n", err)
+				continue
+			}
+			fmt.Printf("pruned %d finished jobs \n", pruned)
+		}
+	}
+}
+
+// update applies fn to the job within a single store update, returning ErrNotFound if the job doesn't exist.
+func (t *Tracker) update(id string, fn func(job *Job)) error {
+	err := t.store.Update(id, func(old []byte) ([]byte, error) {
+		if old == nil {
+			return nil, ErrNotFound
+		}
+
+		var job Job
+		if err := json.Unmarshal(old, &job); err != nil {
+			return nil, fmt.Errorf("unable to unmarshal bytes into job")
+		}
+
+		fn(&job)
+		job.UpdatedAt = Now().UTC()
+
+		return marshal(job)
+	})
+	if err != nil {
+		return fmt.Errorf("unable to update job %s: %w", id, err)
+	}
+
+	return nil
+}
+
+func marshal(job Job) ([]byte, error) {
+	bytes, err := json.Marshal(job)
+	if err != nil {
+		return nil, fmt.Errorf("unable to marshal job into bytes")
+	}
+	return bytes, nil
+}
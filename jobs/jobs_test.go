@@ -0,0 +1,153 @@
+package jobs_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pocockn/downloader/jobs"
+	"github.com/pocockn/downloader/store"
+)
+
+func TestTracker(t *testing.T) {
+	tracker := jobs.NewTracker(store.NewMemory(), 0)
+
+	job, err := tracker.Create("job", "http://www.example.com")
+	require.NoError(t, err)
+	assert.Equal(t, jobs.StateQueued, job.State)
+
+	t.Run("IDs can only be used once", func(t *testing.T) {
+		_, err := tracker.Create("job", "http://www.example1.com")
+		assert.ErrorIs(t, err, jobs.ErrExists)
+	})
+
+	t.Run("Jobs move through their states", func(t *testing.T) {
+		require.NoError(t, tracker.Start("job"))
+		job, err := tracker.Get("job")
+		require.NoError(t, err)
+		assert.Equal(t, jobs.StateDownloading, job.State)
+
+		require.NoError(t, tracker.Fail("job", "status", errors.New("404 Not Found")))
+		job, err = tracker.Get("job")
+		require.NoError(t, err)
+		assert.Equal(t, jobs.StateFailed, job.State)
+		assert.Equal(t, "status", job.Reason)
+		assert.Equal(t, "404 Not Found", job.Error)
+
+		require.NoError(t, tracker.Succeed("job", "hash", "downloads/ha/sh/hash"))
+		job, err = tracker.Get("job")
+		require.NoError(t, err)
+		assert.Equal(t, jobs.StateSucceeded, job.State)
+		assert.Empty(t, job.Reason)
+		assert.Equal(t, "downloads/ha/sh/hash", job.FilePath)
+	})
+
+	t.Run("Unknown jobs are not found", func(t *testing.T) {
+		_, err := tracker.Get("missing")
+		assert.ErrorIs(t, err, jobs.ErrNotFound)
+		assert.ErrorIs(t, tracker.Start("missing"), jobs.ErrNotFound)
+	})
+}
+
+func TestTracker_List(t *testing.T) {
+	defer func() { jobs.Now = time.Now }()
+
+	tracker := jobs.NewTracker(store.NewMemory(), 0)
+	start := time.Now()
+	for i, id := range []string{"first", "second", "third"} {
+		jobs.Now = func() time.Time { return start.Add(time.Duration(i) * time.Second) }
+		_, err := tracker.Create(id, "http://www.example.com")
+		require.NoError(t, err)
+	}
+	require.NoError(t, tracker.Start("second"))
+
+	t.Run("Jobs are listed most recently created first", func(t *testing.T) {
+		listed, err := tracker.List("", 2)
+		require.NoError(t, err)
+		require.Len(t, listed, 2)
+		assert.Equal(t, "third", listed[0].ID)
+		assert.Equal(t, "second", listed[1].ID)
+	})
+
+	t.Run("Jobs can be filtered by state", func(t *testing.T) {
+		listed, err := tracker.List(jobs.StateQueued, 10)
+		require.NoError(t, err)
+		require.Len(t, listed, 2)
+		assert.Equal(t, "third", listed[0].ID)
+		assert.Equal(t, "first", listed[1].ID)
+	})
+}
+
+func TestTracker_Prune(t *testing.T) {
+	defer func() { jobs.Now = time.Now }()
+
+	tracker := jobs.NewTracker(store.NewMemory(), time.Hour)
+	start := time.Now()
+	jobs.Now = func() time.Time { return start }
+	for _, id := range []string{"succeeded", "failed", "queued", "recent"} {
+		_, err := tracker.Create(id, "http://www.example.com")
+		require.NoError(t, err)
+	}
+	require.NoError(t, tracker.Succeed("succeeded", "hash", "downloads/ha/sh/hash"))
+	require.NoError(t, tracker.Fail("failed", "status", errors.New("404 Not Found")))
+
+	jobs.Now = func() time.Time { return start.Add(90 * time.Minute) }
+	require.NoError(t, tracker.Succeed("recent", "hash", "downloads/ha/sh/hash"))
+
+	t.Run("Finished jobs past the retention are removed", func(t *testing.T) {
+		jobs.Now = func() time.Time { return start.Add(2 * time.Hour) }
+
+		pruned, err := tracker.Prune()
+		require.NoError(t, err)
+		assert.Equal(t, 2, pruned)
+
+		for _, id := range []string{"succeeded", "failed"} {
+			_, err := tracker.Get(id)
+			assert.ErrorIs(t, err, jobs.ErrNotFound, id)
+		}
+	})
+
+	t.Run("Unfinished and recently finished jobs are kept", func(t *testing.T) {
+		listed, err := tracker.List("", 10)
+		require.NoError(t, err)
+		assert.Len(t, listed, 2)
+	})
+
+	t.Run("Zero retention keeps every job", func(t *testing.T) {
+		pruned, err := jobs.NewTracker(store.NewMemory(), 0).Prune()
+		require.NoError(t, err)
+		assert.Zero(t, pruned)
+	})
+}
+
+func TestTracker_PruneEvery(t *testing.T) {
+	defer func() { jobs.Now = time.Now }()
+
+	tracker := jobs.NewTracker(store.NewMemory(), time.Hour)
+	jobs.Now = func() time.Time { return time.Now().Add(-2 * time.Hour) }
+	_, err := tracker.Create("finished", "http://www.example.com")
+	require.NoError(t, err)
+	require.NoError(t, tracker.Succeed("finished", "hash", "downloads/ha/sh/hash"))
+	jobs.Now = time.Now
+
+	t.Run("Finished jobs past the retention are pruned every interval until ctx is done", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			tracker.PruneEvery(ctx, 10*time.Millisecond)
+		}()
+
+		require.Eventually(t, func() bool {
+			_, err := tracker.Get("finished")
+			return errors.Is(err, jobs.ErrNotFound)
+		}, 5*time.Second, 10*time.Millisecond)
+
+		cancel()
+		<-done
+	})
+}
@@ -1,29 +1,63 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
 
+	"github.com/pocockn/downloader/bandwidth"
 	"github.com/pocockn/downloader/config"
+	"github.com/pocockn/downloader/content"
+	"github.com/pocockn/downloader/destinations"
+	"github.com/pocockn/downloader/download"
 	"github.com/pocockn/downloader/handlers"
-	"github.com/pocockn/downloader/models"
+	"github.com/pocockn/downloader/hosts"
+	"github.com/pocockn/downloader/jobs"
+	"github.com/pocockn/downloader/queue"
+	"github.com/pocockn/downloader/robots"
 	"github.com/pocockn/downloader/store"
+	"github.com/pocockn/downloader/urls"
+	"github.com/pocockn/downloader/versions"
 	"github.com/pocockn/downloader/watcher"
 	"github.com/pocockn/downloader/worker"
 )
 
-const cfgPath = "config.yaml"
+const (
+	cfgPath = "config.yaml"
+	// blobsBucket holds the reference counts for the blobs in the content store.
+	blobsBucket = "blobs"
+	// queueBucket holds the submitted URLs waiting to be downloaded.
+	queueBucket = "queue"
+	// jobsBucket holds the state of every submission.
+	jobsBucket = "jobs"
+	// versionsBucket holds the version history of the URLs the watcher keeps fresh.
+	versionsBucket = "versions"
+)
+
+// migrate moves URL records stored before submissions were normalised under their canonical keys, merging any
+// duplicates, and exits. It should be run once, while no other instance is using the store.
+var migrate = flag.Bool("migrate", false, "merge url records stored under non canonical keys, then exit")
 
 func main() {
+	flag.Parse()
+
 	cfg, err := config.New(cfgPath)
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
 	e := echo.New()
 	e.Use(
 		middleware.RequestID(),
@@ -35,22 +69,192 @@ func main() {
 		middleware.Logger(),
 	)
 
-	db, err := store.ConnectBolt(cfg.TableName)
+	db, err := store.Open(cfg.Store.Driver, cfg.TableName, store.Options{
+		Path:         cfg.Store.Path,
+		Timeout:      cfg.Store.Timeout,
+		NoSync:       cfg.Store.NoSync,
+		FreelistType: cfg.Store.FreelistType,
+		ReadOnly:     cfg.Store.ReadOnly,
+	})
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	urlChan := make(chan models.URL)
+	refs, err := db.Bucket(blobsBucket)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	storage, err := content.New(cfg.OutputDir, refs)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	overrides := make(map[string]hosts.Limits, len(cfg.Hosts.Overrides))
+	for domain, limits := range cfg.Hosts.Overrides {
+		overrides[domain] = hosts.Limits(limits)
+	}
+
+	destinationPolicy, err := destinations.New(cfg.Destinations.AllowCIDRs, cfg.Destinations.AllowHosts)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	pool := worker.NewPool(cfg.Workers, db, urlChan)
-	watch := watcher.New(cfg.WatchInterval, db)
+	// the limiter is shared by the workers and the watcher, through the client, so the limits hold across both.
+	limiter := bandwidth.New(bandwidth.Limits{Global: cfg.Bandwidth.Global, PerHost: cfg.Bandwidth.PerHost})
+
+	client := download.NewClient(download.Options{
+		UserAgent:      cfg.Download.UserAgent,
+		ConnectTimeout: cfg.Download.ConnectTimeout,
+		HeaderTimeout:  cfg.Download.HeaderTimeout,
+		Timeout:        cfg.Download.Timeout,
+		Bandwidth:      limiter,
+		Destinations:   destinationPolicy,
+	})
+
+	var checker *robots.Checker
+	if cfg.Robots.Enabled {
+		checker = robots.NewChecker(client, cfg.Download.UserAgent, cfg.Robots.TTL)
+	}
+
+	var segmenter *download.Segmenter
+	if cfg.Download.Segments.Threshold > 0 && cfg.Download.Segments.Count > 1 {
+		// by default segments share a budget the size of the worker pool.
+		connections := cfg.Download.Segments.Connections
+		if connections == 0 {
+			connections = cfg.Workers
+		}
+		segmenter = download.NewSegmenter(cfg.Download.Segments.Threshold, cfg.Download.Segments.Count, connections)
+	}
+
+	policy, err := download.NewPolicy(
+		cfg.Download.MaxSize,
+		cfg.Download.ContentTypes.Allow,
+		cfg.Download.ContentTypes.Deny,
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// the scheduler is shared by the workers and the watcher, through the downloader, so the limits hold across both.
+	d := download.New(storage, client, hosts.New(hosts.Limits(cfg.Hosts.Default), overrides), checker, segmenter, policy)
+
+	pending, err := db.Bucket(queueBucket)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	states, err := db.Bucket(jobsBucket)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	dedupe, err := worker.NewDedupe(cfg.Dedupe.Policy, cfg.Dedupe.Window, cfg.Dedupe.Size)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	tracker := jobs.NewTracker(states, cfg.Jobs.Retention)
+	q := queue.New(pending, queue.Options{
+		VisibilityTimeout: cfg.Queue.VisibilityTimeout,
+		Capacity:          cfg.Queue.Capacity,
+		MaxDeliveries:     cfg.Queue.MaxDeliveries,
+	})
+	pool := worker.NewPool(cfg.Workers, db, d, worker.RetryPolicy{
+		MaxAttempts:     cfg.Retry.MaxAttempts,
+		BaseDelay:       cfg.Retry.BaseDelay,
+		MaxDelay:        cfg.Retry.MaxDelay,
+		Jitter:          cfg.Retry.Jitter,
+		RetryableStatus: cfg.Retry.RetryableStatus,
+	}, dedupe, q, tracker)
+
+	histories, err := db.Bucket(versionsBucket)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	history := versions.NewHistory(histories, storage, versions.Retention{
+		MaxVersions: cfg.Versions.MaxVersions,
+		MaxAge:      cfg.Versions.MaxAge,
+	})
+	normalizer := urls.NewNormalizer(urls.Options{
+		SortQuery:      cfg.URLs.SortQuery,
+		TrackingParams: cfg.URLs.TrackingParams,
+	})
+
+	if *migrate {
+		merged, err := urls.Migrate(db, normalizer, storage, history, q)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("merged %d duplicate urls", merged)
+
+		if err := db.Disconnect(); err != nil {
+			log.Printf("unable to disconnect store: %+v", err)
+		}
+		return
+	}
+
+	watch := watcher.New(cfg.WatchInterval, db, d, history, limiter)
 
 	go pool.Run()
 	go watch.Process()
+	go tracker.PruneEvery(ctx, cfg.Jobs.PruneInterval)
 
-	h := handlers.New(db, pool)
+	h := handlers.New(db, pool, history, limiter, normalizer)
 	e.POST("store", h.URLStore)
 	e.GET("urls", h.URLs)
+	e.GET("urls/:url/versions", h.Versions)
+	e.GET("queue", h.Queue)
+	e.GET("jobs", h.Jobs)
+	e.GET("jobs/:id", h.Job)
+
+	// the admin endpoints change how the service behaves, so they are served on their own listener, which by default
+	// only accepts connections from the same machine, rather than next to the public ones.
+	admin := echo.New()
+	admin.Use(middleware.RequestID(), middleware.Recover(), middleware.Logger())
+	admin.GET("admin/bandwidth", h.Bandwidth)
+	admin.PUT("admin/bandwidth", h.SetBandwidth)
+
+	go func() {
+		if err := e.Start(fmt.Sprintf(":%s", cfg.Port)); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal(err)
+		}
+	}()
+
+	if cfg.Admin.Address != "" {
+		go func() {
+			if err := admin.Start(cfg.Admin.Address); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				log.Fatal(err)
+			}
+		}()
+	}
+
+	// block until we're told to stop, then shut everything down in order: stop taking requests, let the workers and
+	// watcher finish what they are doing and finally close the store.
+	<-ctx.Done()
+	log.Println("shutting down...")
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+
+	if err := e.Shutdown(shutdownCtx); err != nil {
+		log.Printf("unable to shut down http server: %+v", err)
+	}
+
+	if err := admin.Shutdown(shutdownCtx); err != nil {
+		log.Printf("unable to shut down admin server: %+v", err)
+	}
+
+	if err := pool.Stop(shutdownCtx); err != nil {
+		log.Printf("unable to stop worker pool: %+v", err)
+	}
+
+	if err := watch.Stop(shutdownCtx); err != nil {
+		log.Printf("unable to stop watcher: %+v", err)
+	}
 
-	log.Fatal(e.Start(fmt.Sprintf(":%s", cfg.Port)))
+	if err := db.Disconnect(); err != nil {
+		log.Printf("unable to disconnect store: %+v", err)
+	}
 }
@@ -1,5 +1,5 @@
 // Code generated by MockGen. DO NOT EDIT.
-// Source: github.com/pocockn/spamhaus/internal/store (interfaces: store)
+// Source: github.com/pocockn/downloader/store (interfaces: Store)
 
 // Package mocks is a generated GoMock package.
 package mocks
@@ -8,9 +8,10 @@ import (
 	reflect "reflect"
 
 	gomock "github.com/golang/mock/gomock"
+	store "github.com/pocockn/downloader/store"
 )
 
-// MockStore is a mock of store interface.
+// MockStore is a mock of Store interface.
 type MockStore struct {
 	ctrl     *gomock.Controller
 	recorder *MockStoreMockRecorder
@@ -33,6 +34,35 @@ func (m *MockStore) EXPECT() *MockStoreMockRecorder {
 	return m.recorder
 }
 
+// Bucket mocks base method.
+func (m *MockStore) Bucket(arg0 string) (store.Store, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Bucket", arg0)
+	ret0, _ := ret[0].(store.Store)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Bucket indicates an expected call of Bucket.
+func (mr *MockStoreMockRecorder) Bucket(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Bucket", reflect.TypeOf((*MockStore)(nil).Bucket), arg0)
+}
+
+// Delete mocks base method.
+func (m *MockStore) Delete(arg0 string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Delete", arg0)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Delete indicates an expected call of Delete.
+func (mr *MockStoreMockRecorder) Delete(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Delete", reflect.TypeOf((*MockStore)(nil).Delete), arg0)
+}
+
 // Disconnect mocks base method.
 func (m *MockStore) Disconnect() error {
 	m.ctrl.T.Helper()
@@ -47,6 +77,20 @@ func (mr *MockStoreMockRecorder) Disconnect() *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Disconnect", reflect.TypeOf((*MockStore)(nil).Disconnect))
 }
 
+// Each mocks base method.
+func (m *MockStore) Each(arg0 func([]byte) (bool, error)) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Each", arg0)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Each indicates an expected call of Each.
+func (mr *MockStoreMockRecorder) Each(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Each", reflect.TypeOf((*MockStore)(nil).Each), arg0)
+}
+
 // Get mocks base method.
 func (m *MockStore) Get(arg0 string) ([]byte, error) {
 	m.ctrl.T.Helper()
@@ -77,6 +121,21 @@ func (mr *MockStoreMockRecorder) GetAll() *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetAll", reflect.TypeOf((*MockStore)(nil).GetAll))
 }
 
+// Latest mocks base method.
+func (m *MockStore) Latest(arg0 int) ([][]byte, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Latest", arg0)
+	ret0, _ := ret[0].([][]byte)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Latest indicates an expected call of Latest.
+func (mr *MockStoreMockRecorder) Latest(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Latest", reflect.TypeOf((*MockStore)(nil).Latest), arg0)
+}
+
 // Set mocks base method.
 func (m *MockStore) Set(arg0 string, arg1 []byte) error {
 	m.ctrl.T.Helper()
@@ -90,3 +149,46 @@ func (mr *MockStoreMockRecorder) Set(arg0, arg1 interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Set", reflect.TypeOf((*MockStore)(nil).Set), arg0, arg1)
 }
+
+// TopSubmitted mocks base method.
+func (m *MockStore) TopSubmitted(arg0 int) ([][]byte, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "TopSubmitted", arg0)
+	ret0, _ := ret[0].([][]byte)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// TopSubmitted indicates an expected call of TopSubmitted.
+func (mr *MockStoreMockRecorder) TopSubmitted(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "TopSubmitted", reflect.TypeOf((*MockStore)(nil).TopSubmitted), arg0)
+}
+
+// Transaction mocks base method.
+func (m *MockStore) Transaction(arg0 func(store.Tx) error) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Transaction", arg0)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Transaction indicates an expected call of Transaction.
+func (mr *MockStoreMockRecorder) Transaction(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Transaction", reflect.TypeOf((*MockStore)(nil).Transaction), arg0)
+}
+
+// Update mocks base method.
+func (m *MockStore) Update(arg0 string, arg1 func([]byte) ([]byte, error)) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Update", arg0, arg1)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Update indicates an expected call of Update.
+func (mr *MockStoreMockRecorder) Update(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Update", reflect.TypeOf((*MockStore)(nil).Update), arg0, arg1)
+}
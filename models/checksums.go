@@ -0,0 +1,45 @@
+package models
+
+import (
+	"encoding/hex"
+	"fmt"
+)
+
+// Checksums are the digests a URL's body is expected to have, as hex. Empty digests aren't checked. FetchSHA256 looks
+// the SHA-256 up in the sibling file the URL's server publishes next to it, the URL with .sha256 appended, when
+// SHA256 isn't given.
+type Checksums struct {
+	SHA256      string `query:"sha256"`
+	SHA512      string `query:"sha512"`
+	MD5         string `query:"md5"`
+	FetchSHA256 bool   `query:"fetch_sha256"`
+}
+
+// Empty reports whether there is nothing to check.
+func (c Checksums) Empty() bool {
+	return c.SHA256 == "" && c.SHA512 == "" && c.MD5 == "" && !c.FetchSHA256
+}
+
+// Validate returns an error if a digest isn't hex of the right length for its algorithm.
+func (c Checksums) Validate() error {
+	for _, digest := range []struct {
+		name  string
+		value string
+		size  int
+	}{
+		{name: "SHA256", value: c.SHA256, size: 32},
+		{name: "SHA512", value: c.SHA512, size: 64},
+		{name: "MD5", value: c.MD5, size: 16},
+	} {
+		if digest.value == "" {
+			continue
+		}
+
+		decoded, err := hex.DecodeString(digest.value)
+		if err != nil || len(decoded) != digest.size {
+			return fmt.Errorf("%s must be %d hex characters", digest.name, digest.size*2)
+		}
+	}
+
+	return nil
+}
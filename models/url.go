@@ -3,9 +3,25 @@ package models
 import "time"
 
 // URL holds a URL, how many times the URL has been submitted via the API. The time it was created and updated.
+// ContentHash, FilePath, Size and ContentType describe the body from the most recent successful download, while
+// FailureReason and LastError describe why the most recent download failed, they are cleared on success. Attempts
+// is how many tries the most recent download took. ETag and LastModified are the validators the server sent with the
+// body, they are sent back on the next download so an unchanged body isn't downloaded again. Checksums are the digests
+// the body is expected to have, a body that doesn't match them is thrown away.
 type URL struct {
-	URL       string `query:"url"`
-	Submitted int
-	CreatedAt time.Time
-	UpdatedAt time.Time
+	URL          string `query:"url"`
+	Submitted    int
+	CreatedAt    time.Time
+	UpdatedAt    time.Time
+	ContentHash  string
+	FilePath     string
+	Size         int64
+	ContentType  string
+	ETag         string
+	LastModified string
+	Checksums    Checksums
+
+	FailureReason string
+	LastError     string
+	Attempts      int
 }
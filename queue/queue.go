@@ -0,0 +1,397 @@
+package queue
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pocockn/downloader/models"
+	"github.com/pocockn/downloader/store"
+)
+
+// pollInterval is how often a waiting Lease looks for jobs whose lease has expired.
+const pollInterval = time.Second
+
+// Now is used, so we can fix the time within our tests.
+var Now = time.Now
+
+// ErrFull is returned when a job is enqueued onto a queue that is at capacity.
+var ErrFull = errors.New("queue is full")
+
+// ErrLeaseLost is returned when a worker renews, releases or acks a job whose lease has expired and been handed to
+// another worker.
+var ErrLeaseLost = errors.New("lease on job has been lost")
+
+// errUnavailable is returned from within an update when the job has been acked or leased by someone else.
+var errUnavailable = errors.New("job is unavailable")
+
+// Job is a submitted URL waiting to be, or being, downloaded.
+type Job struct {
+	// Key is the job's position in the queue, keys sort in the order jobs were enqueued.
+	Key string
+	// ID identifies the submission the job was queued for.
+	ID         string
+	URL        models.URL
+	EnqueuedAt time.Time
+	// LeasedUntil is when the current lease expires, it is zero while the job is pending. A job whose lease has
+	// expired is handed out again, so work lost in a crash is replayed.
+	LeasedUntil time.Time
+	// Deliveries is how many times the job has been leased, it identifies the current lease.
+	Deliveries int
+	// Releases is how many of the deliveries were handed back with Release rather than lost.
+	Releases int
+}
+
+// leased reports whether the job is held by a worker at the given time.
+func (j Job) leased(now time.Time) bool {
+	return now.Before(j.LeasedUntil)
+}
+
+// Options configures a queue.
+type Options struct {
+	// VisibilityTimeout is how long a job is leased to a worker before it is handed out again.
+	VisibilityTimeout time.Duration
+	// Capacity is the most jobs, leased or not, the queue holds. Zero means no limit.
+	Capacity int
+	// MaxDeliveries is how many times a job can be leased without being acked or released before it is exhausted, so
+	// a job that keeps killing its worker isn't replayed forever. Zero means no limit.
+	MaxDeliveries int
+}
+
+// Queue is a durable FIFO queue of jobs kept in a store bucket. Jobs are leased to workers for the visibility
+// timeout and only removed once acked, so anything queued or in flight when the process dies is picked up again.
+type Queue struct {
+	store      store.Store
+	visibility time.Duration
+	capacity   int
+	// maxDeliveries is how many times a job can be lost before it is exhausted, zero means no limit.
+	maxDeliveries int
+	notify        chan struct{}
+	seq           uint64
+
+	// mu guards depth, which is counted from the store the first time it is needed.
+	mu      sync.Mutex
+	depth   int
+	counted bool
+}
+
+// New returns a queue that keeps its jobs in s.
+func New(s store.Store, opts Options) *Queue {
+	return &Queue{
+		store:         s,
+		visibility:    opts.VisibilityTimeout,
+		capacity:      opts.Capacity,
+		maxDeliveries: opts.MaxDeliveries,
+		notify:        make(chan struct{}, 1),
+	}
+}
+
+// Capacity returns the most jobs the queue holds, zero means no limit.
+func (q *Queue) Capacity() int {
+	return q.capacity
+}
+
+// Visibility returns how long a job is leased to a worker before it is handed out again.
+func (q *Queue) Visibility() time.Duration {
+	return q.visibility
+}
+
+// Depth returns how many jobs are in the queue, including those leased to a worker.
+func (q *Queue) Depth() (int, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if err := q.count(); err != nil {
+		return 0, err
+	}
+
+	return q.depth, nil
+}
+
+// Enqueue adds the URL to the back of the queue under the submission ID without blocking. It returns ErrFull if the
+// queue is at capacity.
+func (q *Queue) Enqueue(id string, url models.URL) (Job, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if err := q.count(); err != nil {
+		return Job{}, err
+	}
+	if q.capacity > 0 && q.depth >= q.capacity {
+		return Job{}, ErrFull
+	}
+
+	now := Now().UTC()
+	job := Job{
+		// keys sort in enqueue order, the sequence number breaks ties between jobs enqueued in the same nanosecond.
+		Key:        fmt.Sprintf("%020d-%010d", now.UnixNano(), atomic.AddUint64(&q.seq, 1)),
+		ID:         id,
+		URL:        url,
+		EnqueuedAt: now,
+	}
+
+	bytes, err := json.Marshal(job)
+	if err != nil {
+		return Job{}, fmt.Errorf("unable to marshal job into bytes")
+	}
+
+	if err := q.store.Set(job.Key, bytes); err != nil {
+		return Job{}, fmt.Errorf("unable to enqueue %s: %w", url.URL, err)
+	}
+	q.depth++
+
+	// wake a waiting worker, if one is already being woken there is no need to queue another.
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+
+	return job, nil
+}
+
+// Lease blocks until a job is available and leases it to the caller, or until ctx is done. The caller must Ack the
+// job once it is finished with, or Release it to hand it straight back, and Extend the lease for as long as it holds
+// the job. Deliveries identifies the lease, so a worker whose lease has expired can't ack or release the job once
+// it has been handed to another.
+func (q *Queue) Lease(ctx context.Context) (Job, error) {
+	for {
+		job, ok, err := q.tryLease()
+		if err != nil || ok {
+			return job, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return Job{}, ctx.Err()
+		case <-q.notify:
+		case <-time.After(pollInterval):
+		}
+	}
+}
+
+// tryLease leases the oldest available job, ok is false when there are none. The queue is only read as far as the
+// first job that isn't leased, so leasing doesn't load every queued job.
+func (q *Queue) tryLease() (Job, bool, error) {
+	for {
+		now := Now().UTC()
+		key, err := q.firstAvailable(now)
+		if err != nil || key == "" {
+			return Job{}, false, err
+		}
+
+		leased, err := q.update(key, func(job *Job) error {
+			if job.leased(now) {
+				return errUnavailable
+			}
+			job.LeasedUntil = now.Add(q.visibility)
+			job.Deliveries++
+			return nil
+		})
+		// another worker leased or acked the job first, so look again.
+		if errors.Is(err, errUnavailable) {
+			continue
+		}
+		if err != nil {
+			return Job{}, false, err
+		}
+
+		return leased, true, nil
+	}
+}
+
+// firstAvailable returns the key of the oldest job that isn't leased at now, or an empty key when there are none.
+func (q *Queue) firstAvailable(now time.Time) (string, error) {
+	var key string
+	err := q.store.Each(func(value []byte) (bool, error) {
+		var job Job
+		if err := json.Unmarshal(value, &job); err != nil {
+			return false, fmt.Errorf("unable to unmarshal bytes into job")
+		}
+		if job.leased(now) {
+			return true, nil
+		}
+
+		key = job.Key
+		return false, nil
+	})
+	if err != nil {
+		return "", fmt.Errorf("unable to fetch jobs: %w", err)
+	}
+
+	return key, nil
+}
+
+// Exhausted reports whether the job has been delivered the maximum number of times without being finished, such a
+// job should be failed and acked rather than processed again. Deliveries handed back with Release don't count.
+func (q *Queue) Exhausted(job Job) bool {
+	return q.maxDeliveries > 0 && job.Deliveries-job.Releases > q.maxDeliveries
+}
+
+// Extend renews the lease on a job for another visibility timeout, for work that may outlast a single lease. It
+// returns ErrLeaseLost if the job has since been leased to someone else.
+func (q *Queue) Extend(held Job) error {
+	_, err := q.update(held.Key, func(job *Job) error {
+		if job.Deliveries != held.Deliveries {
+			return ErrLeaseLost
+		}
+		job.LeasedUntil = Now().UTC().Add(q.visibility)
+		return nil
+	})
+	return err
+}
+
+// Release hands a leased job back to the queue so it can be leased again straight away. It returns ErrLeaseLost if
+// the job has since been leased to someone else.
+func (q *Queue) Release(held Job) error {
+	_, err := q.update(held.Key, func(job *Job) error {
+		if job.Deliveries != held.Deliveries {
+			return ErrLeaseLost
+		}
+		job.LeasedUntil = time.Time{}
+		job.Releases++
+		return nil
+	})
+	return err
+}
+
+// Ack removes a finished job from the queue. It returns ErrLeaseLost, leaving the job queued, if the job has since
+// been leased to someone else.
+func (q *Queue) Ack(held Job) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if err := q.count(); err != nil {
+		return err
+	}
+
+	// the job is checked and removed in one transaction, so a lease handed out in between can't be acked.
+	var removed bool
+	err := q.store.Transaction(func(tx store.Tx) error {
+		bytes, err := tx.Get(held.Key)
+		if err != nil {
+			return err
+		}
+		// only count jobs that are still queued, so acking twice doesn't throw the depth out.
+		if bytes == nil {
+			return nil
+		}
+
+		var job Job
+		if err := json.Unmarshal(bytes, &job); err != nil {
+			return fmt.Errorf("unable to unmarshal bytes into job")
+		}
+		if job.Deliveries != held.Deliveries {
+			return ErrLeaseLost
+		}
+
+		removed = true
+		return tx.Delete(held.Key)
+	})
+	if err != nil {
+		return fmt.Errorf("unable to ack job %s: %w", held.Key, err)
+	}
+	if removed {
+		q.depth--
+	}
+
+	return nil
+}
+
+// Rewrite replaces the URL of every job in the queue with the one fn returns for it, jobs keep their place in the
+// queue. It returns how many jobs were changed, and is meant to be run by migrations while nothing is leasing jobs.
+func (q *Queue) Rewrite(fn func(url string) string) (int, error) {
+	jobs, err := q.jobs()
+	if err != nil {
+		return 0, err
+	}
+
+	var rewritten int
+	for _, job := range jobs {
+		url := fn(job.URL.URL)
+		if url == job.URL.URL {
+			continue
+		}
+
+		_, err := q.update(job.Key, func(job *Job) error {
+			job.URL.URL = url
+			return nil
+		})
+		if errors.Is(err, errUnavailable) {
+			continue
+		}
+		if err != nil {
+			return rewritten, fmt.Errorf("unable to rewrite job %s: %w", job.ID, err)
+		}
+		rewritten++
+	}
+
+	return rewritten, nil
+}
+
+// count loads the depth of the queue from the store if it hasn't been already, q.mu must be held.
+func (q *Queue) count() error {
+	if q.counted {
+		return nil
+	}
+
+	jobs, err := q.store.GetAll()
+	if err != nil {
+		return fmt.Errorf("unable to count jobs: %w", err)
+	}
+	q.depth = len(jobs)
+	q.counted = true
+
+	return nil
+}
+
+// jobs returns every job in the queue, oldest first. Every store returns its records in key order, which for jobs is
+// the order they were enqueued in.
+func (q *Queue) jobs() ([]Job, error) {
+	results, err := q.store.GetAll()
+	if err != nil {
+		return nil, fmt.Errorf("unable to fetch jobs: %w", err)
+	}
+
+	jobs := make([]Job, 0, len(results))
+	for _, result := range results {
+		var job Job
+		if err := json.Unmarshal(result, &job); err != nil {
+			return nil, fmt.Errorf("unable to unmarshal bytes into job")
+		}
+		jobs = append(jobs, job)
+	}
+
+	return jobs, nil
+}
+
+// update applies fn to the job with the given key within a single store update. Jobs that have been acked return
+// errUnavailable.
+func (q *Queue) update(key string, fn func(job *Job) error) (Job, error) {
+	var job Job
+	err := q.store.Update(key, func(old []byte) ([]byte, error) {
+		if old == nil {
+			return nil, errUnavailable
+		}
+
+		if err := json.Unmarshal(old, &job); err != nil {
+			return nil, fmt.Errorf("unable to unmarshal bytes into job")
+		}
+
+		if err := fn(&job); err != nil {
+			return nil, err
+		}
+
+		bytes, err := json.Marshal(job)
+		if err != nil {
+			return nil, fmt.Errorf("unable to marshal job into bytes")
+		}
+
+		return bytes, nil
+	})
+
+	return job, err
+}
@@ -0,0 +1,216 @@
+package queue_test
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pocockn/downloader/models"
+	"github.com/pocockn/downloader/queue"
+	"github.com/pocockn/downloader/store"
+)
+
+func TestQueue(t *testing.T) {
+	q := queue.New(store.NewMemory(), queue.Options{VisibilityTimeout: time.Minute})
+
+	first, err := q.Enqueue("first", models.URL{URL: "http://www.example.com"})
+	require.NoError(t, err)
+	second, err := q.Enqueue("second", models.URL{URL: "http://www.example1.com"})
+	require.NoError(t, err)
+
+	var leased queue.Job
+
+	t.Run("Jobs are leased in the order they were enqueued", func(t *testing.T) {
+		job, err := q.Lease(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, first.Key, job.Key)
+		assert.Equal(t, "first", job.ID)
+		assert.Equal(t, "http://www.example.com", job.URL.URL)
+		assert.Equal(t, 1, job.Deliveries)
+		leased = job
+
+		job, err = q.Lease(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, second.Key, job.Key)
+	})
+
+	t.Run("Leased jobs are not handed out again", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+
+		_, err := q.Lease(ctx)
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+	})
+
+	t.Run("Released jobs are handed out again", func(t *testing.T) {
+		require.NoError(t, q.Release(leased))
+
+		job, err := q.Lease(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, first.Key, job.Key)
+		assert.Equal(t, 2, job.Deliveries)
+		leased = job
+	})
+
+	t.Run("Acked jobs are removed", func(t *testing.T) {
+		require.NoError(t, q.Ack(leased))
+		assert.Error(t, q.Release(leased))
+	})
+
+	t.Run("Lease waits for a job to be enqueued", func(t *testing.T) {
+		go func() {
+			time.Sleep(50 * time.Millisecond)
+			_, err := q.Enqueue("job", models.URL{URL: "http://www.example2.com"})
+			assert.NoError(t, err)
+		}()
+
+		job, err := q.Lease(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, "http://www.example2.com", job.URL.URL)
+	})
+}
+
+func TestQueue_Visibility(t *testing.T) {
+	defer func() { queue.Now = time.Now }()
+
+	q := queue.New(store.NewMemory(), queue.Options{VisibilityTimeout: time.Minute})
+	enqueued, err := q.Enqueue("job", models.URL{URL: "http://www.example.com"})
+	require.NoError(t, err)
+
+	expired, err := q.Lease(context.Background())
+	require.NoError(t, err)
+
+	var leased queue.Job
+
+	t.Run("Jobs whose lease has expired are handed out again", func(t *testing.T) {
+		queue.Now = func() time.Time { return time.Now().Add(2 * time.Minute) }
+
+		job, err := q.Lease(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, enqueued.Key, job.Key)
+		assert.Equal(t, 2, job.Deliveries)
+		leased = job
+	})
+
+	t.Run("A worker whose lease has expired can't extend, release or ack the job", func(t *testing.T) {
+		assert.ErrorIs(t, q.Extend(expired), queue.ErrLeaseLost)
+		assert.ErrorIs(t, q.Release(expired), queue.ErrLeaseLost)
+		assert.ErrorIs(t, q.Ack(expired), queue.ErrLeaseLost)
+
+		depth, err := q.Depth()
+		require.NoError(t, err)
+		assert.Equal(t, 1, depth)
+	})
+
+	t.Run("Extending a lease keeps the job hidden", func(t *testing.T) {
+		queue.Now = func() time.Time { return time.Now().Add(4 * time.Minute) }
+		require.NoError(t, q.Extend(leased))
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+
+		_, err := q.Lease(ctx)
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+	})
+}
+
+func TestQueue_MaxDeliveries(t *testing.T) {
+	defer func() { queue.Now = time.Now }()
+
+	q := queue.New(store.NewMemory(), queue.Options{VisibilityTimeout: time.Minute, MaxDeliveries: 1})
+	_, err := q.Enqueue("job", models.URL{URL: "http://www.example.com"})
+	require.NoError(t, err)
+
+	t.Run("Released deliveries don't count towards the maximum", func(t *testing.T) {
+		job, err := q.Lease(context.Background())
+		require.NoError(t, err)
+		assert.False(t, q.Exhausted(job))
+		require.NoError(t, q.Release(job))
+
+		job, err = q.Lease(context.Background())
+		require.NoError(t, err)
+		assert.False(t, q.Exhausted(job))
+	})
+
+	t.Run("Jobs whose leases keep expiring are exhausted", func(t *testing.T) {
+		queue.Now = func() time.Time { return time.Now().Add(2 * time.Minute) }
+
+		job, err := q.Lease(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, 3, job.Deliveries)
+		assert.True(t, q.Exhausted(job))
+	})
+
+	t.Run("Zero allows any number of deliveries", func(t *testing.T) {
+		assert.False(t, queue.New(store.NewMemory(), queue.Options{}).Exhausted(queue.Job{Deliveries: 100}))
+	})
+}
+
+func TestQueue_Capacity(t *testing.T) {
+	jobs := store.NewMemory()
+	q := queue.New(jobs, queue.Options{VisibilityTimeout: time.Minute, Capacity: 2})
+
+	first, err := q.Enqueue("job", models.URL{URL: "http://www.example.com"})
+	require.NoError(t, err)
+	_, err = q.Enqueue("job", models.URL{URL: "http://www.example1.com"})
+	require.NoError(t, err)
+
+	t.Run("Enqueue returns ErrFull once the queue is at capacity", func(t *testing.T) {
+		_, err := q.Enqueue("job", models.URL{URL: "http://www.example2.com"})
+		assert.ErrorIs(t, err, queue.ErrFull)
+
+		depth, err := q.Depth()
+		require.NoError(t, err)
+		assert.Equal(t, 2, depth)
+	})
+
+	t.Run("Acking a job makes room", func(t *testing.T) {
+		require.NoError(t, q.Ack(first))
+		require.NoError(t, q.Ack(first))
+
+		depth, err := q.Depth()
+		require.NoError(t, err)
+		assert.Equal(t, 1, depth)
+
+		_, err = q.Enqueue("job", models.URL{URL: "http://www.example2.com"})
+		assert.NoError(t, err)
+	})
+
+	t.Run("Depth counts jobs already in the store", func(t *testing.T) {
+		depth, err := queue.New(jobs, queue.Options{}).Depth()
+		require.NoError(t, err)
+		assert.Equal(t, 2, depth)
+	})
+}
+
+func TestQueue_Bolt(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queue.db")
+
+	db, err := store.ConnectBolt("urls", store.Options{Path: path})
+	require.NoError(t, err)
+
+	jobs, err := db.Bucket("queue")
+	require.NoError(t, err)
+
+	q := queue.New(jobs, queue.Options{VisibilityTimeout: time.Minute})
+	_, err = q.Enqueue("job", models.URL{URL: "http://www.example.com"})
+	require.NoError(t, err)
+	require.NoError(t, db.Disconnect())
+
+	t.Run("Queued jobs survive a restart", func(t *testing.T) {
+		db, err := store.ConnectBolt("urls", store.Options{Path: path})
+		require.NoError(t, err)
+		defer db.Disconnect()
+
+		jobs, err := db.Bucket("queue")
+		require.NoError(t, err)
+
+		job, err := queue.New(jobs, queue.Options{VisibilityTimeout: time.Minute}).Lease(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, "http://www.example.com", job.URL.URL)
+	})
+}
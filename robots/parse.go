@@ -0,0 +1,193 @@
+package robots
+
+import (
+	"bufio"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// rule allows or disallows the paths matching pattern. Patterns may contain * to match any run of characters and end
+// in $ to anchor them to the end of the path.
+type rule struct {
+	pattern string
+	allow   bool
+}
+
+// group is the rules that apply to a set of user agents.
+type group struct {
+	agents     []string
+	rules      []rule
+	crawlDelay time.Duration
+}
+
+// names reports whether the group applies to the agent.
+func (g group) names(agent string) bool {
+	for _, a := range g.agents {
+		if a == agent {
+			return true
+		}
+	}
+	return false
+}
+
+// Rules are the parts of a robots.txt that apply to us.
+type Rules struct {
+	rules      []rule
+	crawlDelay time.Duration
+}
+
+// AllowAll returns rules that allow every path.
+func AllowAll() *Rules {
+	return &Rules{}
+}
+
+// CrawlDelay returns how long we are asked to wait between requests, zero if there is no delay.
+func (r *Rules) CrawlDelay() time.Duration {
+	return r.crawlDelay
+}
+
+// Allowed reports whether the path, including any query string, may be fetched. The longest matching rule wins, an
+// allow wins a tie, and paths no rule matches are allowed.
+func (r *Rules) Allowed(path string) bool {
+	if path == "" {
+		path = "/"
+	}
+
+	allowed, longest := true, -1
+	for _, rule := range r.rules {
+		if !match(rule.pattern, path) {
+			continue
+		}
+
+		if len(rule.pattern) > longest || (len(rule.pattern) == longest && rule.allow) {
+			allowed, longest = rule.allow, len(rule.pattern)
+		}
+	}
+
+	return allowed
+}
+
+// Parse reads a robots.txt and returns the rules for the user agent. The groups naming the agent's product token
+// apply if there are any, otherwise the * groups do.
+func Parse(r io.Reader, userAgent string) (*Rules, error) {
+	groups, err := parseGroups(r)
+	if err != nil {
+		return nil, err
+	}
+
+	token := productToken(userAgent)
+	var specific, wildcard []group
+	for _, g := range groups {
+		switch {
+		case token != "" && g.names(token):
+			specific = append(specific, g)
+		case g.names("*"):
+			wildcard = append(wildcard, g)
+		}
+	}
+
+	matched := wildcard
+	if len(specific) > 0 {
+		matched = specific
+	}
+
+	rules := &Rules{}
+	for _, g := range matched {
+		rules.rules = append(rules.rules, g.rules...)
+		if g.crawlDelay > rules.crawlDelay {
+			rules.crawlDelay = g.crawlDelay
+		}
+	}
+
+	return rules, nil
+}
+
+// parseGroups splits a robots.txt into its groups. A group starts with one or more user-agent lines and runs until
+// the next user-agent line that follows a rule.
+func parseGroups(r io.Reader) ([]group, error) {
+	var groups []group
+	inRules := false
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		value = strings.TrimSpace(value)
+
+		switch key {
+		case "user-agent":
+			if len(groups) == 0 || inRules {
+				groups = append(groups, group{})
+				inRules = false
+			}
+			current := &groups[len(groups)-1]
+			current.agents = append(current.agents, strings.ToLower(value))
+		case "allow", "disallow":
+			if len(groups) == 0 {
+				continue
+			}
+			current := &groups[len(groups)-1]
+			inRules = true
+			// an empty disallow allows everything, which is the same as having no rule at all.
+			if value == "" {
+				continue
+			}
+			current.rules = append(current.rules, rule{pattern: value, allow: key == "allow"})
+		case "crawl-delay":
+			if len(groups) == 0 {
+				continue
+			}
+			current := &groups[len(groups)-1]
+			inRules = true
+			if seconds, err := strconv.ParseFloat(value, 64); err == nil && seconds > 0 {
+				current.crawlDelay = time.Duration(seconds * float64(time.Second))
+			}
+		}
+	}
+
+	return groups, scanner.Err()
+}
+
+// productToken returns the name at the start of a User-Agent, "downloader" for "downloader/1.0 (+https://...)".
+func productToken(userAgent string) string {
+	token, _, _ := strings.Cut(strings.TrimSpace(userAgent), "/")
+	token, _, _ = strings.Cut(token, " ")
+	return strings.ToLower(token)
+}
+
+// match reports whether the path matches the pattern.
+func match(pattern, path string) bool {
+	anchored := strings.HasSuffix(pattern, "$")
+	pattern = strings.TrimSuffix(pattern, "$")
+
+	parts := strings.Split(pattern, "*")
+	if !strings.HasPrefix(path, parts[0]) {
+		return false
+	}
+	path = path[len(parts[0]):]
+
+	for i, part := range parts[1:] {
+		// the last part of an anchored pattern has to match the end of the path, not just anywhere in it.
+		if anchored && i == len(parts)-2 {
+			return strings.HasSuffix(path, part)
+		}
+
+		j := strings.Index(path, part)
+		if j < 0 {
+			return false
+		}
+		path = path[j+len(part):]
+	}
+
+	return !anchored || path == ""
+}
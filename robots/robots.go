@@ -0,0 +1,126 @@
+package robots
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// maxSize is the most of a robots.txt we read, anything after it is ignored.
+const maxSize = 500 << 10
+
+// sweepInterval is how often the cache is swept of expired robots.txt files.
+const sweepInterval = time.Minute
+
+// Now is used, so we can fix the time within our tests.
+var Now = time.Now
+
+// entry is a robots.txt we have fetched, it is fetched again once it expires.
+type entry struct {
+	rules   *Rules
+	expires time.Time
+}
+
+// Checker fetches and caches the robots.txt of each site we download from.
+type Checker struct {
+	client    *http.Client
+	userAgent string
+	ttl       time.Duration
+
+	mu    sync.Mutex
+	cache map[string]entry
+	swept time.Time
+}
+
+// NewChecker returns a Checker that fetches robots.txt files with client, applies the rules for the user agent and
+// caches them for ttl.
+func NewChecker(client *http.Client, userAgent string, ttl time.Duration) *Checker {
+	return &Checker{
+		client:    client,
+		userAgent: userAgent,
+		ttl:       ttl,
+		cache:     make(map[string]entry),
+	}
+}
+
+// Rules returns the rules that apply to u, fetching the site's robots.txt if we don't have an unexpired copy. A
+// missing robots.txt allows everything. Failing to fetch it, including the server responding with a 5xx, returns an
+// error rather than guessing, and isn't cached so the next download tries again.
+func (c *Checker) Rules(ctx context.Context, u *url.URL) (*Rules, error) {
+	origin := u.Scheme + "://" + u.Host
+	now := Now()
+
+	c.mu.Lock()
+	if now.Sub(c.swept) >= sweepInterval {
+		c.sweep(now)
+	}
+	cached, ok := c.cache[origin]
+	if ok && !now.Before(cached.expires) {
+		delete(c.cache, origin)
+	}
+	c.mu.Unlock()
+	if ok && now.Before(cached.expires) {
+		return cached.rules, nil
+	}
+
+	rules, err := c.fetch(ctx, origin+"/robots.txt")
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	c.cache[origin] = entry{rules: rules, expires: Now().Add(c.ttl)}
+	c.mu.Unlock()
+
+	return rules, nil
+}
+
+// Len returns how many robots.txt files are cached.
+func (c *Checker) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return len(c.cache)
+}
+
+// sweep removes the expired robots.txt files, so sites we no longer download from don't stay cached. c.mu must be
+// held.
+func (c *Checker) sweep(now time.Time) {
+	for origin, cached := range c.cache {
+		if !now.Before(cached.expires) {
+			delete(c.cache, origin)
+		}
+	}
+	c.swept = now
+}
+
+// fetch downloads and parses the robots.txt at robotsURL.
+func (c *Checker) fetch(ctx context.Context, robotsURL string) (*Rules, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, robotsURL, http.NoBody)
+	if err != nil {
+		return nil, fmt.Errorf("unable to fetch %s: %w", robotsURL, err)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("unable to fetch %s: %w", robotsURL, err)
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode <= 299:
+		rules, err := Parse(io.LimitReader(resp.Body, maxSize), c.userAgent)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read %s: %w", robotsURL, err)
+		}
+		return rules, nil
+	case resp.StatusCode >= 400 && resp.StatusCode <= 499:
+		return AllowAll(), nil
+	default:
+		return nil, fmt.Errorf("unable to fetch %s: %s", robotsURL, resp.Status)
+	}
+}
@@ -0,0 +1,140 @@
+package robots_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pocockn/downloader/robots"
+)
+
+const robotsTXT = `
+# comments are ignored
+User-agent: *
+Disallow: /private
+Allow: /private/public
+Disallow: /*.pdf$
+Crawl-delay: 2
+
+User-agent: downloader
+User-agent: other
+Disallow: /downloader-only
+Crawl-delay: 0.5
+`
+
+func TestParse(t *testing.T) {
+	t.Run("The groups for our product token apply", func(t *testing.T) {
+		rules, err := robots.Parse(strings.NewReader(robotsTXT), "Downloader/1.0 (+https://github.com/pocockn/downloader)")
+		require.NoError(t, err)
+
+		assert.False(t, rules.Allowed("/downloader-only/file"))
+		assert.True(t, rules.Allowed("/private"))
+		assert.Equal(t, 500*time.Millisecond, rules.CrawlDelay())
+	})
+
+	t.Run("Other agents get the * groups", func(t *testing.T) {
+		rules, err := robots.Parse(strings.NewReader(robotsTXT), "crawler/2.0")
+		require.NoError(t, err)
+
+		assert.True(t, rules.Allowed("/"))
+		assert.True(t, rules.Allowed(""))
+		assert.False(t, rules.Allowed("/private/file"))
+		assert.True(t, rules.Allowed("/private/public/file"), "the longest match wins")
+		assert.False(t, rules.Allowed("/docs/file.pdf"))
+		assert.True(t, rules.Allowed("/docs/file.pdf?download=1"), "$ anchors to the end of the path")
+		assert.True(t, rules.Allowed("/downloader-only"))
+		assert.Equal(t, 2*time.Second, rules.CrawlDelay())
+	})
+
+	t.Run("An empty robots.txt allows everything", func(t *testing.T) {
+		rules, err := robots.Parse(strings.NewReader(""), "downloader")
+		require.NoError(t, err)
+		assert.True(t, rules.Allowed("/private"))
+		assert.Zero(t, rules.CrawlDelay())
+	})
+}
+
+func TestChecker(t *testing.T) {
+	defer func() { robots.Now = time.Now }()
+
+	var fetches int32
+	status := int32(http.StatusOK)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/robots.txt", r.URL.Path)
+		atomic.AddInt32(&fetches, 1)
+		w.WriteHeader(int(atomic.LoadInt32(&status)))
+		_, _ = w.Write([]byte(robotsTXT))
+	}))
+	defer server.Close()
+
+	u, err := url.Parse(server.URL + "/private/file")
+	require.NoError(t, err)
+
+	checker := robots.NewChecker(http.DefaultClient, "downloader", time.Hour)
+
+	t.Run("robots.txt is fetched and cached", func(t *testing.T) {
+		for i := 0; i < 2; i++ {
+			rules, err := checker.Rules(context.Background(), u)
+			require.NoError(t, err)
+			assert.False(t, rules.Allowed("/downloader-only"))
+		}
+		assert.Equal(t, int32(1), atomic.LoadInt32(&fetches))
+	})
+
+	t.Run("Server errors aren't cached", func(t *testing.T) {
+		robots.Now = func() time.Time { return time.Now().Add(2 * time.Hour) }
+		atomic.StoreInt32(&status, http.StatusServiceUnavailable)
+
+		_, err := checker.Rules(context.Background(), u)
+		assert.Error(t, err)
+		assert.Equal(t, int32(2), atomic.LoadInt32(&fetches))
+	})
+
+	t.Run("A missing robots.txt allows everything", func(t *testing.T) {
+		atomic.StoreInt32(&status, http.StatusNotFound)
+
+		rules, err := checker.Rules(context.Background(), u)
+		require.NoError(t, err)
+		assert.True(t, rules.Allowed("/downloader-only"))
+		assert.Equal(t, int32(3), atomic.LoadInt32(&fetches))
+	})
+}
+
+func TestChecker_Expired(t *testing.T) {
+	defer func() { robots.Now = time.Now }()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(robotsTXT))
+	}))
+	defer server.Close()
+
+	checker := robots.NewChecker(http.DefaultClient, "downloader", time.Hour)
+	start := time.Now()
+	robots.Now = func() time.Time { return start }
+
+	for _, host := range []string{"127.0.0.1", "localhost"} {
+		u, err := url.Parse(strings.Replace(server.URL, "127.0.0.1", host, 1))
+		require.NoError(t, err)
+		_, err = checker.Rules(context.Background(), u)
+		require.NoError(t, err)
+	}
+	require.Equal(t, 2, checker.Len())
+
+	t.Run("Expired robots.txt files are removed from the cache", func(t *testing.T) {
+		robots.Now = func() time.Time { return start.Add(2 * time.Hour) }
+
+		u, err := url.Parse(server.URL)
+		require.NoError(t, err)
+		_, err = checker.Rules(context.Background(), u)
+		require.NoError(t, err)
+		assert.Equal(t, 1, checker.Len())
+	})
+}
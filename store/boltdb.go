@@ -7,37 +7,109 @@ import (
 	bolt "go.etcd.io/bbolt"
 )
 
-// Bolt implements the store interface and holds a connection to the BoltDB.
+// Bolt implements the store interface and holds a connection to the BoltDB. The bucket opened by ConnectBolt is
+// indexed by created at time and submission count, buckets returned by Bucket are not.
 type Bolt struct {
-	Client *bolt.DB
-	bucket string
+	Client  *bolt.DB
+	bucket  string
+	indexed bool
 }
 
-// ConnectBolt opens a connection to Bolt and creates the bucket if it doesn't exist.
-func ConnectBolt(bucket string) (Store, error) {
-	db, err := bolt.Open("my.db", 0600, nil)
+// defaultBoltPath is the database file used when no path is configured.
+const defaultBoltPath = "my.db"
+
+// bolt converts the options into those Bolt is opened with.
+func (o Options) bolt() (*bolt.Options, error) {
+	opts := &bolt.Options{
+		Timeout:  o.Timeout,
+		NoSync:   o.NoSync,
+		ReadOnly: o.ReadOnly,
+	}
+
+	switch o.FreelistType {
+	case "", string(bolt.FreelistArrayType):
+		opts.FreelistType = bolt.FreelistArrayType
+	case string(bolt.FreelistMapType):
+		opts.FreelistType = bolt.FreelistMapType
+	default:
+		return nil, fmt.Errorf("unknown freelist type %q", o.FreelistType)
+	}
+
+	return opts, nil
+}
+
+// ConnectBolt opens a connection to Bolt and creates the bucket and its index buckets if they don't exist. In read
+// only mode they must already exist.
+func ConnectBolt(bucket string, opts Options) (Store, error) {
+	boltOpts, err := opts.bolt()
+	if err != nil {
+		return nil, err
+	}
+
+	path := opts.Path
+	if path == "" {
+		path = defaultBoltPath
+	}
+
+	db, err := bolt.Open(path, 0600, boltOpts)
 	if err != nil {
 		return nil, fmt.Errorf("unable to create new Bolt instance: %w", err)
 	}
 
-	err = db.Update(func(tx *bolt.Tx) error {
-		_, err = tx.CreateBucketIfNotExists([]byte(bucket))
-		if err != nil {
-			return err
-		}
-		return nil
-	})
+	r := &Bolt{Client: db, bucket: bucket, indexed: true}
+
+	if opts.ReadOnly {
+		err = db.View(func(tx *bolt.Tx) error {
+			for _, name := range [][]byte{[]byte(bucket), r.createdIndex(), r.submittedIndex()} {
+				if tx.Bucket(name) == nil {
+					return fmt.Errorf("bucket %s not found, open the store read-write once to create it", name)
+				}
+			}
+			return nil
+		})
+	} else {
+		err = db.Update(func(tx *bolt.Tx) error {
+			_, err = tx.CreateBucketIfNotExists([]byte(bucket))
+			if err != nil {
+				return err
+			}
+			return r.createIndexes(tx)
+		})
+	}
 	if err != nil {
+		db.Close()
 		return nil, err
 	}
 
-	return &Bolt{Client: db, bucket: bucket}, nil
+	return r, nil
 }
 
 // Set sets key value.
 func (r *Bolt) Set(key string, value []byte) error {
 	return r.Client.Update(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(r.bucket))
+		if err := r.reindex(tx, []byte(key), b.Get([]byte(key)), value); err != nil {
+			return err
+		}
+		return b.Put([]byte(key), value)
+	})
+}
+
+// Update runs fn against the current value of key and stores the result within a single Bolt transaction, so no
+// other writer can change the value in between.
+func (r *Bolt) Update(key string, fn func(old []byte) ([]byte, error)) error {
+	return r.Client.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(r.bucket))
+
+		old := b.Get([]byte(key))
+		value, err := fn(old)
+		if err != nil {
+			return err
+		}
+
+		if err := r.reindex(tx, []byte(key), old, value); err != nil {
+			return err
+		}
 		return b.Put([]byte(key), value)
 	})
 }
@@ -48,7 +120,10 @@ func (r *Bolt) Get(key string) ([]byte, error) {
 	var result []byte
 	if err := r.Client.View(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(r.bucket))
-		result = b.Get([]byte(key))
+		// values returned by Bolt are only valid for the life of the transaction.
+		if value := b.Get([]byte(key)); value != nil {
+			result = append([]byte{}, value...)
+		}
 		return nil
 	}); err != nil {
 		return nil, fmt.Errorf("unable to fetch key %s : %w", key, err)
@@ -57,6 +132,52 @@ func (r *Bolt) Get(key string) ([]byte, error) {
 	return result, nil
 }
 
+// Delete removes key and its index entries. Deleting a missing key is not an error.
+func (r *Bolt) Delete(key string) error {
+	return r.Client.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(r.bucket))
+		if err := r.reindex(tx, []byte(key), b.Get([]byte(key)), nil); err != nil {
+			return err
+		}
+		return b.Delete([]byte(key))
+	})
+}
+
+// Transaction runs fn within a single Bolt transaction, keeping the indexes up to date with every change it makes.
+func (r *Bolt) Transaction(fn func(tx Tx) error) error {
+	return r.Client.Update(func(tx *bolt.Tx) error {
+		return fn(&boltTx{store: r, tx: tx, bucket: tx.Bucket([]byte(r.bucket))})
+	})
+}
+
+// boltTx is a transaction against a single Bolt bucket.
+type boltTx struct {
+	store  *Bolt
+	tx     *bolt.Tx
+	bucket *bolt.Bucket
+}
+
+func (t *boltTx) Get(key string) ([]byte, error) {
+	if value := t.bucket.Get([]byte(key)); value != nil {
+		return append([]byte{}, value...), nil
+	}
+	return nil, nil
+}
+
+func (t *boltTx) Set(key string, value []byte) error {
+	if err := t.store.reindex(t.tx, []byte(key), t.bucket.Get([]byte(key)), value); err != nil {
+		return err
+	}
+	return t.bucket.Put([]byte(key), value)
+}
+
+func (t *boltTx) Delete(key string) error {
+	if err := t.store.reindex(t.tx, []byte(key), t.bucket.Get([]byte(key)), nil); err != nil {
+		return err
+	}
+	return t.bucket.Delete([]byte(key))
+}
+
 // GetAll will fetch all records from Bolt.
 func (r *Bolt) GetAll() ([][]byte, error) {
 	var results [][]byte
@@ -70,7 +191,7 @@ func (r *Bolt) GetAll() ([][]byte, error) {
 		c := b.Cursor()
 
 		for k, v := c.First(); k != nil; k, v = c.Next() {
-			results = append(results, v)
+			results = append(results, append([]byte{}, v...))
 		}
 
 		return nil
@@ -81,6 +202,61 @@ func (r *Bolt) GetAll() ([][]byte, error) {
 	return results, nil
 }
 
+// Each calls fn with every record in key order until fn returns false or an error, all within one read transaction.
+func (r *Bolt) Each(fn func(value []byte) (bool, error)) error {
+	return r.Client.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(r.bucket))
+		if b == nil {
+			return fmt.Errorf("bucket %s not found", r.bucket)
+		}
+
+		c := b.Cursor()
+
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			more, err := fn(append([]byte{}, v...))
+			if err != nil || !more {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// Latest returns up to n records, most recently created first.
+func (r *Bolt) Latest(n int) ([][]byte, error) {
+	return r.scanIndex(r.createdIndex(), n)
+}
+
+// TopSubmitted returns up to n records, most submitted first.
+func (r *Bolt) TopSubmitted(n int) ([][]byte, error) {
+	return r.scanIndex(r.submittedIndex(), n)
+}
+
+// Bucket returns a Store for the named bucket, creating it if it doesn't exist. In read only mode the bucket must
+// already exist. The returned Store shares this connection, so only the parent should be disconnected.
+func (r *Bolt) Bucket(name string) (Store, error) {
+	var err error
+	if r.Client.IsReadOnly() {
+		err = r.Client.View(func(tx *bolt.Tx) error {
+			if tx.Bucket([]byte(name)) == nil {
+				return fmt.Errorf("bucket %s not found", name)
+			}
+			return nil
+		})
+	} else {
+		err = r.Client.Update(func(tx *bolt.Tx) error {
+			_, err := tx.CreateBucketIfNotExists([]byte(name))
+			return err
+		})
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to create bucket %s: %w", name, err)
+	}
+
+	return &Bolt{Client: r.Client, bucket: name}, nil
+}
+
 // Disconnect will disconnect the Bolt connection.
 func (r *Bolt) Disconnect() error {
 	return r.Client.Close()
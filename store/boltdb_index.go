@@ -0,0 +1,117 @@
+package store
+
+import (
+	"encoding/binary"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Bolt keeps two index buckets alongside an indexed bucket. Their keys are a big endian ordering value followed by
+// the record key, so a cursor walking backwards from the end visits records newest or most submitted first.
+const (
+	createdIndexSuffix   = "_by_created"
+	submittedIndexSuffix = "_by_submitted"
+)
+
+func (r *Bolt) createdIndex() []byte {
+	return []byte(r.bucket + createdIndexSuffix)
+}
+
+func (r *Bolt) submittedIndex() []byte {
+	return []byte(r.bucket + submittedIndexSuffix)
+}
+
+// createIndexes creates the index buckets, populating them from the records already stored if they are new.
+func (r *Bolt) createIndexes(tx *bolt.Tx) error {
+	if tx.Bucket(r.createdIndex()) != nil && tx.Bucket(r.submittedIndex()) != nil {
+		return nil
+	}
+
+	for _, name := range [][]byte{r.createdIndex(), r.submittedIndex()} {
+		if err := tx.DeleteBucket(name); err != nil && err != bolt.ErrBucketNotFound {
+			return err
+		}
+		if _, err := tx.CreateBucket(name); err != nil {
+			return err
+		}
+	}
+
+	return tx.Bucket([]byte(r.bucket)).ForEach(func(k, v []byte) error {
+		return r.reindex(tx, k, nil, v)
+	})
+}
+
+// reindex moves the index entries for key from those of the old value to those of the new one. Either value may be
+// nil.
+func (r *Bolt) reindex(tx *bolt.Tx, key, old, new []byte) error {
+	if !r.indexed {
+		return nil
+	}
+
+	created := tx.Bucket(r.createdIndex())
+	submitted := tx.Bucket(r.submittedIndex())
+
+	if fields, ok := decodeIndexFields(old); ok {
+		if err := created.Delete(createdKey(fields, key)); err != nil {
+			return err
+		}
+		if err := submitted.Delete(submittedKey(fields, key)); err != nil {
+			return err
+		}
+	}
+
+	if fields, ok := decodeIndexFields(new); ok {
+		if err := created.Put(createdKey(fields, key), key); err != nil {
+			return err
+		}
+		if err := submitted.Put(submittedKey(fields, key), key); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// scanIndex walks the index backwards, returning the values of up to n records.
+func (r *Bolt) scanIndex(index []byte, n int) ([][]byte, error) {
+	if !r.indexed {
+		return nil, ErrNotIndexed
+	}
+
+	var results [][]byte
+	if err := r.Client.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(r.bucket))
+		c := tx.Bucket(index).Cursor()
+
+		for k, key := c.Last(); k != nil && len(results) < n; k, key = c.Prev() {
+			if v := b.Get(key); v != nil {
+				results = append(results, append([]byte{}, v...))
+			}
+		}
+
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	return results, nil
+}
+
+func createdKey(fields indexFields, key []byte) []byte {
+	return orderedKey(uint64(fields.createdNanos()), key)
+}
+
+func submittedKey(fields indexFields, key []byte) []byte {
+	submitted := fields.submitted
+	if submitted < 0 {
+		submitted = 0
+	}
+	return orderedKey(uint64(submitted), key)
+}
+
+func orderedKey(order uint64, key []byte) []byte {
+	b := make([]byte, 8+len(key))
+	binary.BigEndian.PutUint64(b, order)
+	copy(b[8:], key)
+	return b
+}
@@ -4,7 +4,10 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
+	"path/filepath"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -18,7 +21,7 @@ func TestBolt(t *testing.T) {
 	var err error
 
 	t.Run("Can connect to Bolt", func(t *testing.T) {
-		db, err = store.ConnectBolt("test")
+		db, err = store.ConnectBolt("test", store.Options{})
 		require.NoError(t, err)
 	})
 
@@ -33,12 +36,130 @@ func TestBolt(t *testing.T) {
 		assert.Equal(t, []byte("test_bytes"), result)
 	})
 
+	t.Run("Update replaces the value of a key", func(t *testing.T) {
+		require.NoError(t, db.Update("test", func(old []byte) ([]byte, error) {
+			return append(old, []byte("_updated")...), nil
+		}))
+
+		result, err := db.Get("test")
+		require.NoError(t, err)
+		assert.Equal(t, []byte("test_bytes_updated"), result)
+	})
+
+	t.Run("Update leaves the value unchanged on error", func(t *testing.T) {
+		err := db.Update("test", func(old []byte) ([]byte, error) {
+			return nil, fmt.Errorf("big error")
+		})
+		assert.Error(t, err)
+
+		result, err := db.Get("test")
+		require.NoError(t, err)
+		assert.Equal(t, []byte("test_bytes_updated"), result)
+	})
+
+	t.Run("Concurrent updates are not lost", func(t *testing.T) {
+		var wg sync.WaitGroup
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				assert.NoError(t, db.Update("counter", func(old []byte) ([]byte, error) {
+					return append(old, 'x'), nil
+				}))
+			}()
+		}
+		wg.Wait()
+
+		result, err := db.Get("counter")
+		require.NoError(t, err)
+		assert.Len(t, result, 20)
+	})
+
+	t.Run("Transaction applies all of its changes or none", func(t *testing.T) {
+		require.NoError(t, db.Set("moved", []byte("moved_bytes")))
+
+		err := db.Transaction(func(tx store.Tx) error {
+			require.NoError(t, tx.Set("target", []byte("target_bytes")))
+			require.NoError(t, tx.Delete("moved"))
+			return fmt.Errorf("big error")
+		})
+		assert.Error(t, err)
+
+		result, err := db.Get("target")
+		require.NoError(t, err)
+		assert.Nil(t, result)
+
+		require.NoError(t, db.Transaction(func(tx store.Tx) error {
+			value, err := tx.Get("moved")
+			if err != nil {
+				return err
+			}
+			if err := tx.Set("target", value); err != nil {
+				return err
+			}
+			return tx.Delete("moved")
+		}))
+
+		result, err = db.Get("moved")
+		require.NoError(t, err)
+		assert.Nil(t, result)
+
+		result, err = db.Get("target")
+		require.NoError(t, err)
+		assert.Equal(t, []byte("moved_bytes"), result)
+	})
+
+	t.Run("Delete removes the item", func(t *testing.T) {
+		require.NoError(t, db.Set("deleted", []byte("deleted_bytes")))
+		require.NoError(t, db.Delete("deleted"))
+		require.NoError(t, db.Delete("deleted"))
+
+		result, err := db.Get("deleted")
+		require.NoError(t, err)
+		assert.Nil(t, result)
+	})
+
+	t.Run("Each reads records in key order until fn is done", func(t *testing.T) {
+		bucket, err := db.Bucket("each")
+		require.NoError(t, err)
+		for _, key := range []string{"c", "a", "b"} {
+			require.NoError(t, bucket.Set(key, []byte(key)))
+		}
+
+		var seen []string
+		require.NoError(t, bucket.Each(func(value []byte) (bool, error) {
+			seen = append(seen, string(value))
+			return string(value) != "b", nil
+		}))
+		assert.Equal(t, []string{"a", "b"}, seen)
+
+		err = bucket.Each(func(value []byte) (bool, error) {
+			return true, fmt.Errorf("big error")
+		})
+		assert.Error(t, err)
+	})
+
+	t.Run("Buckets are kept separate", func(t *testing.T) {
+		bucket, err := db.Bucket("other")
+		require.NoError(t, err)
+
+		result, err := bucket.Get("test")
+		require.NoError(t, err)
+		assert.Nil(t, result)
+
+		require.NoError(t, bucket.Set("test", []byte("other_bytes")))
+
+		result, err = db.Get("test")
+		require.NoError(t, err)
+		assert.Equal(t, []byte("test_bytes_updated"), result)
+	})
+
 	assert.NoError(t, db.Disconnect())
 	assert.NoError(t, os.Remove("my.db"))
 }
 
 func TestBoltDB_GetAll(t *testing.T) {
-	db, err := store.ConnectBolt("test")
+	db, err := store.ConnectBolt("test", store.Options{})
 	require.NoError(t, err)
 
 	for i := 0; i <= 10; i++ {
@@ -55,3 +176,118 @@ func TestBoltDB_GetAll(t *testing.T) {
 	assert.NoError(t, db.Disconnect())
 	assert.NoError(t, os.Remove("my.db"))
 }
+
+func TestBoltDB_Indexes(t *testing.T) {
+	db, err := store.ConnectBolt("test", store.Options{})
+	require.NoError(t, err)
+
+	now := time.Now().UTC()
+	for i := 0; i < 5; i++ {
+		url := models.URL{
+			URL:       fmt.Sprintf("www.example.com%d", i),
+			Submitted: 5 - i,
+			CreatedAt: now.Add(time.Duration(i) * time.Minute),
+		}
+		urlBytes, err := json.Marshal(url)
+		require.NoError(t, err)
+		require.NoError(t, db.Set(url.URL, urlBytes))
+	}
+
+	t.Run("Latest returns the most recently created records first", func(t *testing.T) {
+		results, err := db.Latest(2)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"www.example.com4", "www.example.com3"}, decodeKeys(t, results))
+	})
+
+	t.Run("TopSubmitted returns the most submitted records first", func(t *testing.T) {
+		results, err := db.TopSubmitted(2)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"www.example.com0", "www.example.com1"}, decodeKeys(t, results))
+	})
+
+	t.Run("Indexes follow updates", func(t *testing.T) {
+		require.NoError(t, db.Update("www.example.com4", func(old []byte) ([]byte, error) {
+			var url models.URL
+			require.NoError(t, json.Unmarshal(old, &url))
+			url.Submitted = 10
+			return json.Marshal(url)
+		}))
+
+		results, err := db.TopSubmitted(10)
+		require.NoError(t, err)
+		assert.Equal(
+			t,
+			[]string{"www.example.com4", "www.example.com0", "www.example.com1", "www.example.com2", "www.example.com3"},
+			decodeKeys(t, results),
+		)
+	})
+
+	t.Run("Deleted records are removed from the indexes", func(t *testing.T) {
+		require.NoError(t, db.Delete("www.example.com4"))
+
+		results, err := db.Latest(1)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"www.example.com3"}, decodeKeys(t, results))
+	})
+
+	t.Run("Buckets are not indexed", func(t *testing.T) {
+		bucket, err := db.Bucket("other")
+		require.NoError(t, err)
+
+		_, err = bucket.Latest(10)
+		assert.ErrorIs(t, err, store.ErrNotIndexed)
+	})
+
+	assert.NoError(t, db.Disconnect())
+	assert.NoError(t, os.Remove("my.db"))
+}
+
+func decodeKeys(t *testing.T, results [][]byte) []string {
+	var keys []string
+	for _, result := range results {
+		var url models.URL
+		require.NoError(t, json.Unmarshal(result, &url))
+		keys = append(keys, url.URL)
+	}
+
+	return keys
+}
+
+func TestBoltDB_Options(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "downloader.db")
+
+	db, err := store.ConnectBolt("test", store.Options{Path: path, FreelistType: "hashmap"})
+	require.NoError(t, err)
+	require.NoError(t, db.Set("test", []byte("test_bytes")))
+
+	t.Run("Database is created at the configured path", func(t *testing.T) {
+		assert.FileExists(t, path)
+	})
+
+	t.Run("Open gives up waiting for the file lock after the timeout", func(t *testing.T) {
+		_, err := store.ConnectBolt("test", store.Options{Path: path, Timeout: 100 * time.Millisecond})
+		assert.Error(t, err)
+	})
+
+	t.Run("Unknown freelist types are rejected", func(t *testing.T) {
+		_, err := store.ConnectBolt("test", store.Options{Path: path, FreelistType: "tree"})
+		assert.Error(t, err)
+	})
+
+	require.NoError(t, db.Disconnect())
+
+	t.Run("Read only stores can read but not write", func(t *testing.T) {
+		readOnly, err := store.ConnectBolt("test", store.Options{Path: path, ReadOnly: true})
+		require.NoError(t, err)
+		defer readOnly.Disconnect()
+
+		result, err := readOnly.Get("test")
+		require.NoError(t, err)
+		assert.Equal(t, []byte("test_bytes"), result)
+
+		assert.Error(t, readOnly.Set("test", []byte("other_bytes")))
+
+		_, err = readOnly.Bucket("missing")
+		assert.Error(t, err)
+	})
+}
@@ -0,0 +1,42 @@
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/pocockn/downloader/models"
+)
+
+// ErrNotIndexed is returned when an ordered query is made against a store that doesn't maintain indexes.
+var ErrNotIndexed = errors.New("store is not indexed")
+
+// indexFields holds the fields of a record that the stores order by.
+type indexFields struct {
+	createdAt time.Time
+	submitted int
+}
+
+// decodeIndexFields extracts the fields we index on from a URL record. Values that aren't URL records aren't
+// indexed, in which case ok is false.
+func decodeIndexFields(value []byte) (fields indexFields, ok bool) {
+	if value == nil {
+		return indexFields{}, false
+	}
+
+	var url models.URL
+	if err := json.Unmarshal(value, &url); err != nil {
+		return indexFields{}, false
+	}
+
+	return indexFields{createdAt: url.CreatedAt, submitted: url.Submitted}, true
+}
+
+// createdNanos returns the created at time as unix nanoseconds, with times before the epoch ordered as the epoch.
+func (f indexFields) createdNanos() int64 {
+	nanos := f.createdAt.UnixNano()
+	if nanos < 0 || f.createdAt.IsZero() {
+		return 0
+	}
+	return nanos
+}
@@ -0,0 +1,261 @@
+package store
+
+import (
+	"sort"
+	"sync"
+)
+
+// Memory implements the store interface in memory. It orders records the same way Bolt does, so it can stand in for
+// Bolt in ephemeral deployments and tests. Nothing is persisted once the process exits.
+type Memory struct {
+	mu      sync.RWMutex
+	records map[string][]byte
+	indexed bool
+	buckets *memoryBuckets
+}
+
+// memoryBuckets is shared by a Memory store and all of its buckets, so asking for a bucket twice returns the same
+// records.
+type memoryBuckets struct {
+	mu     sync.Mutex
+	byName map[string]*Memory
+}
+
+// NewMemory returns an empty, indexed in memory store.
+func NewMemory() *Memory {
+	return &Memory{
+		records: make(map[string][]byte),
+		indexed: true,
+		buckets: &memoryBuckets{byName: make(map[string]*Memory)},
+	}
+}
+
+// Set sets key value.
+func (m *Memory) Set(key string, value []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.records[key] = append([]byte{}, value...)
+	return nil
+}
+
+// Update runs fn against the current value of key and stores the result while holding the write lock.
+func (m *Memory) Update(key string, fn func(old []byte) ([]byte, error)) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var old []byte
+	if value, ok := m.records[key]; ok {
+		old = append([]byte{}, value...)
+	}
+
+	value, err := fn(old)
+	if err != nil {
+		return err
+	}
+
+	m.records[key] = append([]byte{}, value...)
+	return nil
+}
+
+// Get gets a value from memory.
+func (m *Memory) Get(key string) ([]byte, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	value, ok := m.records[key]
+	if !ok {
+		return nil, nil
+	}
+
+	return append([]byte{}, value...), nil
+}
+
+// Delete removes key. Deleting a missing key is not an error.
+func (m *Memory) Delete(key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.records, key)
+	return nil
+}
+
+// Transaction runs fn while holding the write lock. Its changes are staged and only applied once fn returns without
+// an error.
+func (m *Memory) Transaction(fn func(tx Tx) error) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	tx := &memoryTx{store: m, staged: make(map[string][]byte)}
+	if err := fn(tx); err != nil {
+		return err
+	}
+
+	for key, value := range tx.staged {
+		if value == nil {
+			delete(m.records, key)
+			continue
+		}
+		m.records[key] = value
+	}
+
+	return nil
+}
+
+// memoryTx stages the changes made within a transaction, a nil value marks a deleted key.
+type memoryTx struct {
+	store  *Memory
+	staged map[string][]byte
+}
+
+func (t *memoryTx) Get(key string) ([]byte, error) {
+	value, ok := t.staged[key]
+	if !ok {
+		value, ok = t.store.records[key]
+	}
+	if !ok || value == nil {
+		return nil, nil
+	}
+
+	return append([]byte{}, value...), nil
+}
+
+func (t *memoryTx) Set(key string, value []byte) error {
+	t.staged[key] = append([]byte{}, value...)
+	return nil
+}
+
+func (t *memoryTx) Delete(key string) error {
+	t.staged[key] = nil
+	return nil
+}
+
+// GetAll will fetch all records in key order.
+func (m *Memory) GetAll() ([][]byte, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	keys := make([]string, 0, len(m.records))
+	for key := range m.records {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	results := make([][]byte, 0, len(keys))
+	for _, key := range keys {
+		results = append(results, append([]byte{}, m.records[key]...))
+	}
+
+	return results, nil
+}
+
+// Each calls fn with every record in key order until fn returns false or an error. Records changed while fn runs are
+// seen as they are when fn reaches them.
+func (m *Memory) Each(fn func(value []byte) (bool, error)) error {
+	m.mu.RLock()
+	keys := make([]string, 0, len(m.records))
+	for key := range m.records {
+		keys = append(keys, key)
+	}
+	m.mu.RUnlock()
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		m.mu.RLock()
+		value, ok := m.records[key]
+		value = append([]byte{}, value...)
+		m.mu.RUnlock()
+		if !ok {
+			continue
+		}
+
+		more, err := fn(value)
+		if err != nil || !more {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Latest returns up to n records, most recently created first.
+func (m *Memory) Latest(n int) ([][]byte, error) {
+	return m.ordered(n, func(a, b indexFields) int {
+		return compareInt64(a.createdNanos(), b.createdNanos())
+	})
+}
+
+// TopSubmitted returns up to n records, most submitted first.
+func (m *Memory) TopSubmitted(n int) ([][]byte, error) {
+	return m.ordered(n, func(a, b indexFields) int {
+		return compareInt64(int64(a.submitted), int64(b.submitted))
+	})
+}
+
+// Bucket returns a Store for the named bucket, creating it if it doesn't exist.
+func (m *Memory) Bucket(name string) (Store, error) {
+	m.buckets.mu.Lock()
+	defer m.buckets.mu.Unlock()
+
+	bucket, ok := m.buckets.byName[name]
+	if !ok {
+		bucket = &Memory{records: make(map[string][]byte), buckets: m.buckets}
+		m.buckets.byName[name] = bucket
+	}
+
+	return bucket, nil
+}
+
+// Disconnect is a no-op, the records live as long as the store.
+func (m *Memory) Disconnect() error {
+	return nil
+}
+
+// ordered returns up to n URL records sorted in descending order by compare, ties are broken by descending key to
+// match the order Bolt walks its indexes in.
+func (m *Memory) ordered(n int, compare func(a, b indexFields) int) ([][]byte, error) {
+	if !m.indexed {
+		return nil, ErrNotIndexed
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	type entry struct {
+		key    string
+		fields indexFields
+		value  []byte
+	}
+
+	var entries []entry
+	for key, value := range m.records {
+		if fields, ok := decodeIndexFields(value); ok {
+			entries = append(entries, entry{key: key, fields: fields, value: value})
+		}
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		if c := compare(entries[i].fields, entries[j].fields); c != 0 {
+			return c > 0
+		}
+		return entries[i].key > entries[j].key
+	})
+
+	var results [][]byte
+	for i := 0; i < len(entries) && i < n; i++ {
+		results = append(results, append([]byte{}, entries[i].value...))
+	}
+
+	return results, nil
+}
+
+func compareInt64(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	default:
+		return 0
+	}
+}
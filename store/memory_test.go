@@ -0,0 +1,182 @@
+package store_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pocockn/downloader/models"
+	"github.com/pocockn/downloader/store"
+)
+
+func TestMemory(t *testing.T) {
+	db, err := store.Open(store.DriverMemory, "test", store.Options{})
+	require.NoError(t, err)
+
+	t.Run("Set and get item", func(t *testing.T) {
+		require.NoError(t, db.Set("test", []byte("test_bytes")))
+
+		result, err := db.Get("test")
+		require.NoError(t, err)
+		assert.Equal(t, []byte("test_bytes"), result)
+
+		result, err = db.Get("missing")
+		require.NoError(t, err)
+		assert.Nil(t, result)
+	})
+
+	t.Run("Update leaves the value unchanged on error", func(t *testing.T) {
+		err := db.Update("test", func(old []byte) ([]byte, error) {
+			return nil, fmt.Errorf("big error")
+		})
+		assert.Error(t, err)
+
+		result, err := db.Get("test")
+		require.NoError(t, err)
+		assert.Equal(t, []byte("test_bytes"), result)
+	})
+
+	t.Run("Concurrent updates are not lost", func(t *testing.T) {
+		var wg sync.WaitGroup
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				assert.NoError(t, db.Update("counter", func(old []byte) ([]byte, error) {
+					return append(old, 'x'), nil
+				}))
+			}()
+		}
+		wg.Wait()
+
+		result, err := db.Get("counter")
+		require.NoError(t, err)
+		assert.Len(t, result, 20)
+	})
+
+	t.Run("Transaction applies all of its changes or none", func(t *testing.T) {
+		require.NoError(t, db.Set("moved", []byte("moved_bytes")))
+
+		err := db.Transaction(func(tx store.Tx) error {
+			require.NoError(t, tx.Set("target", []byte("target_bytes")))
+			require.NoError(t, tx.Delete("moved"))
+			return fmt.Errorf("big error")
+		})
+		assert.Error(t, err)
+
+		result, err := db.Get("target")
+		require.NoError(t, err)
+		assert.Nil(t, result)
+
+		require.NoError(t, db.Transaction(func(tx store.Tx) error {
+			value, err := tx.Get("moved")
+			if err != nil {
+				return err
+			}
+			if err := tx.Set("target", value); err != nil {
+				return err
+			}
+			return tx.Delete("moved")
+		}))
+
+		result, err = db.Get("moved")
+		require.NoError(t, err)
+		assert.Nil(t, result)
+
+		result, err = db.Get("target")
+		require.NoError(t, err)
+		assert.Equal(t, []byte("moved_bytes"), result)
+	})
+
+	t.Run("Delete removes the item", func(t *testing.T) {
+		require.NoError(t, db.Set("deleted", []byte("deleted_bytes")))
+		require.NoError(t, db.Delete("deleted"))
+		require.NoError(t, db.Delete("deleted"))
+
+		result, err := db.Get("deleted")
+		require.NoError(t, err)
+		assert.Nil(t, result)
+	})
+
+	t.Run("Each reads records in key order until fn is done", func(t *testing.T) {
+		bucket, err := db.Bucket("each")
+		require.NoError(t, err)
+		for _, key := range []string{"c", "a", "b"} {
+			require.NoError(t, bucket.Set(key, []byte(key)))
+		}
+
+		var seen []string
+		require.NoError(t, bucket.Each(func(value []byte) (bool, error) {
+			seen = append(seen, string(value))
+			return string(value) != "b", nil
+		}))
+		assert.Equal(t, []string{"a", "b"}, seen)
+
+		err = bucket.Each(func(value []byte) (bool, error) {
+			return true, fmt.Errorf("big error")
+		})
+		assert.Error(t, err)
+	})
+
+	t.Run("Buckets are kept separate and reused", func(t *testing.T) {
+		bucket, err := db.Bucket("other")
+		require.NoError(t, err)
+		require.NoError(t, bucket.Set("test", []byte("other_bytes")))
+
+		result, err := db.Get("test")
+		require.NoError(t, err)
+		assert.Equal(t, []byte("test_bytes"), result)
+
+		again, err := db.Bucket("other")
+		require.NoError(t, err)
+		result, err = again.Get("test")
+		require.NoError(t, err)
+		assert.Equal(t, []byte("other_bytes"), result)
+
+		_, err = bucket.Latest(10)
+		assert.ErrorIs(t, err, store.ErrNotIndexed)
+	})
+}
+
+func TestMemory_Queries(t *testing.T) {
+	db := store.NewMemory()
+
+	now := time.Now().UTC()
+	for i := 0; i < 5; i++ {
+		url := models.URL{
+			URL:       fmt.Sprintf("www.example.com%d", i),
+			Submitted: 5 - i,
+			CreatedAt: now.Add(time.Duration(i) * time.Minute),
+		}
+		urlBytes, err := json.Marshal(url)
+		require.NoError(t, err)
+		require.NoError(t, db.Set(url.URL, urlBytes))
+	}
+
+	t.Run("GetAll returns records in key order", func(t *testing.T) {
+		results, err := db.GetAll()
+		require.NoError(t, err)
+		assert.Equal(
+			t,
+			[]string{"www.example.com0", "www.example.com1", "www.example.com2", "www.example.com3", "www.example.com4"},
+			decodeKeys(t, results),
+		)
+	})
+
+	t.Run("Latest returns the most recently created records first", func(t *testing.T) {
+		results, err := db.Latest(2)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"www.example.com4", "www.example.com3"}, decodeKeys(t, results))
+	})
+
+	t.Run("TopSubmitted returns the most submitted records first", func(t *testing.T) {
+		results, err := db.TopSubmitted(2)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"www.example.com0", "www.example.com1"}, decodeKeys(t, results))
+	})
+}
@@ -0,0 +1,303 @@
+package store
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+
+	// registers the pure Go sqlite driver with database/sql.
+	_ "modernc.org/sqlite"
+)
+
+// defaultSQLitePath is the database file used when no path is configured.
+const defaultSQLitePath = "my.sqlite"
+
+// SQLite implements the store interface on top of an embedded SQLite database. Each bucket is a table holding the
+// raw record alongside the submitted and created_at columns extracted from it, which the table opened by
+// ConnectSQLite indexes for its ordered queries.
+type SQLite struct {
+	Client  *sql.DB
+	table   string
+	indexed bool
+}
+
+// ConnectSQLite opens the SQLite database and creates the table and its indexes if they don't exist. NoSync and
+// FreelistType only apply to Bolt and are ignored.
+func ConnectSQLite(table string, opts Options) (Store, error) {
+	db, err := sql.Open("sqlite", opts.sqliteDSN())
+	if err != nil {
+		return nil, fmt.Errorf("unable to create new SQLite instance: %w", err)
+	}
+
+	// SQLite only allows a single writer, so serialise access through one connection rather than retrying on
+	// SQLITE_BUSY.
+	db.SetMaxOpenConns(1)
+
+	r := &SQLite{Client: db, table: table, indexed: true}
+	if err := r.createTable(); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// sqliteDSN builds the data source name for the options. The lock timeout maps onto SQLite's busy timeout.
+func (o Options) sqliteDSN() string {
+	path := o.Path
+	if path == "" {
+		path = defaultSQLitePath
+	}
+
+	params := url.Values{}
+	if o.Timeout > 0 {
+		params.Add("_pragma", fmt.Sprintf("busy_timeout(%d)", o.Timeout.Milliseconds()))
+	}
+	if o.ReadOnly {
+		params.Add("mode", "ro")
+	}
+
+	if len(params) == 0 {
+		return path
+	}
+
+	return fmt.Sprintf("file:%s?%s", path, params.Encode())
+}
+
+func (r *SQLite) createTable() error {
+	statements := []string{
+		fmt.Sprintf(
+			`CREATE TABLE IF NOT EXISTS %q (key TEXT PRIMARY KEY, value BLOB NOT NULL, submitted INTEGER, created_at INTEGER)`,
+			r.table,
+		),
+	}
+
+	if r.indexed {
+		statements = append(
+			statements,
+			fmt.Sprintf(`CREATE INDEX IF NOT EXISTS %q ON %q (submitted, key)`, r.table+submittedIndexSuffix, r.table),
+			fmt.Sprintf(`CREATE INDEX IF NOT EXISTS %q ON %q (created_at, key)`, r.table+createdIndexSuffix, r.table),
+		)
+	}
+
+	for _, statement := range statements {
+		if _, err := r.Client.Exec(statement); err != nil {
+			return fmt.Errorf("unable to create table %s: %w", r.table, err)
+		}
+	}
+
+	return nil
+}
+
+// Set sets key value.
+func (r *SQLite) Set(key string, value []byte) error {
+	return r.put(r.Client, key, value)
+}
+
+// Update runs fn against the current value of key and stores the result within a single transaction.
+func (r *SQLite) Update(key string, fn func(old []byte) ([]byte, error)) error {
+	tx, err := r.Client.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	old, err := r.get(tx, key)
+	if err != nil {
+		return err
+	}
+
+	value, err := fn(old)
+	if err != nil {
+		return err
+	}
+
+	if err := r.put(tx, key, value); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Get gets a value from SQLite.
+func (r *SQLite) Get(key string) ([]byte, error) {
+	result, err := r.get(r.Client, key)
+	if err != nil {
+		return nil, fmt.Errorf("unable to fetch key %s : %w", key, err)
+	}
+
+	return result, nil
+}
+
+// Delete removes key. Deleting a missing key is not an error.
+func (r *SQLite) Delete(key string) error {
+	return r.delete(r.Client, key)
+}
+
+// Transaction runs fn within a single SQLite transaction.
+func (r *SQLite) Transaction(fn func(tx Tx) error) error {
+	tx, err := r.Client.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := fn(&sqliteTx{store: r, tx: tx}); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// sqliteTx is a transaction against a single SQLite table.
+type sqliteTx struct {
+	store *SQLite
+	tx    *sql.Tx
+}
+
+func (t *sqliteTx) Get(key string) ([]byte, error) {
+	return t.store.get(t.tx, key)
+}
+
+func (t *sqliteTx) Set(key string, value []byte) error {
+	return t.store.put(t.tx, key, value)
+}
+
+func (t *sqliteTx) Delete(key string) error {
+	return t.store.delete(t.tx, key)
+}
+
+// GetAll will fetch all records from SQLite in key order.
+func (r *SQLite) GetAll() ([][]byte, error) {
+	return r.query(fmt.Sprintf(`SELECT value FROM %q ORDER BY key`, r.table))
+}
+
+// Each calls fn with every record in key order until fn returns false or an error. The rows are read as fn asks for
+// them, so the query is left once fn is done.
+func (r *SQLite) Each(fn func(value []byte) (bool, error)) error {
+	rows, err := r.Client.Query(fmt.Sprintf(`SELECT value FROM %q ORDER BY key`, r.table))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var value []byte
+		if err := rows.Scan(&value); err != nil {
+			return err
+		}
+
+		more, err := fn(value)
+		if err != nil || !more {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+// Latest returns up to n records, most recently created first.
+func (r *SQLite) Latest(n int) ([][]byte, error) {
+	if !r.indexed {
+		return nil, ErrNotIndexed
+	}
+
+	return r.query(
+		fmt.Sprintf(`SELECT value FROM %q WHERE created_at IS NOT NULL ORDER BY created_at DESC, key DESC LIMIT ?`, r.table),
+		n,
+	)
+}
+
+// TopSubmitted returns up to n records, most submitted first.
+func (r *SQLite) TopSubmitted(n int) ([][]byte, error) {
+	if !r.indexed {
+		return nil, ErrNotIndexed
+	}
+
+	return r.query(
+		fmt.Sprintf(`SELECT value FROM %q WHERE submitted IS NOT NULL ORDER BY submitted DESC, key DESC LIMIT ?`, r.table),
+		n,
+	)
+}
+
+// Bucket returns a Store for the named table, creating it if it doesn't exist. The returned Store shares this
+// connection, so only the parent should be disconnected.
+func (r *SQLite) Bucket(name string) (Store, error) {
+	bucket := &SQLite{Client: r.Client, table: name}
+	if err := bucket.createTable(); err != nil {
+		return nil, err
+	}
+
+	return bucket, nil
+}
+
+// Disconnect will disconnect the SQLite connection.
+func (r *SQLite) Disconnect() error {
+	return r.Client.Close()
+}
+
+// execer is satisfied by both *sql.DB and *sql.Tx.
+type execer interface {
+	Exec(query string, args ...any) (sql.Result, error)
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+func (r *SQLite) get(db execer, key string) ([]byte, error) {
+	var value []byte
+	err := db.QueryRow(fmt.Sprintf(`SELECT value FROM %q WHERE key = ?`, r.table), key).Scan(&value)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+
+	return value, err
+}
+
+func (r *SQLite) put(db execer, key string, value []byte) error {
+	var submitted, createdAt sql.NullInt64
+	if fields, ok := decodeIndexFields(value); ok && r.indexed {
+		submitted = sql.NullInt64{Int64: int64(fields.submitted), Valid: true}
+		createdAt = sql.NullInt64{Int64: fields.createdNanos(), Valid: true}
+	}
+
+	_, err := db.Exec(
+		fmt.Sprintf(
+			`INSERT INTO %q (key, value, submitted, created_at) VALUES (?, ?, ?, ?)
+			ON CONFLICT (key) DO UPDATE SET value = excluded.value, submitted = excluded.submitted, created_at = excluded.created_at`,
+			r.table,
+		),
+		key, value, submitted, createdAt,
+	)
+	if err != nil {
+		return fmt.Errorf("unable to set key %s : %w", key, err)
+	}
+
+	return nil
+}
+
+func (r *SQLite) delete(db execer, key string) error {
+	if _, err := db.Exec(fmt.Sprintf(`DELETE FROM %q WHERE key = ?`, r.table), key); err != nil {
+		return fmt.Errorf("unable to delete key %s : %w", key, err)
+	}
+
+	return nil
+}
+
+func (r *SQLite) query(query string, args ...any) ([][]byte, error) {
+	rows, err := r.Client.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var results [][]byte
+	for rows.Next() {
+		var value []byte
+		if err := rows.Scan(&value); err != nil {
+			return nil, err
+		}
+		results = append(results, value)
+	}
+
+	return results, rows.Err()
+}
@@ -0,0 +1,198 @@
+package store_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pocockn/downloader/models"
+	"github.com/pocockn/downloader/store"
+)
+
+func TestSQLite(t *testing.T) {
+	db, err := store.Open(store.DriverSQLite, "test", store.Options{})
+	require.NoError(t, err)
+
+	t.Run("Set item within database", func(t *testing.T) {
+		assert.NoError(t, db.Set("test", []byte("test_bytes")))
+	})
+
+	t.Run("Get item within database", func(t *testing.T) {
+		result, err := db.Get("test")
+		require.NoError(t, err)
+		assert.Equal(t, []byte("test_bytes"), result)
+
+		result, err = db.Get("missing")
+		require.NoError(t, err)
+		assert.Nil(t, result)
+	})
+
+	t.Run("Update replaces the value of a key", func(t *testing.T) {
+		require.NoError(t, db.Update("test", func(old []byte) ([]byte, error) {
+			return append(old, []byte("_updated")...), nil
+		}))
+
+		result, err := db.Get("test")
+		require.NoError(t, err)
+		assert.Equal(t, []byte("test_bytes_updated"), result)
+	})
+
+	t.Run("Update leaves the value unchanged on error", func(t *testing.T) {
+		err := db.Update("test", func(old []byte) ([]byte, error) {
+			return nil, fmt.Errorf("big error")
+		})
+		assert.Error(t, err)
+
+		result, err := db.Get("test")
+		require.NoError(t, err)
+		assert.Equal(t, []byte("test_bytes_updated"), result)
+	})
+
+	t.Run("Transaction applies all of its changes or none", func(t *testing.T) {
+		require.NoError(t, db.Set("moved", []byte("moved_bytes")))
+
+		err := db.Transaction(func(tx store.Tx) error {
+			require.NoError(t, tx.Set("target", []byte("target_bytes")))
+			require.NoError(t, tx.Delete("moved"))
+			return fmt.Errorf("big error")
+		})
+		assert.Error(t, err)
+
+		result, err := db.Get("target")
+		require.NoError(t, err)
+		assert.Nil(t, result)
+
+		require.NoError(t, db.Transaction(func(tx store.Tx) error {
+			value, err := tx.Get("moved")
+			if err != nil {
+				return err
+			}
+			if err := tx.Set("target", value); err != nil {
+				return err
+			}
+			return tx.Delete("moved")
+		}))
+
+		result, err = db.Get("moved")
+		require.NoError(t, err)
+		assert.Nil(t, result)
+
+		result, err = db.Get("target")
+		require.NoError(t, err)
+		assert.Equal(t, []byte("moved_bytes"), result)
+	})
+
+	t.Run("Delete removes the item", func(t *testing.T) {
+		require.NoError(t, db.Set("deleted", []byte("deleted_bytes")))
+		require.NoError(t, db.Delete("deleted"))
+		require.NoError(t, db.Delete("deleted"))
+
+		result, err := db.Get("deleted")
+		require.NoError(t, err)
+		assert.Nil(t, result)
+	})
+
+	t.Run("Each reads records in key order until fn is done", func(t *testing.T) {
+		bucket, err := db.Bucket("each")
+		require.NoError(t, err)
+		for _, key := range []string{"c", "a", "b"} {
+			require.NoError(t, bucket.Set(key, []byte(key)))
+		}
+
+		var seen []string
+		require.NoError(t, bucket.Each(func(value []byte) (bool, error) {
+			seen = append(seen, string(value))
+			return string(value) != "b", nil
+		}))
+		assert.Equal(t, []string{"a", "b"}, seen)
+
+		err = bucket.Each(func(value []byte) (bool, error) {
+			return true, fmt.Errorf("big error")
+		})
+		assert.Error(t, err)
+	})
+
+	t.Run("Buckets are kept separate", func(t *testing.T) {
+		bucket, err := db.Bucket("other")
+		require.NoError(t, err)
+
+		require.NoError(t, bucket.Set("test", []byte("other_bytes")))
+
+		result, err := db.Get("test")
+		require.NoError(t, err)
+		assert.Equal(t, []byte("test_bytes_updated"), result)
+
+		_, err = bucket.TopSubmitted(10)
+		assert.ErrorIs(t, err, store.ErrNotIndexed)
+	})
+
+	assert.NoError(t, db.Disconnect())
+	assert.NoError(t, os.Remove("my.sqlite"))
+}
+
+func TestSQLite_Queries(t *testing.T) {
+	db, err := store.Open(store.DriverSQLite, "test", store.Options{})
+	require.NoError(t, err)
+
+	now := time.Now().UTC()
+	for i := 0; i < 5; i++ {
+		url := models.URL{
+			URL:       fmt.Sprintf("www.example.com%d", i),
+			Submitted: 5 - i,
+			CreatedAt: now.Add(time.Duration(i) * time.Minute),
+		}
+		urlBytes, err := json.Marshal(url)
+		require.NoError(t, err)
+		require.NoError(t, db.Set(url.URL, urlBytes))
+	}
+
+	t.Run("GetAll returns every record", func(t *testing.T) {
+		results, err := db.GetAll()
+		require.NoError(t, err)
+		assert.Len(t, results, 5)
+	})
+
+	t.Run("Latest returns the most recently created records first", func(t *testing.T) {
+		results, err := db.Latest(2)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"www.example.com4", "www.example.com3"}, decodeKeys(t, results))
+	})
+
+	t.Run("TopSubmitted returns the most submitted records first", func(t *testing.T) {
+		results, err := db.TopSubmitted(2)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"www.example.com0", "www.example.com1"}, decodeKeys(t, results))
+	})
+
+	assert.NoError(t, db.Disconnect())
+	assert.NoError(t, os.Remove("my.sqlite"))
+}
+
+func TestSQLite_Options(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "downloader.sqlite")
+
+	db, err := store.ConnectSQLite("test", store.Options{Path: path, Timeout: time.Second})
+	require.NoError(t, err)
+	require.NoError(t, db.Set("test", []byte("test_bytes")))
+	require.NoError(t, db.Disconnect())
+
+	assert.FileExists(t, path)
+
+	t.Run("Read only stores can read but not write", func(t *testing.T) {
+		readOnly, err := store.ConnectSQLite("test", store.Options{Path: path, ReadOnly: true})
+		require.NoError(t, err)
+		defer readOnly.Disconnect()
+
+		result, err := readOnly.Get("test")
+		require.NoError(t, err)
+		assert.Equal(t, []byte("test_bytes"), result)
+
+		assert.Error(t, readOnly.Set("test", []byte("other_bytes")))
+	})
+}
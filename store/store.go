@@ -1,9 +1,74 @@
 package store
 
+import (
+	"fmt"
+	"time"
+)
+
+// Drivers that Open can connect to.
+const (
+	DriverBolt   = "bolt"
+	DriverSQLite = "sqlite"
+	DriverMemory = "memory"
+)
+
 // Store handles fetching and storing data.
 type Store interface {
 	Set(key string, value []byte) error
+	// Update atomically replaces the value of key with the value returned by fn. fn is passed the current value, or
+	// nil if the key doesn't exist. If fn returns an error the value is left unchanged and the error is returned.
+	Update(key string, fn func(old []byte) ([]byte, error)) error
 	Get(key string) ([]byte, error)
+	Delete(key string) error
+	// Transaction runs fn within a single read-write transaction. Either every change fn makes is stored or, if fn
+	// returns an error, none of them are and the error is returned.
+	Transaction(fn func(tx Tx) error) error
 	GetAll() ([][]byte, error)
+	// Each calls fn with every record in key order until fn returns false or an error, which is returned. Unlike
+	// GetAll it stops reading once fn is done, so it suits scans that usually stop early. fn must not use the store.
+	Each(fn func(value []byte) (bool, error)) error
+	// Latest returns up to n URL records, most recently created first.
+	Latest(n int) ([][]byte, error)
+	// TopSubmitted returns up to n URL records, most submitted first.
+	TopSubmitted(n int) ([][]byte, error)
+	Bucket(name string) (Store, error)
 	Disconnect() error
 }
+
+// Tx reads and writes the records of a store within a transaction started by Store.Transaction. It is only valid
+// until fn returns.
+type Tx interface {
+	Get(key string) ([]byte, error)
+	Set(key string, value []byte) error
+	// Delete removes key. Deleting a missing key is not an error.
+	Delete(key string) error
+}
+
+// Options configures how a store is opened.
+type Options struct {
+	// Path is the database file, it defaults to my.db for Bolt and my.sqlite for SQLite.
+	Path string
+	// Timeout is how long to wait for the lock on the database file before giving up. Zero waits forever.
+	Timeout time.Duration
+	// NoSync skips fsync after each commit. It is faster but a crash can lose or corrupt recent writes. Bolt only.
+	NoSync bool
+	// FreelistType is the Bolt freelist backend, either "array" or "hashmap". Bolt only.
+	FreelistType string
+	// ReadOnly opens the database without write access, so several processes can share it.
+	ReadOnly bool
+}
+
+// Open connects to the store for the driver passed in and creates table if it doesn't exist. An empty driver
+// defaults to Bolt.
+func Open(driver, table string, opts Options) (Store, error) {
+	switch driver {
+	case "", DriverBolt:
+		return ConnectBolt(table, opts)
+	case DriverSQLite:
+		return ConnectSQLite(table, opts)
+	case DriverMemory:
+		return NewMemory(), nil
+	default:
+		return nil, fmt.Errorf("unknown store driver %q", driver)
+	}
+}
@@ -0,0 +1,184 @@
+package urls
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/pocockn/downloader/content"
+	"github.com/pocockn/downloader/models"
+	"github.com/pocockn/downloader/queue"
+	"github.com/pocockn/downloader/store"
+	"github.com/pocockn/downloader/versions"
+)
+
+// Migrate moves the URL records in s, stored before submissions were normalised, under their canonical keys. Records
+// whose URLs normalise to the same key are merged into one. The merged record describes the most recently refreshed
+// body, keeps the earliest CreatedAt and sums the Submitted counts, and the version histories are merged along with
+// the records. Records whose URL can't be normalised are left as they are. The URLs of jobs still waiting in q are
+// normalised too, so they don't recreate the old keys once they are downloaded. It returns how many records were
+// merged into another, and is meant to be run while nothing else is writing to the store. Each group of records is
+// merged in a single transaction, so a run that stops partway can be run again without counting anything twice.
+func Migrate(
+	s store.Store,
+	n *Normalizer,
+	blobs *content.Storage,
+	history *versions.History,
+	q *queue.Queue,
+) (int, error) {
+	records, err := s.GetAll()
+	if err != nil {
+		return 0, fmt.Errorf("unable to fetch urls: %w", err)
+	}
+
+	groups := make(map[string][]models.URL)
+	for _, bytes := range records {
+		// nested buckets show up without a value.
+		if bytes == nil {
+			continue
+		}
+
+		var url models.URL
+		if err := json.Unmarshal(bytes, &url); err != nil {
+			return 0, fmt.Errorf("unable to unmarshal bytes into URL: %w", err)
+		}
+
+		key, err := n.Normalize(url.URL)
+		if err != nil {
+			fmt.Printf("leaving %s as it is : %+v \n", url.URL, err)
+			continue
+		}
+		groups[key] = append(groups[key], url)
+	}
+
+	var merged int
+	for key, group := range groups {
+		if len(group) == 1 && group[0].URL == key {
+			continue
+		}
+
+		if err := migrate(s, blobs, history, key, group); err != nil {
+			return merged, err
+		}
+		merged += len(group) - 1
+	}
+
+	rewritten, err := q.Rewrite(func(url string) string {
+		key, err := n.Normalize(url)
+		if err != nil {
+			return url
+		}
+		return key
+	})
+	if err != nil {
+		return merged, fmt.Errorf("unable to normalise queued urls: %w", err)
+	}
+	fmt.Printf("normalised the urls of %d queued jobs \n", rewritten)
+
+	return merged, nil
+}
+
+// migrate replaces the records in the group with a single record under key.
+func migrate(
+	s store.Store,
+	blobs *content.Storage,
+	history *versions.History,
+	key string,
+	group []models.URL,
+) error {
+	record := merge(key, group)
+	bytes, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("unable to marshal URL into bytes")
+	}
+
+	// histories are merged first, merging one that has already been moved does nothing.
+	for _, url := range group {
+		if url.URL == key {
+			continue
+		}
+
+		if err := history.Merge(url.URL, key); err != nil {
+			return err
+		}
+	}
+
+	// every record held a reference to its blob, the merged record holds one between them. It is taken before the
+	// records are replaced and the old ones dropped after, so stopping partway leaves a reference too many rather than
+	// a blob that can be collected from under the merged record.
+	if record.ContentHash != "" {
+		if err := blobs.Retain(record.ContentHash); err != nil {
+			return err
+		}
+	}
+
+	err = s.Transaction(func(tx store.Tx) error {
+		if err := tx.Set(key, bytes); err != nil {
+			return fmt.Errorf("unable to store %s: %w", key, err)
+		}
+
+		for _, url := range group {
+			if url.URL == key {
+				continue
+			}
+
+			if err := tx.Delete(url.URL); err != nil {
+				return fmt.Errorf("unable to remove %s: %w", url.URL, err)
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, url := range group {
+		if url.ContentHash != "" {
+			if err := blobs.Release(url.ContentHash); err != nil {
+				return err
+			}
+		}
+
+		if url.URL != key {
+			fmt.Printf("moved %s to %s \n", url.URL, key)
+		}
+	}
+
+	return nil
+}
+
+// merge combines the records of a URL stored under different keys into one record under key.
+func merge(key string, group []models.URL) models.URL {
+	// order the group so the merge doesn't depend on the order the store returned the records in.
+	sort.Slice(group, func(i, j int) bool {
+		return group[i].URL < group[j].URL
+	})
+
+	record := group[0]
+	for _, url := range group[1:] {
+		if refreshed(url).After(refreshed(record)) {
+			record = url
+		}
+	}
+
+	record.URL = key
+	record.Submitted = 0
+	for _, url := range group {
+		record.Submitted += url.Submitted
+		if !url.CreatedAt.IsZero() && (record.CreatedAt.IsZero() || url.CreatedAt.Before(record.CreatedAt)) {
+			record.CreatedAt = url.CreatedAt
+		}
+	}
+
+	return record
+}
+
+// refreshed returns when the record last changed.
+func refreshed(url models.URL) time.Time {
+	if url.UpdatedAt.IsZero() {
+		return url.CreatedAt
+	}
+	return url.UpdatedAt
+}
@@ -0,0 +1,201 @@
+package urls_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pocockn/downloader/content"
+	"github.com/pocockn/downloader/download"
+	"github.com/pocockn/downloader/models"
+	"github.com/pocockn/downloader/queue"
+	"github.com/pocockn/downloader/store"
+	"github.com/pocockn/downloader/urls"
+	"github.com/pocockn/downloader/versions"
+)
+
+func TestMigrate(t *testing.T) {
+	db := store.NewMemory()
+	refs, err := db.Bucket("blobs")
+	require.NoError(t, err)
+
+	storage, err := content.New(t.TempDir(), refs)
+	require.NoError(t, err)
+
+	history := versions.NewHistory(store.NewMemory(), storage, versions.Retention{})
+	q := queue.New(store.NewMemory(), queue.Options{VisibilityTimeout: time.Minute})
+
+	queued, err := q.Enqueue("queued", models.URL{URL: "HTTP://www.example.com:80/#top"})
+	require.NoError(t, err)
+
+	older, err := storage.Save(strings.NewReader("older"))
+	require.NoError(t, err)
+	newer, err := storage.Save(strings.NewReader("newer"))
+	require.NoError(t, err)
+
+	created := time.Date(2023, 4, 25, 7, 0, 0, 0, time.UTC)
+	for _, url := range []models.URL{
+		{
+			URL:         "http://www.example.com",
+			Submitted:   2,
+			CreatedAt:   created,
+			UpdatedAt:   created.Add(time.Hour),
+			ContentHash: older.Hash,
+		},
+		{
+			URL:         "HTTP://www.example.com:80/#top",
+			Submitted:   3,
+			CreatedAt:   created.Add(time.Minute),
+			UpdatedAt:   created.Add(2 * time.Hour),
+			ContentHash: newer.Hash,
+		},
+		{URL: "http://www.example.com/", Submitted: 1, CreatedAt: created.Add(-time.Minute), ContentHash: older.Hash},
+		{URL: "http://www.example.org/", Submitted: 4, CreatedAt: created, ContentHash: older.Hash},
+		{URL: "http://www.example.net", Submitted: 5, CreatedAt: created},
+		{URL: "example.io", Submitted: 6, CreatedAt: created},
+	} {
+		bytes, err := json.Marshal(url)
+		require.NoError(t, err)
+		require.NoError(t, db.Set(url.URL, bytes))
+
+		if url.ContentHash != "" {
+			require.NoError(t, storage.Retain(url.ContentHash))
+		}
+	}
+
+	_, err = history.Record("http://www.example.com", &download.Result{Hash: older.Hash, Path: older.Path})
+	require.NoError(t, err)
+
+	t.Run("Duplicate records are merged under their canonical key", func(t *testing.T) {
+		merged, err := urls.Migrate(db, nil, storage, history, q)
+		require.NoError(t, err)
+		assert.Equal(t, 2, merged)
+
+		url := fetch(t, db, "http://www.example.com/")
+		assert.Equal(t, "http://www.example.com/", url.URL)
+		assert.Equal(t, 6, url.Submitted)
+		assert.Equal(t, created.Add(-time.Minute), url.CreatedAt)
+		assert.Equal(t, newer.Hash, url.ContentHash)
+
+		for _, key := range []string{"http://www.example.com", "HTTP://www.example.com:80/#top"} {
+			bytes, err := db.Get(key)
+			require.NoError(t, err)
+			assert.Nil(t, bytes, key)
+		}
+
+		list, err := history.List("http://www.example.com/")
+		require.NoError(t, err)
+		require.Len(t, list, 1)
+		assert.Equal(t, older.Hash, list[0].Hash)
+	})
+
+	t.Run("Records under a non canonical key are moved", func(t *testing.T) {
+		url := fetch(t, db, "http://www.example.net/")
+		assert.Equal(t, 5, url.Submitted)
+
+		bytes, err := db.Get("http://www.example.net")
+		require.NoError(t, err)
+		assert.Nil(t, bytes)
+	})
+
+	t.Run("Canonical and invalid records are left alone", func(t *testing.T) {
+		assert.Equal(t, 4, fetch(t, db, "http://www.example.org/").Submitted)
+		assert.Equal(t, 6, fetch(t, db, "example.io").Submitted)
+	})
+
+	t.Run("Queued jobs are normalised", func(t *testing.T) {
+		job, err := q.Lease(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, queued.Key, job.Key)
+		assert.Equal(t, "http://www.example.com/", job.URL.URL)
+		require.NoError(t, q.Release(job))
+	})
+
+	t.Run("Blobs keep a reference per record and version", func(t *testing.T) {
+		// the example.org record and the version.
+		count, err := storage.Refs(older.Hash)
+		require.NoError(t, err)
+		assert.Equal(t, 2, count)
+
+		count, err = storage.Refs(newer.Hash)
+		require.NoError(t, err)
+		assert.Equal(t, 1, count)
+	})
+
+	t.Run("Running it again changes nothing", func(t *testing.T) {
+		merged, err := urls.Migrate(db, nil, storage, history, q)
+		require.NoError(t, err)
+		assert.Zero(t, merged)
+		assert.Equal(t, 6, fetch(t, db, "http://www.example.com/").Submitted)
+	})
+}
+
+// failingStore fails its first transaction once fn has made its changes, as if the process died before committing.
+type failingStore struct {
+	*store.Memory
+	failed bool
+}
+
+func (s *failingStore) Transaction(fn func(tx store.Tx) error) error {
+	if s.failed {
+		return s.Memory.Transaction(fn)
+	}
+
+	s.failed = true
+	return s.Memory.Transaction(func(tx store.Tx) error {
+		if err := fn(tx); err != nil {
+			return err
+		}
+		return errors.New("big error")
+	})
+}
+
+func TestMigrate_Interrupted(t *testing.T) {
+	db := &failingStore{Memory: store.NewMemory()}
+	storage, err := content.New(t.TempDir(), store.NewMemory())
+	require.NoError(t, err)
+
+	history := versions.NewHistory(store.NewMemory(), storage, versions.Retention{})
+	q := queue.New(store.NewMemory(), queue.Options{VisibilityTimeout: time.Minute})
+
+	for _, url := range []models.URL{
+		{URL: "http://www.example.com", Submitted: 2},
+		{URL: "http://www.example.com/", Submitted: 3},
+	} {
+		bytes, err := json.Marshal(url)
+		require.NoError(t, err)
+		require.NoError(t, db.Set(url.URL, bytes))
+	}
+
+	t.Run("A run that stops partway leaves the records as they were", func(t *testing.T) {
+		_, err := urls.Migrate(db, nil, storage, history, q)
+		assert.Error(t, err)
+
+		assert.Equal(t, 2, fetch(t, db, "http://www.example.com").Submitted)
+		assert.Equal(t, 3, fetch(t, db, "http://www.example.com/").Submitted)
+	})
+
+	t.Run("Running it again counts every submission once", func(t *testing.T) {
+		merged, err := urls.Migrate(db, nil, storage, history, q)
+		require.NoError(t, err)
+		assert.Equal(t, 1, merged)
+		assert.Equal(t, 5, fetch(t, db, "http://www.example.com/").Submitted)
+	})
+}
+
+func fetch(t *testing.T, db store.Store, key string) models.URL {
+	bytes, err := db.Get(key)
+	require.NoError(t, err)
+	require.NotNil(t, bytes, key)
+
+	var url models.URL
+	require.NoError(t, json.Unmarshal(bytes, &url))
+
+	return url
+}
@@ -0,0 +1,198 @@
+package urls
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var (
+	// ErrNotAbsolute is returned for URLs without a scheme, like example.com.
+	ErrNotAbsolute = errors.New("url must be absolute, like http://example.com/")
+	// ErrScheme is returned for URLs we can't download, anything other than http and https.
+	ErrScheme = errors.New("url scheme must be http or https")
+	// ErrNoHost is returned for URLs without a host.
+	ErrNoHost = errors.New("url must have a host")
+	// ErrPort is returned for URLs with a port that isn't a number between 1 and 65535.
+	ErrPort = errors.New("url port must be between 1 and 65535")
+)
+
+// defaultPorts are the ports that are implied by each scheme.
+var defaultPorts = map[string]string{
+	"http":  "80",
+	"https": "443",
+}
+
+// Options turns on the normalisations that can change which resource a URL points at on some sites.
+type Options struct {
+	// SortQuery sorts the query params by name, params with the same name keep their order.
+	SortQuery bool
+	// TrackingParams are query params that are removed, like utm_source. A name ending in * removes every param
+	// starting with what comes before it.
+	TrackingParams []string
+}
+
+// Normalizer turns the different ways of writing a URL into one canonical form, so submissions of the same URL are
+// stored under the same key.
+type Normalizer struct {
+	opts Options
+}
+
+// NewNormalizer returns a Normalizer that applies the options on top of the normalisations that never change the
+// resource a URL points at.
+func NewNormalizer(opts Options) *Normalizer {
+	return &Normalizer{opts: opts}
+}
+
+// Normalize returns the canonical form of raw, or an error saying why it isn't a URL we can download. The scheme and
+// host are lower cased, the scheme's default port, the fragment and any trailing dot on the host are removed, an empty
+// path becomes /, and percent-encoding is normalised so unreserved characters are never escaped and escapes use upper
+// case hex. A nil Normalizer doesn't apply any of the options.
+func (n *Normalizer) Normalize(raw string) (string, error) {
+	u, err := url.Parse(strings.TrimSpace(raw))
+	if err != nil {
+		return "", fmt.Errorf("url is invalid: %w", errors.Unwrap(err))
+	}
+
+	if u.Scheme == "" || u.Opaque != "" {
+		return "", ErrNotAbsolute
+	}
+
+	u.Scheme = strings.ToLower(u.Scheme)
+	if _, ok := defaultPorts[u.Scheme]; !ok {
+		return "", ErrScheme
+	}
+
+	if u.Host, err = normalizeHost(u); err != nil {
+		return "", err
+	}
+
+	u.Fragment, u.RawFragment = "", ""
+
+	path := normalizeEscapes(u.EscapedPath())
+	if path == "" {
+		path = "/"
+	}
+	if u.Path, err = url.PathUnescape(path); err != nil {
+		return "", fmt.Errorf("url is invalid: %w", err)
+	}
+	u.RawPath = path
+
+	u.RawQuery = n.query(normalizeEscapes(u.RawQuery))
+	u.ForceQuery = false
+
+	return u.String(), nil
+}
+
+// normalizeHost returns the URL's host lower cased, without a trailing dot or the scheme's default port.
+func normalizeHost(u *url.URL) (string, error) {
+	host := strings.TrimSuffix(strings.ToLower(u.Hostname()), ".")
+	if host == "" {
+		return "", ErrNoHost
+	}
+
+	if strings.Contains(host, ":") {
+		// IPv6 addresses keep their brackets.
+		host = "[" + host + "]"
+	}
+
+	if u.Port() == "" {
+		return host, nil
+	}
+
+	number, err := strconv.Atoi(u.Port())
+	if err != nil || number < 1 || number > 65535 {
+		return "", ErrPort
+	}
+
+	port := strconv.Itoa(number)
+	if port == defaultPorts[u.Scheme] {
+		return host, nil
+	}
+
+	return net.JoinHostPort(strings.Trim(host, "[]"), port), nil
+}
+
+// query removes the tracking params from the raw query, and sorts it if asked to. The params are left encoded as they
+// were, so the query isn't rewritten any more than it has to be.
+func (n *Normalizer) query(raw string) string {
+	if n == nil || (!n.opts.SortQuery && len(n.opts.TrackingParams) == 0) {
+		return raw
+	}
+
+	var params []string
+	for _, param := range strings.Split(raw, "&") {
+		if param != "" && !n.tracking(param) {
+			params = append(params, param)
+		}
+	}
+
+	if n.opts.SortQuery {
+		sort.SliceStable(params, func(i, j int) bool {
+			return name(params[i]) < name(params[j])
+		})
+	}
+
+	return strings.Join(params, "&")
+}
+
+// tracking reports whether the param is one of the tracking params.
+func (n *Normalizer) tracking(param string) bool {
+	key := name(param)
+	for _, tracking := range n.opts.TrackingParams {
+		if prefix, ok := strings.CutSuffix(tracking, "*"); key == tracking || (ok && strings.HasPrefix(key, prefix)) {
+			return true
+		}
+	}
+	return false
+}
+
+// name returns the decoded name of a query param.
+func name(param string) string {
+	key, _, _ := strings.Cut(param, "=")
+	if decoded, err := url.QueryUnescape(key); err == nil {
+		return decoded
+	}
+	return key
+}
+
+// normalizeEscapes decodes percent-encoded unreserved characters, which mean the same thing escaped or not, and upper
+// cases the hex digits of every other escape.
+func normalizeEscapes(s string) string {
+	if !strings.Contains(s, "%") {
+		return s
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '%' || i+2 >= len(s) || !isHex(s[i+1]) || !isHex(s[i+2]) {
+			b.WriteByte(s[i])
+			continue
+		}
+
+		decoded, _ := strconv.ParseUint(s[i+1:i+3], 16, 8)
+		if c := byte(decoded); unreserved(c) {
+			b.WriteByte(c)
+		} else {
+			b.WriteString("%" + strings.ToUpper(s[i+1:i+3]))
+		}
+		i += 2
+	}
+
+	return b.String()
+}
+
+// isHex reports whether c is a hex digit.
+func isHex(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'
+}
+
+// unreserved reports whether c is one of the characters RFC 3986 never needs escaped.
+func unreserved(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' ||
+		c == '-' || c == '.' || c == '_' || c == '~'
+}
@@ -0,0 +1,65 @@
+package urls_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pocockn/downloader/urls"
+)
+
+func TestNormalize(t *testing.T) {
+	t.Run("Different ways of writing a URL have one canonical form", func(t *testing.T) {
+		var n *urls.Normalizer
+
+		for raw, want := range map[string]string{
+			"http://example.com":                       "http://example.com/",
+			"HTTP://Example.COM:80/":                   "http://example.com/",
+			"http://example.com/#frag":                 "http://example.com/",
+			" https://example.com:443/a ":              "https://example.com/a",
+			"https://example.com.:8443/a":              "https://example.com:8443/a",
+			"http://example.com:080/":                  "http://example.com/",
+			"http://example.com/%7euser/%2fdocs%3f":    "http://example.com/~user/%2Fdocs%3F",
+			"http://example.com/a%20b?q=%7e%c3%a9":     "http://example.com/a%20b?q=~%C3%A9",
+			"http://[2001:DB8::1]:80/":                 "http://[2001:db8::1]/",
+			"http://example.com/?":                     "http://example.com/",
+			"http://example.com/?b=2&a=1&utm_source=x": "http://example.com/?b=2&a=1&utm_source=x",
+		} {
+			normalized, err := n.Normalize(raw)
+			require.NoError(t, err, raw)
+			assert.Equal(t, want, normalized, raw)
+		}
+	})
+
+	t.Run("Query params can be sorted and tracking params removed", func(t *testing.T) {
+		n := urls.NewNormalizer(urls.Options{SortQuery: true, TrackingParams: []string{"utm_*", "fbclid"}})
+
+		normalized, err := n.Normalize("http://example.com/?b=2&utm_source=x&a=1&fbclid=y&a=0&utm_medium=z")
+		require.NoError(t, err)
+		assert.Equal(t, "http://example.com/?a=1&a=0&b=2", normalized)
+
+		normalized, err = n.Normalize("http://example.com/?utm_source=x")
+		require.NoError(t, err)
+		assert.Equal(t, "http://example.com/", normalized)
+	})
+
+	t.Run("URLs we can't download are rejected", func(t *testing.T) {
+		var n *urls.Normalizer
+
+		for raw, want := range map[string]error{
+			"example.com":               urls.ErrNotAbsolute,
+			"localhost:5000/path":       urls.ErrNotAbsolute,
+			"/path":                     urls.ErrNotAbsolute,
+			"ftp://example.com/":        urls.ErrScheme,
+			"http:///path":              urls.ErrNoHost,
+			"http://example.com:70000/": urls.ErrPort,
+		} {
+			_, err := n.Normalize(raw)
+			assert.ErrorIs(t, err, want, raw)
+		}
+
+		_, err := n.Normalize("http://exa mple.com/")
+		assert.EqualError(t, err, `url is invalid: invalid character " " in host name`)
+	})
+}
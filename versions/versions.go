@@ -0,0 +1,215 @@
+package versions
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/pocockn/downloader/content"
+	"github.com/pocockn/downloader/download"
+	"github.com/pocockn/downloader/store"
+)
+
+// Status says how a version relates to the one before it.
+type Status string
+
+// Statuses a version can have.
+const (
+	// StatusNew is the first version we have of a URL.
+	StatusNew Status = "new"
+	// StatusChanged is a body that differs from the version before it.
+	StatusChanged Status = "changed"
+)
+
+// Now is used, so we can fix the time within our tests.
+var Now = time.Now
+
+// Version is a distinct body we have downloaded from a URL. FetchedAt is when we first downloaded it and CheckedAt
+// is the last time a download found the URL still serving it.
+type Version struct {
+	Hash        string
+	FilePath    string
+	Size        int64
+	ContentType string
+	Status      Status
+	FetchedAt   time.Time
+	CheckedAt   time.Time
+}
+
+// Retention bounds how many versions are kept for each URL, it is applied whenever a new version is recorded. The
+// latest version is always kept. Zero means no limit.
+type Retention struct {
+	// MaxVersions is the most versions kept for a URL.
+	MaxVersions int
+	// MaxAge is how long a version is kept once it has been replaced.
+	MaxAge time.Duration
+}
+
+// History keeps the versions of each URL, newest first, in a single record per URL. Every version holds a reference
+// to its blob so previous versions survive garbage collection until they fall out of the retention.
+type History struct {
+	store     store.Store
+	blobs     *content.Storage
+	retention Retention
+}
+
+// NewHistory returns a History that keeps versions in s, holding references to their bodies in blobs.
+func NewHistory(s store.Store, blobs *content.Storage, retention Retention) *History {
+	return &History{store: s, blobs: blobs, retention: retention}
+}
+
+// Record adds the body downloaded from url to its history. A body with the same hash as the latest version only
+// moves that version's CheckedAt on, so a page that rarely changes doesn't push its old versions out of the
+// retention. The version the download is recorded against is returned.
+func (h *History) Record(url string, downloaded *download.Result) (Version, error) {
+	now := Now().UTC()
+
+	var latest Version
+	var retain string
+	var released []Version
+	err := h.store.Update(url, func(old []byte) ([]byte, error) {
+		var history []Version
+		if old != nil {
+			if err := json.Unmarshal(old, &history); err != nil {
+				return nil, fmt.Errorf("unable to unmarshal versions of %s: %w", url, err)
+			}
+		}
+
+		retain, released = "", nil
+		if len(history) > 0 && history[0].Hash == downloaded.Hash {
+			history[0].CheckedAt = now
+		} else {
+			status := StatusChanged
+			if len(history) == 0 {
+				status = StatusNew
+			}
+
+			history = append([]Version{{
+				Hash:        downloaded.Hash,
+				FilePath:    downloaded.Path,
+				Size:        downloaded.Size,
+				ContentType: downloaded.ContentType,
+				Status:      status,
+				FetchedAt:   now,
+				CheckedAt:   now,
+			}}, history...)
+			retain = downloaded.Hash
+			history, released = h.prune(history, now)
+		}
+		latest = history[0]
+
+		bytes, err := json.Marshal(history)
+		if err != nil {
+			return nil, fmt.Errorf("unable to marshal versions of %s: %w", url, err)
+		}
+
+		return bytes, nil
+	})
+	if err != nil {
+		return Version{}, fmt.Errorf("unable to record version of %s: %w", url, err)
+	}
+
+	if retain != "" {
+		if err := h.blobs.Retain(retain); err != nil {
+			return Version{}, err
+		}
+	}
+
+	for _, version := range released {
+		if err := h.blobs.Release(version.Hash); err != nil {
+			return Version{}, err
+		}
+	}
+
+	return latest, nil
+}
+
+// Merge moves the versions of from into the history of to, for when two URLs turn out to be the same one. The
+// versions are ordered newest first and the retention applied to the lot, the versions that fall out of it release
+// their blobs.
+func (h *History) Merge(from, to string) error {
+	moved, err := h.List(from)
+	if err != nil || len(moved) == 0 {
+		return err
+	}
+
+	now := Now().UTC()
+
+	var released []Version
+	err = h.store.Update(to, func(old []byte) ([]byte, error) {
+		var history []Version
+		if old != nil {
+			if err := json.Unmarshal(old, &history); err != nil {
+				return nil, fmt.Errorf("unable to unmarshal versions of %s: %w", to, err)
+			}
+		}
+
+		history = append(history, moved...)
+		sort.SliceStable(history, func(i, j int) bool {
+			return history[i].FetchedAt.After(history[j].FetchedAt)
+		})
+		history, released = h.prune(history, now)
+
+		bytes, err := json.Marshal(history)
+		if err != nil {
+			return nil, fmt.Errorf("unable to marshal versions of %s: %w", to, err)
+		}
+
+		return bytes, nil
+	})
+	if err != nil {
+		return fmt.Errorf("unable to merge versions of %s into %s: %w", from, to, err)
+	}
+
+	if err := h.store.Delete(from); err != nil {
+		return fmt.Errorf("unable to remove versions of %s: %w", from, err)
+	}
+
+	for _, version := range released {
+		if err := h.blobs.Release(version.Hash); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// prune splits history into the versions to keep and those that have fallen out of the retention. A version's age is
+// counted from when the version after it replaced it.
+func (h *History) prune(history []Version, now time.Time) ([]Version, []Version) {
+	keep := len(history)
+	if h.retention.MaxVersions > 0 && keep > h.retention.MaxVersions {
+		keep = h.retention.MaxVersions
+	}
+
+	if h.retention.MaxAge > 0 {
+		for i := 1; i < keep; i++ {
+			if now.Sub(history[i-1].FetchedAt) > h.retention.MaxAge {
+				keep = i
+				break
+			}
+		}
+	}
+
+	return history[:keep], history[keep:]
+}
+
+// List returns the versions of url, newest first. URLs without a history return an empty list.
+func (h *History) List(url string) ([]Version, error) {
+	bytes, err := h.store.Get(url)
+	if err != nil {
+		return nil, fmt.Errorf("unable to fetch versions of %s: %w", url, err)
+	}
+
+	history := []Version{}
+	if bytes == nil {
+		return history, nil
+	}
+
+	if err := json.Unmarshal(bytes, &history); err != nil {
+		return nil, fmt.Errorf("unable to unmarshal versions of %s: %w", url, err)
+	}
+
+	return history, nil
+}
@@ -0,0 +1,173 @@
+package versions_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pocockn/downloader/content"
+	"github.com/pocockn/downloader/download"
+	"github.com/pocockn/downloader/store"
+	"github.com/pocockn/downloader/versions"
+)
+
+func TestHistory(t *testing.T) {
+	storage, err := content.New(t.TempDir(), store.NewMemory())
+	require.NoError(t, err)
+
+	now := time.Date(2023, 4, 25, 7, 0, 0, 0, time.UTC)
+	versions.Now = func() time.Time { return now }
+	defer func() { versions.Now = time.Now }()
+
+	save := func(body string) *download.Result {
+		blob, err := storage.Save(strings.NewReader(body))
+		require.NoError(t, err)
+		return &download.Result{Hash: blob.Hash, Path: blob.Path, Size: blob.Size}
+	}
+
+	history := versions.NewHistory(store.NewMemory(), storage, versions.Retention{MaxVersions: 2})
+	url := "http://www.example.com"
+
+	first := save("first")
+	second := save("second")
+
+	t.Run("URLs without a history have no versions", func(t *testing.T) {
+		list, err := history.List(url)
+		require.NoError(t, err)
+		assert.Empty(t, list)
+	})
+
+	t.Run("The first body is a new version", func(t *testing.T) {
+		version, err := history.Record(url, first)
+		require.NoError(t, err)
+		assert.Equal(t, versions.StatusNew, version.Status)
+		assert.Equal(t, first.Hash, version.Hash)
+		assert.Equal(t, now, version.FetchedAt)
+	})
+
+	t.Run("Unchanged bodies only move the latest version on", func(t *testing.T) {
+		now = now.Add(time.Hour)
+
+		version, err := history.Record(url, first)
+		require.NoError(t, err)
+		assert.Equal(t, now.Add(-time.Hour), version.FetchedAt)
+		assert.Equal(t, now, version.CheckedAt)
+
+		list, err := history.List(url)
+		require.NoError(t, err)
+		assert.Len(t, list, 1)
+	})
+
+	t.Run("Changed bodies are recorded newest first and hold their blob", func(t *testing.T) {
+		version, err := history.Record(url, second)
+		require.NoError(t, err)
+		assert.Equal(t, versions.StatusChanged, version.Status)
+
+		list, err := history.List(url)
+		require.NoError(t, err)
+		require.Len(t, list, 2)
+		assert.Equal(t, second.Hash, list[0].Hash)
+		assert.Equal(t, first.Hash, list[1].Hash)
+
+		refs, err := storage.Refs(first.Hash)
+		require.NoError(t, err)
+		assert.Equal(t, 1, refs)
+	})
+
+	t.Run("Versions past the retention are dropped and release their blob", func(t *testing.T) {
+		_, err := history.Record(url, save("third"))
+		require.NoError(t, err)
+
+		list, err := history.List(url)
+		require.NoError(t, err)
+		require.Len(t, list, 2)
+		assert.Equal(t, second.Hash, list[1].Hash)
+
+		refs, err := storage.Refs(first.Hash)
+		require.NoError(t, err)
+		assert.Zero(t, refs)
+	})
+}
+
+func TestHistory_MaxAge(t *testing.T) {
+	storage, err := content.New(t.TempDir(), store.NewMemory())
+	require.NoError(t, err)
+
+	now := time.Date(2023, 4, 25, 7, 0, 0, 0, time.UTC)
+	versions.Now = func() time.Time { return now }
+	defer func() { versions.Now = time.Now }()
+
+	history := versions.NewHistory(store.NewMemory(), storage, versions.Retention{MaxAge: 24 * time.Hour})
+	url := "http://www.example.com"
+
+	for i, body := range []string{"first", "second", "third"} {
+		blob, err := storage.Save(strings.NewReader(body))
+		require.NoError(t, err)
+
+		_, err = history.Record(url, &download.Result{Hash: blob.Hash, Path: blob.Path, Size: blob.Size})
+		require.NoError(t, err)
+
+		// the first version is replaced after an hour, the second a couple of days later.
+		if i == 0 {
+			now = now.Add(time.Hour)
+		} else {
+			now = now.Add(49 * time.Hour)
+		}
+	}
+
+	t.Run("Versions replaced longer ago than the max age are dropped", func(t *testing.T) {
+		list, err := history.List(url)
+		require.NoError(t, err)
+		require.Len(t, list, 2)
+		assert.Equal(t, versions.StatusChanged, list[1].Status)
+		assert.Equal(t, int64(6), list[1].Size)
+	})
+}
+
+func TestHistory_Merge(t *testing.T) {
+	storage, err := content.New(t.TempDir(), store.NewMemory())
+	require.NoError(t, err)
+
+	now := time.Date(2023, 4, 25, 7, 0, 0, 0, time.UTC)
+	versions.Now = func() time.Time { return now }
+	defer func() { versions.Now = time.Now }()
+
+	save := func(body string) *download.Result {
+		blob, err := storage.Save(strings.NewReader(body))
+		require.NoError(t, err)
+		return &download.Result{Hash: blob.Hash, Path: blob.Path, Size: blob.Size}
+	}
+
+	history := versions.NewHistory(store.NewMemory(), storage, versions.Retention{MaxVersions: 2})
+	first, second, third := save("first"), save("second"), save("third")
+
+	_, err = history.Record("http://www.example.com", first)
+	require.NoError(t, err)
+	now = now.Add(time.Hour)
+	_, err = history.Record("http://www.example.com/", second)
+	require.NoError(t, err)
+	now = now.Add(time.Hour)
+	_, err = history.Record("http://www.example.com", third)
+	require.NoError(t, err)
+
+	t.Run("Versions are merged newest first and the retention applied", func(t *testing.T) {
+		require.NoError(t, history.Merge("http://www.example.com", "http://www.example.com/"))
+
+		list, err := history.List("http://www.example.com/")
+		require.NoError(t, err)
+		require.Len(t, list, 2)
+		assert.Equal(t, third.Hash, list[0].Hash)
+		assert.Equal(t, second.Hash, list[1].Hash)
+
+		list, err = history.List("http://www.example.com")
+		require.NoError(t, err)
+		assert.Empty(t, list)
+
+		refs, err := storage.Refs(first.Hash)
+		require.NoError(t, err)
+		assert.Zero(t, refs)
+	})
+}
@@ -1,52 +1,129 @@
 package watcher
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
-	"net/http"
-	"sort"
 	"sync"
 	"time"
 
+	"github.com/pocockn/downloader/bandwidth"
+	"github.com/pocockn/downloader/content"
+	"github.com/pocockn/downloader/download"
 	"github.com/pocockn/downloader/models"
 	"github.com/pocockn/downloader/store"
+	"github.com/pocockn/downloader/versions"
 )
 
+// topURLs is how many of the most submitted URLs the watcher downloads on each run.
+const topURLs = 10
+
 // Watcher is used to watch the URLs being saved into the database. It will run a process
 // function based on the interval passed in.
 type Watcher struct {
 	intervalDuration time.Duration
 	store            store.Store
+	downloader       *download.Downloader
+	history          *versions.History
+	bandwidth        *bandwidth.Limiter
 
 	successfulDownloads   int64
+	unchangedDownloads    int64
 	unsuccessfulDownloads int64
+	timedOutDownloads     int64
+	// throughput is the bytes per second downloaded during the last batch.
+	throughput float64
+
+	// stop is closed to stop the watcher, done is closed once the current run has finished.
+	stop     chan struct{}
+	done     chan struct{}
+	stopOnce sync.Once
+
+	// started is set once Process has started the run loop, so Stop knows whether there is a run to wait for. It is
+	// guarded by mu.
+	started bool
 
-	stop chan struct{}
+	// ctx is passed to every download, it is cancelled to abandon in-flight downloads on shutdown.
+	ctx    context.Context
+	cancel context.CancelFunc
 
 	mu sync.RWMutex
 }
 
-// New returns a new watcher struct.
-func New(i time.Duration, s store.Store) *Watcher {
+// New returns a new watcher struct. Every body the watcher downloads is recorded in the history. The throughput of
+// each batch is measured by the bandwidth limiter the downloads are read through, a nil limiter doesn't measure it.
+func New(
+	i time.Duration,
+	s store.Store,
+	d *download.Downloader,
+	history *versions.History,
+	limiter *bandwidth.Limiter,
+) *Watcher {
+	ctx, cancel := context.WithCancel(context.Background())
+
 	return &Watcher{
 		intervalDuration: i,
 		store:            s,
+		downloader:       d,
+		history:          history,
+		bandwidth:        limiter,
 		mu:               sync.RWMutex{},
 		stop:             make(chan struct{}),
+		done:             make(chan struct{}),
+		ctx:              ctx,
+		cancel:           cancel,
+	}
+}
+
+// Stats counts the outcomes of the downloads the watcher has made. Unchanged downloads are the successful ones where
+// the server told us the copy we already had is current, they aren't included in Successful. Throughput is the bytes
+// per second downloaded while the last batch ran, by the workers as well as the watcher, since they share the uplink.
+type Stats struct {
+	Successful   int64
+	Unchanged    int64
+	Unsuccessful int64
+	TimedOut     int64
+	Throughput   float64
+}
+
+// Stats returns the outcomes of the downloads made so far.
+func (w *Watcher) Stats() Stats {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+
+	return Stats{
+		Successful:   w.successfulDownloads,
+		Unchanged:    w.unchangedDownloads,
+		Unsuccessful: w.unsuccessfulDownloads,
+		TimedOut:     w.timedOutDownloads,
+		Throughput:   w.throughput,
 	}
 }
 
 // Process performs the logic for the watcher. It triggers every n seconds based off the interval passed into the
 // watchers constructor. It will fetch the 10 most submitted URLs then perform batch downloads of 3 URLs at a time.
-// Once all URLs have been downloaded it prints the time taken and number of successful / unsuccessful downloads to stdout.
+// Once all URLs have been downloaded it prints the time taken, number of successful / unchanged / unsuccessful /
+// timed out downloads and the throughput to stdout, and garbage collects any blobs that are no longer referenced by a
+// URL.
 func (w *Watcher) Process() {
+	w.mu.Lock()
+	select {
+	case <-w.stop:
+		w.mu.Unlock()
+		return
+	default:
+	}
+	w.started = true
+	w.mu.Unlock()
+
 	fmt.Println("starting watcher...")
 	ticker := time.NewTicker(w.intervalDuration)
 	go func() {
+		defer close(w.done)
 		for {
 			select {
 			case <-ticker.C:
-				results, err := w.store.GetAll()
+				results, err := w.store.TopSubmitted(topURLs)
 				if err != nil {
 					fmt.Println(err.Error())
 					return
@@ -63,9 +140,7 @@ func (w *Watcher) Process() {
 					urls = append(urls, url)
 				}
 
-				sort.Slice(urls, func(i, j int) bool {
-					return urls[i].Submitted > urls[j].Submitted
-				})
+				started, transferred := time.Now(), w.transferred()
 
 				// Create a wait group to wait for all the downloads to complete
 				var wg sync.WaitGroup
@@ -74,22 +149,26 @@ func (w *Watcher) Process() {
 				// Buffered channel, allows max 3 values
 				concurrentGoroutines := make(chan struct{}, 3)
 
-				if len(urls) > 10 {
-					urls = urls[:9]
-				}
-
 				for _, url := range urls {
 					wg.Add(1)
 					concurrentGoroutines <- struct{}{}
 					go func(url models.URL) {
 						defer wg.Done()
-						if err := w.downloadURL(url); err != nil {
-							w.mu.Lock()
-							w.unsuccessfulDownloads++
-							w.mu.Unlock()
+						result, err := w.downloadURL(url)
+						if err != nil {
+							fmt.Println(err.Error())
 						}
 						w.mu.Lock()
-						w.successfulDownloads++
+						switch {
+						case err == nil && result.Unchanged:
+							w.unchangedDownloads++
+						case err == nil:
+							w.successfulDownloads++
+						case download.ReasonFor(err) == download.ReasonTimeout:
+							w.timedOutDownloads++
+						default:
+							w.unsuccessfulDownloads++
+						}
 						w.mu.Unlock()
 						// read from the channel, this will allow another URL to be processed.
 						<-concurrentGoroutines
@@ -97,11 +176,25 @@ func (w *Watcher) Process() {
 				}
 
 				wg.Wait()
+				w.mu.Lock()
+				w.throughput = float64(w.transferred()-transferred) / time.Since(started).Seconds()
 				fmt.Printf(
-					"successfull downloads %d, unsuccessful downloads %d \n",
+					"successfull downloads %d, unchanged downloads %d, unsuccessful downloads %d, "+
+						"timed out downloads %d, throughput %.1f KB/s \n",
 					w.successfulDownloads,
+					w.unchangedDownloads,
 					w.unsuccessfulDownloads,
+					w.timedOutDownloads,
+					w.throughput/1024,
 				)
+				w.mu.Unlock()
+
+				removed, err := w.downloader.Storage().GC(content.GCGrace)
+				if err != nil {
+					fmt.Printf("unable to garbage collect blobs: %+v \n", err)
+					continue
+				}
+				fmt.Printf("garbage collected %d unreferenced blobs \n", removed)
 			case <-w.stop:
 				ticker.Stop()
 				fmt.Println("Stopping watcher...")
@@ -111,31 +204,102 @@ func (w *Watcher) Process() {
 	}()
 }
 
-// Stop closes down the watcher
-func (w *Watcher) Stop() {
-	w.stop <- struct{}{}
+// Stop closes down the watcher, waiting for any run in progress to finish. If ctx is done first the in-flight
+// downloads are cancelled, and once the run has returned ctx's error is returned. A watcher that was never started is
+// stopped straight away, and won't start afterwards.
+func (w *Watcher) Stop(ctx context.Context) error {
+	w.mu.Lock()
+	w.stopOnce.Do(func() {
+		close(w.stop)
+	})
+	started := w.started
+	w.mu.Unlock()
+
+	if !started {
+		return nil
+	}
+
+	select {
+	case <-w.done:
+		return nil
+	case <-ctx.Done():
+		w.cancel()
+		<-w.done
+		return ctx.Err()
+	}
+}
+
+// transferred returns how many bytes have been downloaded through the bandwidth limiter.
+func (w *Watcher) transferred() int64 {
+	if w.bandwidth == nil {
+		return 0
+	}
+	return w.bandwidth.Transferred()
 }
 
-// downloadURL performs a GET request to the URL passed in. We measure the time it takes to download the URL
-// and then log the URLs stats to stdout.
-func (w *Watcher) downloadURL(url models.URL) error {
+// downloadURL downloads the URL passed in, measuring the time it takes, and logs the URLs stats to stdout. The
+// refreshed body details are written back to the store so GET /urls points at the latest copy, and recorded in the
+// URL's version history. The body isn't downloaded again if the server tells us it hasn't changed.
+func (w *Watcher) downloadURL(url models.URL) (*download.Result, error) {
 	fmt.Printf("downloading %s...\n", url.URL)
 
 	startTime := time.Now()
 
-	resp, err := http.Get(url.URL)
+	result, err := w.downloader.Download(w.ctx, url)
 	if err != nil {
-		return fmt.Errorf("error downloading %s: %s\n", url.URL, err)
+		if recordErr := download.RecordFailure(w.store, url.URL, err, 1); recordErr != nil {
+			fmt.Printf("unable to record failure for %s : %+v \n", url.URL, recordErr)
+		}
+		return nil, fmt.Errorf("error downloading %s: %w", url.URL, err)
 	}
 
-	defer resp.Body.Close()
 	elapsedTime := time.Since(startTime)
-	fmt.Printf(
-		"downloaded %s in %s \n",
-		url.URL,
-		elapsedTime,
-	)
-
-	url.UpdatedAt = time.Now()
-	return nil
+	if result.Unchanged {
+		fmt.Printf("%s unchanged, checked in %s \n", url.URL, elapsedTime)
+	} else {
+		fmt.Printf("downloaded %s in %s \n", url.URL, elapsedTime)
+	}
+
+	// read the latest record within the update so we don't overwrite submissions made since the batch was fetched.
+	var oldHash string
+	err = w.store.Update(url.URL, func(old []byte) ([]byte, error) {
+		record := url
+		if old != nil {
+			if err := json.Unmarshal(old, &record); err != nil {
+				return nil, fmt.Errorf("unable to unmarshal bytes into URL")
+			}
+		}
+
+		oldHash = record.ContentHash
+		record.UpdatedAt = time.Now()
+		record.ContentHash = result.Hash
+		record.FilePath = result.Path
+		record.Size = result.Size
+		record.ContentType = result.ContentType
+		record.ETag = result.ETag
+		record.LastModified = result.LastModified
+		record.FailureReason = ""
+		record.LastError = ""
+		record.Attempts = 1
+
+		bytes, err := json.Marshal(record)
+		if err != nil {
+			return nil, fmt.Errorf("unable to marshal URL into bytes")
+		}
+
+		return bytes, nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to update %s: %w", url.URL, err)
+	}
+
+	if err := w.downloader.Storage().Swap(oldHash, result.Hash); err != nil {
+		return nil, err
+	}
+
+	if _, err := w.history.Record(url.URL, result); err != nil {
+		return nil, err
+	}
+
+	return result, nil
 }
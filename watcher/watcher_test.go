@@ -1,16 +1,25 @@
 package watcher_test
 
 import (
+	"context"
 	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 
-	"github.com/golang/mock/gomock"
 	"github.com/jarcoal/httpmock"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
-	"github.com/pocockn/downloader/mocks"
+	"github.com/pocockn/downloader/bandwidth"
+	"github.com/pocockn/downloader/content"
+	"github.com/pocockn/downloader/download"
 	"github.com/pocockn/downloader/models"
+	"github.com/pocockn/downloader/store"
+	"github.com/pocockn/downloader/versions"
 	"github.com/pocockn/downloader/watcher"
 )
 
@@ -18,14 +27,17 @@ func TestWatcher(t *testing.T) {
 	httpmock.Activate()
 	defer httpmock.DeactivateAndReset()
 
-	ctrl := gomock.NewController(t)
-	defer ctrl.Finish()
+	db := store.NewMemory()
+	refs, err := db.Bucket("blobs")
+	require.NoError(t, err)
 
-	store := mocks.NewMockStore(ctrl)
+	storage, err := content.New(t.TempDir(), refs)
+	require.NoError(t, err)
 
-	w := watcher.New(5*time.Second, store)
+	history := versions.NewHistory(store.NewMemory(), storage, versions.Retention{})
+	w := watcher.New(1*time.Second, db, download.New(storage, http.DefaultClient, nil, nil, nil, nil), history, nil)
 
-	t.Run("Watcher runs every 5 seconds and downloads top 10 submitted URLs", func(t *testing.T) {
+	t.Run("Watcher runs every interval and downloads top 10 submitted URLs", func(t *testing.T) {
 		urls := []models.URL{
 			{URL: "http://www.example.com", Submitted: 0},
 			{URL: "http://www.example1.com", Submitted: 1},
@@ -39,30 +51,174 @@ func TestWatcher(t *testing.T) {
 			{URL: "http://www.example9.com", Submitted: 9},
 			{URL: "http://www.example10.com", Submitted: 10},
 		}
-		results := marshalURLs(urls, t)
 
 		for _, url := range urls {
+			bytes, err := json.Marshal(url)
+			require.NoError(t, err)
+			require.NoError(t, db.Set(url.URL, bytes))
+
 			httpmock.RegisterResponder(
 				"GET",
 				url.URL,
-				httpmock.NewStringResponder(200, ``),
+				httpmock.NewStringResponder(200, url.URL),
 			)
 		}
 
-		store.EXPECT().GetAll().Return(results, nil)
 		go w.Process()
-		time.Sleep(5 * time.Second)
-		w.Stop()
+		defer func() {
+			assert.NoError(t, w.Stop(context.Background()))
+		}()
+
+		require.Eventually(t, func() bool {
+			return httpmock.GetTotalCallCount() >= 10
+		}, 5*time.Second, 50*time.Millisecond)
+
+		// the least submitted URL falls outside the top 10 and is never downloaded.
+		calls := httpmock.GetCallCountInfo()
+		assert.Zero(t, calls["GET http://www.example.com"])
+
+		require.Eventually(t, func() bool {
+			return fetch(t, db, "http://www.example10.com").ContentHash != ""
+		}, 5*time.Second, 50*time.Millisecond)
+
+		refreshed := fetch(t, db, "http://www.example10.com")
+		assert.Equal(t, 10, refreshed.Submitted)
+		assert.Equal(t, int64(len(refreshed.URL)), refreshed.Size)
+		assert.FileExists(t, refreshed.FilePath)
+
+		// the version is recorded once the record has been refreshed.
+		require.Eventually(t, func() bool {
+			list, err := history.List("http://www.example10.com")
+			require.NoError(t, err)
+			return len(list) > 0 && list[0].Hash == refreshed.ContentHash
+		}, 5*time.Second, 50*time.Millisecond)
 	})
 }
 
-func marshalURLs(urls []models.URL, t *testing.T) [][]byte {
-	var results [][]byte
-	for _, url := range urls {
-		bytes, err := json.Marshal(url)
-		require.NoError(t, err)
-		results = append(results, bytes)
+func TestWatcher_Unchanged(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	db := store.NewMemory()
+	refs, err := db.Bucket("blobs")
+	require.NoError(t, err)
+
+	storage, err := content.New(t.TempDir(), refs)
+	require.NoError(t, err)
+
+	blob, err := storage.Save(strings.NewReader("hello"))
+	require.NoError(t, err)
+	require.NoError(t, storage.Retain(blob.Hash))
+
+	url := models.URL{
+		URL:         "http://www.example.com",
+		Submitted:   1,
+		ContentHash: blob.Hash,
+		FilePath:    blob.Path,
+		Size:        blob.Size,
+		ETag:        `"v1"`,
 	}
+	bytes, err := json.Marshal(url)
+	require.NoError(t, err)
+	require.NoError(t, db.Set(url.URL, bytes))
+
+	httpmock.RegisterResponder(http.MethodGet, url.URL, func(req *http.Request) (*http.Response, error) {
+		if req.Header.Get("If-None-Match") != `"v1"` {
+			return httpmock.NewStringResponse(http.StatusOK, "changed"), nil
+		}
+		resp := httpmock.NewStringResponse(http.StatusNotModified, "")
+		resp.Header.Set("ETag", `"v1"`)
+		return resp, nil
+	})
+
+	history := versions.NewHistory(store.NewMemory(), storage, versions.Retention{})
+	w := watcher.New(100*time.Millisecond, db, download.New(storage, http.DefaultClient, nil, nil, nil, nil), history, nil)
+
+	t.Run("Unchanged bodies are counted separately and keep their blob", func(t *testing.T) {
+		go w.Process()
+		defer func() {
+			assert.NoError(t, w.Stop(context.Background()))
+		}()
+
+		require.Eventually(t, func() bool {
+			return w.Stats().Unchanged > 0
+		}, 5*time.Second, 50*time.Millisecond)
+
+		assert.Zero(t, w.Stats().Successful)
+
+		refreshed := fetch(t, db, url.URL)
+		assert.Equal(t, blob.Hash, refreshed.ContentHash)
+		assert.Equal(t, `"v1"`, refreshed.ETag)
+		assert.FileExists(t, refreshed.FilePath)
+
+		list, err := history.List(url.URL)
+		require.NoError(t, err)
+		require.Len(t, list, 1)
+		assert.Equal(t, blob.Hash, list[0].Hash)
+	})
+}
+
+func TestWatcher_Throughput(t *testing.T) {
+	body := strings.Repeat("a", 64<<10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, body)
+	}))
+	defer server.Close()
+
+	db := store.NewMemory()
+	refs, err := db.Bucket("blobs")
+	require.NoError(t, err)
+
+	storage, err := content.New(t.TempDir(), refs)
+	require.NoError(t, err)
+
+	url := models.URL{URL: server.URL, Submitted: 1}
+	bytes, err := json.Marshal(url)
+	require.NoError(t, err)
+	require.NoError(t, db.Set(url.URL, bytes))
+
+	limiter := bandwidth.New(bandwidth.Limits{})
+	client := download.NewClient(download.Options{Bandwidth: limiter})
+	history := versions.NewHistory(store.NewMemory(), storage, versions.Retention{})
+	w := watcher.New(100*time.Millisecond, db, download.New(storage, client, nil, nil, nil, nil), history, limiter)
+
+	t.Run("Batch stats include the throughput of the bodies read through the limiter", func(t *testing.T) {
+		go w.Process()
+		defer func() {
+			assert.NoError(t, w.Stop(context.Background()))
+		}()
+
+		require.Eventually(t, func() bool {
+			return w.Stats().Throughput > 0
+		}, 5*time.Second, 50*time.Millisecond)
+
+		assert.GreaterOrEqual(t, limiter.Transferred(), int64(len(body)))
+	})
+}
+
+func TestWatcher_Stop(t *testing.T) {
+	storage, err := content.New(t.TempDir(), store.NewMemory())
+	require.NoError(t, err)
+
+	history := versions.NewHistory(store.NewMemory(), storage, versions.Retention{})
+	w := watcher.New(100*time.Millisecond, store.NewMemory(), download.New(storage, http.DefaultClient, nil, nil, nil, nil), history, nil)
+
+	t.Run("Watchers that never started stop straight away", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+
+		assert.NoError(t, w.Stop(ctx))
+		w.Process()
+		assert.NoError(t, w.Stop(ctx))
+	})
+}
+
+func fetch(t *testing.T, db store.Store, key string) models.URL {
+	bytes, err := db.Get(key)
+	require.NoError(t, err)
+
+	var url models.URL
+	require.NoError(t, json.Unmarshal(bytes, &url))
 
-	return results
+	return url
 }
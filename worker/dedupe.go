@@ -0,0 +1,194 @@
+package worker
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/pocockn/downloader/download"
+)
+
+// Dedupe policies.
+const (
+	// DedupeNone downloads every submission.
+	DedupeNone = "none"
+	// DedupeInFlight coalesces submissions of a URL that is already being downloaded into that download.
+	DedupeInFlight = "in_flight"
+	// DedupeWindow coalesces like DedupeInFlight and also reuses a successful download for a window afterwards.
+	DedupeWindow = "window"
+)
+
+// Dedupe decides whether a submission needs its own download or can share another one.
+type Dedupe interface {
+	// Do calls fn to download url, or returns the outcome of another download of url instead. shared is true when fn
+	// wasn't called.
+	Do(
+		ctx context.Context,
+		url string,
+		fn func() (*download.Result, error),
+	) (result *download.Result, shared bool, err error)
+}
+
+// NewDedupe returns the dedupe policy with the given name. The window and size only apply to DedupeWindow, they are
+// how long a download is reused for and the most URLs remembered at once.
+func NewDedupe(policy string, window time.Duration, size int) (Dedupe, error) {
+	switch policy {
+	case DedupeNone:
+		return noDedupe{}, nil
+	case "", DedupeInFlight:
+		return newInFlight(), nil
+	case DedupeWindow:
+		return newWindow(window, size), nil
+	default:
+		return nil, fmt.Errorf("unknown dedupe policy %q", policy)
+	}
+}
+
+// noDedupe downloads every submission.
+type noDedupe struct{}
+
+func (noDedupe) Do(_ context.Context, _ string, fn func() (*download.Result, error)) (*download.Result, bool, error) {
+	result, err := fn()
+	return result, false, err
+}
+
+// call is a download that other submissions of the same URL can wait on. done is closed once result and err are set.
+type call struct {
+	done   chan struct{}
+	result *download.Result
+	err    error
+}
+
+// inFlight coalesces submissions of a URL that is already being downloaded.
+type inFlight struct {
+	mu    sync.Mutex
+	calls map[string]*call
+}
+
+func newInFlight() *inFlight {
+	return &inFlight{calls: make(map[string]*call)}
+}
+
+func (f *inFlight) Do(
+	ctx context.Context,
+	url string,
+	fn func() (*download.Result, error),
+) (*download.Result, bool, error) {
+	f.mu.Lock()
+	if c, ok := f.calls[url]; ok {
+		f.mu.Unlock()
+		return wait(ctx, c)
+	}
+
+	c := &call{done: make(chan struct{})}
+	f.calls[url] = c
+	f.mu.Unlock()
+
+	c.result, c.err = fn()
+
+	f.mu.Lock()
+	delete(f.calls, url)
+	f.mu.Unlock()
+	close(c.done)
+
+	return c.result, false, c.err
+}
+
+// wait waits for the call to finish and returns its outcome. It gives up, abandoning the submission, if ctx is done
+// first.
+func wait(ctx context.Context, c *call) (*download.Result, bool, error) {
+	select {
+	case <-c.done:
+		return c.result, true, c.err
+	case <-ctx.Done():
+		return nil, true, fmt.Errorf("%w: %w", errAbandoned, ctx.Err())
+	}
+}
+
+// recent is a successful download remembered by the window policy.
+type recent struct {
+	url    string
+	result *download.Result
+	at     time.Time
+}
+
+// window coalesces in-flight submissions and reuses successful downloads for a while afterwards. Downloads are
+// remembered in an LRU list so memory is bounded by size rather than by how many URLs we have ever seen.
+type window struct {
+	flights *inFlight
+	window  time.Duration
+	size    int
+
+	mu      sync.Mutex
+	lru     *list.List
+	entries map[string]*list.Element
+}
+
+func newWindow(d time.Duration, size int) *window {
+	return &window{
+		flights: newInFlight(),
+		window:  d,
+		size:    size,
+		lru:     list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+func (w *window) Do(
+	ctx context.Context,
+	url string,
+	fn func() (*download.Result, error),
+) (*download.Result, bool, error) {
+	if result, ok := w.get(url); ok {
+		return result, true, nil
+	}
+
+	// remember the download before the in-flight call finishes, so there is no gap for another download to start in.
+	return w.flights.Do(ctx, url, func() (*download.Result, error) {
+		result, err := fn()
+		if err == nil {
+			w.add(url, result)
+		}
+		return result, err
+	})
+}
+
+// get returns the download of url if it finished within the window.
+func (w *window) get(url string) (*download.Result, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	element, ok := w.entries[url]
+	if !ok {
+		return nil, false
+	}
+
+	entry := element.Value.(*recent)
+	if time.Since(entry.at) >= w.window {
+		w.lru.Remove(element)
+		delete(w.entries, url)
+		return nil, false
+	}
+
+	w.lru.MoveToFront(element)
+	return entry.result, true
+}
+
+// add remembers a successful download of url, evicting the least recently used URL if we are over size.
+func (w *window) add(url string, result *download.Result) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if element, ok := w.entries[url]; ok {
+		w.lru.Remove(element)
+	}
+	w.entries[url] = w.lru.PushFront(&recent{url: url, result: result, at: time.Now()})
+
+	for w.size > 0 && w.lru.Len() > w.size {
+		oldest := w.lru.Back()
+		w.lru.Remove(oldest)
+		delete(w.entries, oldest.Value.(*recent).url)
+	}
+}
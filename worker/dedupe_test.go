@@ -0,0 +1,148 @@
+package worker_test
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pocockn/downloader/download"
+	"github.com/pocockn/downloader/worker"
+)
+
+func TestDedupe(t *testing.T) {
+	t.Run("Unknown policies are rejected", func(t *testing.T) {
+		_, err := worker.NewDedupe("unknown", 0, 0)
+		assert.Error(t, err)
+	})
+
+	t.Run("None downloads every submission", func(t *testing.T) {
+		dedupe, err := worker.NewDedupe(worker.DedupeNone, 0, 0)
+		require.NoError(t, err)
+
+		var calls int32
+		for i := 0; i < 2; i++ {
+			_, shared, err := dedupe.Do(context.Background(), "http://www.example.com", counted(&calls, nil))
+			require.NoError(t, err)
+			assert.False(t, shared)
+		}
+		assert.Equal(t, int32(2), calls)
+	})
+
+	t.Run("In flight shares a download in progress", func(t *testing.T) {
+		dedupe, err := worker.NewDedupe(worker.DedupeInFlight, 0, 0)
+		require.NoError(t, err)
+
+		var calls int32
+		release := make(chan struct{})
+		go func() {
+			_, _, _ = dedupe.Do(context.Background(), "http://www.example.com", counted(&calls, release))
+		}()
+		require.Eventually(t, func() bool { return atomic.LoadInt32(&calls) == 1 }, time.Second, time.Millisecond)
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			result, shared, err := dedupe.Do(context.Background(), "http://www.example.com", counted(&calls, nil))
+			assert.NoError(t, err)
+			assert.True(t, shared)
+			assert.Equal(t, "hash", result.Hash)
+		}()
+
+		// give the second submission time to start waiting before the first finishes.
+		time.Sleep(50 * time.Millisecond)
+		close(release)
+		<-done
+		assert.Equal(t, int32(1), calls)
+
+		_, shared, err := dedupe.Do(context.Background(), "http://www.example.com", counted(&calls, nil))
+		require.NoError(t, err)
+		assert.False(t, shared, "finished downloads aren't shared")
+	})
+
+	t.Run("In flight gives up waiting once ctx is done", func(t *testing.T) {
+		dedupe, err := worker.NewDedupe(worker.DedupeInFlight, 0, 0)
+		require.NoError(t, err)
+
+		var calls int32
+		release := make(chan struct{})
+		defer close(release)
+		go func() {
+			_, _, _ = dedupe.Do(context.Background(), "http://www.example.com", counted(&calls, release))
+		}()
+		require.Eventually(t, func() bool { return atomic.LoadInt32(&calls) == 1 }, time.Second, time.Millisecond)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		_, _, err = dedupe.Do(ctx, "http://www.example.com", counted(&calls, nil))
+		assert.ErrorIs(t, err, context.Canceled)
+	})
+
+	t.Run("Window reuses successful downloads until the window has passed", func(t *testing.T) {
+		dedupe, err := worker.NewDedupe(worker.DedupeWindow, 100*time.Millisecond, 10)
+		require.NoError(t, err)
+
+		var calls int32
+		_, shared, err := dedupe.Do(context.Background(), "http://www.example.com", counted(&calls, nil))
+		require.NoError(t, err)
+		assert.False(t, shared)
+
+		result, shared, err := dedupe.Do(context.Background(), "http://www.example.com", counted(&calls, nil))
+		require.NoError(t, err)
+		assert.True(t, shared)
+		assert.Equal(t, "hash", result.Hash)
+		assert.Equal(t, int32(1), calls)
+
+		time.Sleep(150 * time.Millisecond)
+		_, shared, err = dedupe.Do(context.Background(), "http://www.example.com", counted(&calls, nil))
+		require.NoError(t, err)
+		assert.False(t, shared)
+		assert.Equal(t, int32(2), calls)
+	})
+
+	t.Run("Window doesn't reuse failures", func(t *testing.T) {
+		dedupe, err := worker.NewDedupe(worker.DedupeWindow, time.Minute, 10)
+		require.NoError(t, err)
+
+		var calls int32
+		fail := func() (*download.Result, error) {
+			atomic.AddInt32(&calls, 1)
+			return nil, errors.New("big error")
+		}
+		for i := 0; i < 2; i++ {
+			_, shared, err := dedupe.Do(context.Background(), "http://www.example.com", fail)
+			assert.Error(t, err)
+			assert.False(t, shared)
+		}
+		assert.Equal(t, int32(2), calls)
+	})
+
+	t.Run("Window forgets the least recently used URLs", func(t *testing.T) {
+		dedupe, err := worker.NewDedupe(worker.DedupeWindow, time.Minute, 1)
+		require.NoError(t, err)
+
+		var calls int32
+		for _, url := range []string{"http://www.example.com", "http://www.example1.com", "http://www.example.com"} {
+			_, shared, err := dedupe.Do(context.Background(), url, counted(&calls, nil))
+			require.NoError(t, err)
+			assert.False(t, shared)
+		}
+		assert.Equal(t, int32(3), calls)
+	})
+}
+
+// counted returns a download that counts how many times it is called, and waits for release to be closed if it
+// isn't nil.
+func counted(calls *int32, release chan struct{}) func() (*download.Result, error) {
+	return func() (*download.Result, error) {
+		atomic.AddInt32(calls, 1)
+		if release != nil {
+			<-release
+		}
+		return &download.Result{Hash: "hash"}, nil
+	}
+}
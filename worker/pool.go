@@ -1,69 +1,238 @@
 package worker
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"net/http"
 	"sync"
 	"time"
 
+	"github.com/pocockn/downloader/download"
+	"github.com/pocockn/downloader/jobs"
 	"github.com/pocockn/downloader/models"
+	"github.com/pocockn/downloader/queue"
 	"github.com/pocockn/downloader/store"
 )
 
 // Now is used, so we can fix the time within our tests.
-var Now = time.Now()
+var Now = time.Now
 
-// Pool holds the max amount of workers, a channel that we'll send our URLs down and our store.
+// ErrStopped is returned when a URL is added to a pool that has been stopped.
+var ErrStopped = errors.New("worker pool has been stopped")
+
+// Pool holds the max amount of workers, the queue that submitted URLs are consumed from, the tracker that records
+// the state of each job, our store, the downloader used to fetch the URLs, the policy for retrying failed downloads
+// and the policy for deduplicating submissions of the same URL.
 type Pool struct {
-	maxWorker int
-	urls      chan models.URL
-	store     store.Store
-	mu        sync.Mutex
+	maxWorker  int
+	queue      *queue.Queue
+	jobs       *jobs.Tracker
+	store      store.Store
+	downloader *download.Downloader
+	retry      RetryPolicy
+	dedupe     Dedupe
+
+	// quit is cancelled to tell the workers to stop taking new jobs, done is closed once they have all returned.
+	quit     context.Context
+	stopping context.CancelFunc
+	done     chan struct{}
+
+	// mu guards started, which is set once Run has started the workers, so Stop knows whether there are any to wait
+	// for.
+	mu      sync.Mutex
+	started bool
+
+	// ctx is passed to every download, it is cancelled to abandon in-flight downloads on shutdown.
+	ctx    context.Context
+	cancel context.CancelFunc
 }
 
-// NewPool creates a new worker pool.
-func NewPool(maxWorkers int, s store.Store, urls chan models.URL) *Pool {
+// NewPool creates a new worker pool that processes the jobs in q, recording their progress in t. A nil dedupe
+// downloads every submission.
+func NewPool(
+	maxWorkers int,
+	s store.Store,
+	d *download.Downloader,
+	retry RetryPolicy,
+	dedupe Dedupe,
+	q *queue.Queue,
+	t *jobs.Tracker,
+) *Pool {
+	quit, stopping := context.WithCancel(context.Background())
+	ctx, cancel := context.WithCancel(context.Background())
+
+	if dedupe == nil {
+		dedupe = noDedupe{}
+	}
+
 	return &Pool{
-		maxWorker: maxWorkers,
-		urls:      urls,
-		store:     s,
-		mu:        sync.Mutex{},
+		maxWorker:  maxWorkers,
+		queue:      q,
+		jobs:       t,
+		store:      s,
+		downloader: d,
+		retry:      retry,
+		dedupe:     dedupe,
+		quit:       quit,
+		stopping:   stopping,
+		done:       make(chan struct{}),
+		ctx:        ctx,
+		cancel:     cancel,
 	}
 }
 
-// AddURL add a url to the pool to be processed by the workers.
-func (p *Pool) AddURL(url models.URL) {
-	p.urls <- url
+// AddURL adds a url to the queue to be processed by the workers and returns the job tracking it. The job takes the ID
+// passed in, unless it is empty or already in use in which case a new one is generated. It never blocks waiting for a
+// worker, it returns as soon as the URL has been queued, queue.ErrFull if the queue is at capacity and ErrStopped once
+// the pool has been stopped.
+func (p *Pool) AddURL(id string, url models.URL) (jobs.Job, error) {
+	if p.quit.Err() != nil {
+		return jobs.Job{}, ErrStopped
+	}
+
+	if id == "" {
+		id = jobs.NewID()
+	}
+
+	// the job is created before it is queued so a worker never picks up a job we aren't tracking.
+	job, err := p.jobs.Create(id, url.URL)
+	if errors.Is(err, jobs.ErrExists) {
+		job, err = p.jobs.Create(jobs.NewID(), url.URL)
+	}
+	if err != nil {
+		return jobs.Job{}, err
+	}
+
+	if _, err := p.queue.Enqueue(job.ID, url); err != nil {
+		if deleteErr := p.jobs.Delete(job.ID); deleteErr != nil {
+			fmt.Printf("unable to delete job %s : %+v \n", job.ID, deleteErr)
+		}
+		return jobs.Job{}, err
+	}
+
+	return job, nil
+}
+
+// Jobs returns the tracker recording the state of each job.
+func (p *Pool) Jobs() *jobs.Tracker {
+	return p.jobs
+}
+
+// QueueDepth returns how many URLs are queued or being processed, along with the capacity of the queue.
+func (p *Pool) QueueDepth() (depth, capacity int, err error) {
+	depth, err = p.queue.Depth()
+	return depth, p.queue.Capacity(), err
 }
 
-// Run starts our workers and listens on the channel that the URLs are sent down.
-// If we encounter an error we log it and discard the URL.
+// Stop tells the workers to stop taking new jobs and waits for them to finish the jobs they are processing. If ctx
+// is done first the in-flight downloads are cancelled, and once the workers have returned ctx's error is returned.
+// Anything left in the queue is picked up the next time the pool runs. A pool that was never run is stopped straight
+// away, and won't run afterwards.
+func (p *Pool) Stop(ctx context.Context) error {
+	p.mu.Lock()
+	p.stopping()
+	started := p.started
+	p.mu.Unlock()
+
+	if !started {
+		return nil
+	}
+
+	select {
+	case <-p.done:
+		return nil
+	case <-ctx.Done():
+		p.cancel()
+		<-p.done
+		return ctx.Err()
+	}
+}
+
+// Run starts our workers, which lease jobs from the queue until the pool is stopped. It returns once every worker has
+// finished its current job. Submissions of the same URL are deduplicated according to the pool's dedupe policy, a
+// submission that shares another download is still counted and its body is checked against the submission's own
+// checksums. Once a job has finished, successfully or not, its outcome is recorded and it is acked. If we encounter an
+// error we log it, jobs abandoned because the pool is stopping are released back to the queue so they are replayed.
 func (p *Pool) Run() {
+	p.mu.Lock()
+	if p.quit.Err() != nil {
+		p.mu.Unlock()
+		return
+	}
+	p.started = true
+	p.mu.Unlock()
+
+	defer close(p.done)
+	defer p.cancel()
+
 	// ensure we don't exit before all the Go routines have finished processing.
 	var wg sync.WaitGroup
 	wg.Add(p.maxWorker)
-	seenURLs := make(map[string]bool)
 
 	for i := 0; i < p.maxWorker; i++ {
 		go func(workerID int) {
 			defer wg.Done()
 			fmt.Printf("starting worker %d \n", workerID)
-			for url := range p.urls {
-				// ensure we only process URLs once.
-				p.mu.Lock()
-				if seenURLs[url.URL] {
-					p.mu.Unlock()
+			for {
+				job, ok := p.next(workerID)
+				if !ok {
+					fmt.Printf("stopping worker %d \n", workerID)
+					return
+				}
+
+				if p.queue.Exhausted(job) {
+					err := fmt.Errorf("leased %d times without finishing", job.Deliveries-job.Releases)
+					fmt.Printf("failing %s from worker %d : %+v \n", job.URL.URL, workerID, err)
+					p.track(job, p.jobs.Fail(job.ID, ReasonExhausted, err))
+					p.ack(job)
+					continue
+				}
+
+				p.track(job, p.jobs.Start(job.ID))
+				stop := p.hold(job)
+
+				result, shared, err := p.dedupe.Do(p.ctx, job.URL.URL, func() (*download.Result, error) {
+					return p.processWithRetry(job, workerID)
+				})
+				if err == nil && shared {
+					// the download was shared with another submission, this submission still needs counting and
+					// may expect different checksums.
+					fmt.Printf("%s shared an existing download via worker %d \n", job.URL.URL, workerID)
+					if err = p.downloader.Verify(p.ctx, job.URL, result); err == nil {
+						err = save(job.URL, p.store, p.downloader, result)
+					}
+				}
+				stop()
+
+				if errors.Is(err, errAbandoned) || download.ReasonFor(err) == download.ReasonCanceled {
+					fmt.Printf("releasing %s from worker %d, the pool is stopping \n", job.URL.URL, workerID)
+					p.track(job, p.jobs.Requeue(job.ID))
+					if err := p.queue.Release(job); err != nil {
+						fmt.Printf("unable to release job %s : %+v \n", job.ID, err)
+					}
 					continue
 				}
-				seenURLs[url.URL] = true
-				p.mu.Unlock()
 
-				if err := Process(url, p.store); err != nil {
-					fmt.Printf("unable to process %s from worker %d : %+v \n", url.URL, workerID, err)
+				// record the outcome before acking, if we die in between the job is replayed rather than lost.
+				if err != nil {
+					p.track(job, p.jobs.Fail(job.ID, string(download.ReasonFor(err)), err))
+				} else {
+					p.track(job, p.jobs.Succeed(job.ID, result.Hash, result.Path))
+				}
+				p.ack(job)
+
+				if err != nil {
+					fmt.Printf(
+						"unable to process %s from worker %d (%s) : %+v \n",
+						job.URL.URL,
+						workerID,
+						download.ReasonFor(err),
+						err,
+					)
 					continue
 				}
-				fmt.Printf("processed URL %s via worker %d \n", url.URL, workerID)
+				fmt.Printf("processed URL %s via worker %d \n", job.URL.URL, workerID)
 			}
 		}(i)
 	}
@@ -71,44 +240,234 @@ func (p *Pool) Run() {
 	wg.Wait()
 }
 
-// Process takes a URL and performs a GET request against the URL. If the GET request isn't successful we discard the
-// URL and log the error. If it is successful we store the URL in the store.
-func Process(url models.URL, store store.Store) error {
-	fmt.Printf("downloading %s...\n", url.URL)
-	resp, err := http.Get(url.URL)
+// ReasonExhausted is recorded on jobs that are failed because they reached the queue's maximum deliveries.
+const ReasonExhausted = "exhausted"
+
+// errAbandoned is returned when the pool is stopped while a job is waiting to be retried.
+var errAbandoned = errors.New("job abandoned")
+
+// processWithRetry processes the job's URL, retrying failures the retry policy considers transient. It stops retrying
+// if the pool is stopped while waiting for the next attempt.
+func (p *Pool) processWithRetry(job queue.Job, workerID int) (*download.Result, error) {
+	attempts := p.retry.attempts()
+	url := job.URL
+
+	for attempt := 1; ; attempt++ {
+		url.Attempts = attempt
+		result, err := Process(p.ctx, url, p.store, p.downloader)
+		if err == nil || attempt == attempts || !p.retry.Retryable(err) {
+			return result, err
+		}
+
+		delay := p.retry.Delay(attempt, err)
+		fmt.Printf(
+			"attempt %d of %s from worker %d failed, retrying in %s : %+v \n",
+			attempt,
+			url.URL,
+			workerID,
+			delay,
+			err,
+		)
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-p.quit.Done():
+			timer.Stop()
+			return nil, fmt.Errorf("%w: %w", errAbandoned, err)
+		case <-p.ctx.Done():
+			timer.Stop()
+			return nil, fmt.Errorf("%w: %w", errAbandoned, err)
+		}
+	}
+}
+
+// next leases the next job to process. It returns false once the pool has been stopped.
+func (p *Pool) next(workerID int) (queue.Job, bool) {
+	for {
+		job, err := p.queue.Lease(p.quit)
+		if err == nil {
+			return job, true
+		}
+		if p.quit.Err() != nil {
+			return queue.Job{}, false
+		}
+
+		fmt.Printf("unable to lease a job for worker %d : %+v \n", workerID, err)
+		select {
+		case <-time.After(time.Second):
+		case <-p.quit.Done():
+			return queue.Job{}, false
+		}
+	}
+}
+
+// hold renews the job's lease every half visibility timeout until the returned func is called, so a long download or
+// a wait for the scheduler or another submission's download doesn't see the job handed to a second worker. Renewal
+// stops early if the lease has already been lost.
+func (p *Pool) hold(job queue.Job) (stop func()) {
+	interval := p.queue.Visibility() / 2
+	if interval <= 0 {
+		return func() {}
+	}
+
+	stopping := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				err := p.queue.Extend(job)
+				if err == nil {
+					continue
+				}
+				fmt.Printf("unable to extend lease on job %s : %+v \n", job.ID, err)
+				if errors.Is(err, queue.ErrLeaseLost) {
+					return
+				}
+			case <-stopping:
+				return
+			}
+		}
+	}()
+
+	// wait for the renewal to finish, so the lease isn't extended after the job has been released.
+	return func() {
+		close(stopping)
+		<-stopped
+	}
+}
+
+// ack removes a finished job from the queue.
+func (p *Pool) ack(job queue.Job) {
+	if err := p.queue.Ack(job); err != nil {
+		fmt.Printf("unable to ack job %s : %+v \n", job.ID, err)
+	}
+}
+
+// track logs a failure to record a change in the job's state. The download itself carries on regardless.
+func (p *Pool) track(job queue.Job, err error) {
 	if err != nil {
-		return err
+		fmt.Printf("unable to update the state of job %s : %+v \n", job.ID, err)
 	}
-	defer resp.Body.Close()
-	fmt.Printf("successfully downloaded %s \n", url.URL)
+}
 
-	result, err := store.Get(url.URL)
+// Process takes a URL and makes a single attempt at downloading it into the downloaders storage. If the download isn't
+// successful we discard the URL, recording why on its record, and return the error. The
+// attempt number is read from url.Attempts. The validators of the copy we already have are sent with the request, so
+// an unchanged body isn't downloaded again. If it is successful the download is saved against the URL and the
+// downloaded body is returned.
+func Process(ctx context.Context, url models.URL, store store.Store, d *download.Downloader) (*download.Result, error) {
+	fmt.Printf("downloading %s...\n", url.URL)
+	downloaded, err := d.Download(ctx, withValidators(store, url))
 	if err != nil {
-		return fmt.Errorf("unable to fetch %s", url.URL)
+		if recordErr := download.RecordFailure(store, url.URL, err, url.Attempts); recordErr != nil {
+			fmt.Printf("unable to record failure for %s : %+v \n", url.URL, recordErr)
+		}
+		return nil, err
+	}
+	if downloaded.Unchanged {
+		fmt.Printf("%s is unchanged since it was last downloaded to %s \n", url.URL, downloaded.Path)
+	} else {
+		fmt.Printf("successfully downloaded %s to %s \n", url.URL, downloaded.Path)
+	}
+
+	if err := save(url, store, d, downloaded); err != nil {
+		return nil, err
 	}
 
-	if result == nil {
-		url.Submitted = 1
-		url.CreatedAt = Now.UTC()
-		bytes, err := json.Marshal(url)
+	return downloaded, nil
+}
+
+// save counts a submission of the URL and stores it, along with where its body was written, in the store and moves
+// the URLs blob reference over to the new body. The record is read and written in a single store update so
+// concurrent submissions of the same URL are all counted. A zero url.Attempts keeps the attempts already recorded,
+// for submissions that shared another download. The URL's expected checksums are replaced by any the submission gives.
+func save(url models.URL, store store.Store, d *download.Downloader, downloaded *download.Result) error {
+	var oldHash string
+	err := store.Update(url.URL, func(old []byte) ([]byte, error) {
+		record := url
+
+		if old == nil {
+			record.Submitted = 1
+			record.CreatedAt = Now().UTC()
+			fmt.Printf("first time we have seen url %s storing in the db \n", url.URL)
+		} else {
+			if err := json.Unmarshal(old, &record); err != nil {
+				return nil, fmt.Errorf("unable to unmarshal bytes into URL")
+			}
+			oldHash = record.ContentHash
+			// a record that only holds earlier failures has never been counted, its first success creates it.
+			if record.Submitted == 0 {
+				record.CreatedAt = Now().UTC()
+			} else {
+				record.UpdatedAt = Now().UTC()
+			}
+			record.Submitted++
+			fmt.Printf("seen url %s %d times, updating \n", url.URL, record.Submitted)
+		}
+
+		record.ContentHash = downloaded.Hash
+		record.FilePath = downloaded.Path
+		record.Size = downloaded.Size
+		record.ContentType = downloaded.ContentType
+		record.ETag = downloaded.ETag
+		record.LastModified = downloaded.LastModified
+		// the checksums of the latest submission that gave any are kept, so the watcher checks its refreshes too.
+		if !url.Checksums.Empty() {
+			record.Checksums = url.Checksums
+		}
+		record.FailureReason = ""
+		record.LastError = ""
+		if url.Attempts > 0 {
+			record.Attempts = url.Attempts
+		}
+
+		bytes, err := json.Marshal(record)
 		if err != nil {
-			return fmt.Errorf("unable to marshal URL into bytes")
+			return nil, fmt.Errorf("unable to marshal URL into bytes")
 		}
-		fmt.Printf("first time we have seen url %s storing in the db \n", url.URL)
-		return store.Set(url.URL, bytes)
+
+		return bytes, nil
+	})
+	if err != nil {
+		return fmt.Errorf("unable to update %s: %w", url.URL, err)
 	}
 
-	if err := json.Unmarshal(result, &url); err != nil {
-		return fmt.Errorf("unable to unmarshal bytes into URL")
+	return d.Storage().Swap(oldHash, downloaded.Hash)
+}
+
+// withValidators returns url with the validators and body details of the copy we already have, so the download can
+// ask the server whether it has changed. Any the submission carried are cleared first, only our own record is trusted,
+// so url has none if we have never downloaded it.
+func withValidators(store store.Store, url models.URL) models.URL {
+	url.ContentHash = ""
+	url.FilePath = ""
+	url.Size = 0
+	url.ContentType = ""
+	url.ETag = ""
+	url.LastModified = ""
+
+	bytes, err := store.Get(url.URL)
+	if err != nil || bytes == nil {
+		return url
 	}
 
-	url.Submitted++
-	url.UpdatedAt = Now.UTC()
-	fmt.Printf("seen url %s %d times, updating \n", url.URL, url.Submitted)
-	bytes, err := json.Marshal(url)
-	if err != nil {
-		return fmt.Errorf("unable to marshal URL into bytes")
+	var stored models.URL
+	if err := json.Unmarshal(bytes, &stored); err != nil {
+		return url
 	}
 
-	return store.Set(url.URL, bytes)
+	url.ContentHash = stored.ContentHash
+	url.Size = stored.Size
+	url.ContentType = stored.ContentType
+	url.ETag = stored.ETag
+	url.LastModified = stored.LastModified
+
+	return url
 }
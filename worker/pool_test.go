@@ -1,17 +1,30 @@
 package worker_test
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/golang/mock/gomock"
 	"github.com/jarcoal/httpmock"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
+	"github.com/pocockn/downloader/content"
+	"github.com/pocockn/downloader/download"
+	"github.com/pocockn/downloader/jobs"
 	"github.com/pocockn/downloader/mocks"
 	"github.com/pocockn/downloader/models"
+	"github.com/pocockn/downloader/queue"
+	"github.com/pocockn/downloader/store"
 	"github.com/pocockn/downloader/worker"
 )
 
@@ -22,65 +35,95 @@ func TestPool(t *testing.T) {
 	ctrl := gomock.NewController(t)
 	defer ctrl.Finish()
 
-	store := mocks.NewMockStore(ctrl)
-	urlChan := make(chan models.URL)
+	db := mocks.NewMockStore(ctrl)
 
-	pool := worker.NewPool(3, store, urlChan)
+	storage, err := content.New(t.TempDir(), store.NewMemory())
+	require.NoError(t, err)
+
+	// every responder returns an empty body so they all share the same blob.
+	sum := sha256.Sum256(nil)
+	emptyHash := hex.EncodeToString(sum[:])
+
+	pool := worker.NewPool(3, db, download.New(storage, http.DefaultClient, nil, nil, nil, nil), worker.RetryPolicy{}, nil, newQueue(), newTracker())
 
 	go pool.Run()
-	defer close(urlChan)
+	defer pool.Stop(context.Background())
+	defer func() { worker.Now = time.Now }()
 
 	t.Run("New URLs are saved by the workers", func(t *testing.T) {
 		url := models.URL{URL: "http://www.example.com"}
 
-		store.EXPECT().Get(url.URL).Return(nil, nil)
-
 		httpmock.RegisterResponder(
 			"GET",
 			url.URL,
 			httpmock.NewStringResponder(200, ``),
 		)
 
-		worker.Now = time.Now().UTC()
-		url.CreatedAt = worker.Now
+		now := time.Now().UTC()
+		worker.Now = func() time.Time { return now }
+		url.CreatedAt = now
 		url.Submitted = 1
+		url.ContentHash = emptyHash
+		url.FilePath = storage.Path(emptyHash)
+		url.Attempts = 1
 		bytes, err := json.Marshal(url)
 		require.NoError(t, err)
-		store.EXPECT().Set(url.URL, bytes).Return(nil)
+		db.EXPECT().Get(url.URL).Return(nil, nil)
+		expectUpdate(t, db, url.URL, nil, bytes)
 
-		pool.AddURL(url)
+		_, err = pool.AddURL("", url)
+		require.NoError(t, err)
 
 		time.Sleep(1 * time.Second)
 	})
 
-	t.Run("URLs that error are not saved", func(t *testing.T) {
+	t.Run("URLs that error only have their failure recorded", func(t *testing.T) {
 		url := models.URL{URL: "https://www.error.com"}
 
+		// we've never seen the URL so there are no validators to send, the record holds just the failure.
+		db.EXPECT().Get(url.URL).Return(nil, nil)
+		db.EXPECT().Update(url.URL, gomock.Any()).DoAndReturn(func(_ string, fn func([]byte) ([]byte, error)) error {
+			got, err := fn(nil)
+			require.NoError(t, err)
+
+			var record models.URL
+			require.NoError(t, json.Unmarshal(got, &record))
+			assert.Equal(t, url.URL, record.URL)
+			assert.Zero(t, record.Submitted)
+			assert.Equal(t, string(download.ReasonNetwork), record.FailureReason)
+			assert.Equal(t, 1, record.Attempts)
+			return nil
+		})
+
 		httpmock.RegisterResponder(
 			"GET",
 			url.URL,
 			httpmock.NewErrorResponder(fmt.Errorf("big error")),
 		)
 
-		pool.AddURL(url)
+		_, err := pool.AddURL("", url)
+		require.NoError(t, err)
 
 		time.Sleep(1 * time.Second)
 	})
 
 	t.Run("Valid URLs we've seen have their seen number increased", func(t *testing.T) {
-		url := models.URL{URL: "https://www.test.com"}
+		url := models.URL{URL: "https://www.test.com", Submitted: 1}
 		bytes, err := json.Marshal(url)
 		require.NoError(t, err)
 
-		store.EXPECT().Get(url.URL).Return(bytes, nil)
-
 		// Submitted should be +1 from the old value and updated at set to our fixed time.Now
-		worker.Now = time.Now().UTC()
+		now := time.Now().UTC()
+		worker.Now = func() time.Time { return now }
 		url.Submitted++
-		url.UpdatedAt = worker.Now
+		url.UpdatedAt = now
+		url.ContentHash = emptyHash
+		url.FilePath = storage.Path(emptyHash)
+		url.Attempts = 1
 		updatedBytes, err := json.Marshal(url)
 		require.NoError(t, err)
-		store.EXPECT().Set(url.URL, updatedBytes).Return(nil)
+		db.EXPECT().Get(url.URL).Return(bytes, nil)
+		expectUpdate(t, db, url.URL, bytes, updatedBytes)
 
 		httpmock.RegisterResponder(
 			"GET",
@@ -88,8 +131,501 @@ func TestPool(t *testing.T) {
 			httpmock.NewStringResponder(200, ``),
 		)
 
-		pool.AddURL(url)
+		_, err = pool.AddURL("", url)
+		require.NoError(t, err)
 
 		time.Sleep(2 * time.Second)
 	})
 }
+
+func TestPool_Retry(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	db := store.NewMemory()
+	storage, err := content.New(t.TempDir(), store.NewMemory())
+	require.NoError(t, err)
+
+	retry := worker.RetryPolicy{
+		MaxAttempts:     3,
+		BaseDelay:       10 * time.Millisecond,
+		RetryableStatus: []int{http.StatusServiceUnavailable},
+	}
+	pool := worker.NewPool(1, db, download.New(storage, http.DefaultClient, nil, nil, nil, nil), retry, nil, newQueue(), newTracker())
+	go pool.Run()
+	defer pool.Stop(context.Background())
+
+	t.Run("Transient failures are retried", func(t *testing.T) {
+		url := models.URL{URL: "http://www.flaky.com"}
+
+		httpmock.RegisterResponder(
+			"GET",
+			url.URL,
+			httpmock.NewStringResponder(http.StatusServiceUnavailable, ``).
+				Then(httpmock.NewStringResponder(http.StatusOK, `hello`)),
+		)
+
+		_, err := pool.AddURL("", url)
+		require.NoError(t, err)
+
+		require.Eventually(t, func() bool {
+			bytes, err := db.Get(url.URL)
+			require.NoError(t, err)
+			if bytes == nil {
+				return false
+			}
+
+			var saved models.URL
+			require.NoError(t, json.Unmarshal(bytes, &saved))
+			return saved.Attempts == 2 && saved.Size == 5
+		}, 5*time.Second, 10*time.Millisecond)
+	})
+
+	t.Run("Permanent failures are not retried", func(t *testing.T) {
+		url := models.URL{URL: "http://www.missing.com"}
+
+		httpmock.RegisterResponder("GET", url.URL, httpmock.NewStringResponder(http.StatusNotFound, ``))
+
+		_, err := pool.AddURL("", url)
+		require.NoError(t, err)
+
+		require.Eventually(t, func() bool {
+			return httpmock.GetCallCountInfo()["GET "+url.URL] == 1
+		}, 5*time.Second, 10*time.Millisecond)
+
+		time.Sleep(50 * time.Millisecond)
+		assert.Equal(t, 1, httpmock.GetCallCountInfo()["GET "+url.URL])
+	})
+}
+
+func TestPool_Latest(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	// every save is a second after the last, so the records can only come back in save order.
+	var ticks int64
+	start := time.Now().UTC()
+	worker.Now = func() time.Time { return start.Add(time.Duration(atomic.AddInt64(&ticks, 1)) * time.Second) }
+	defer func() { worker.Now = time.Now }()
+
+	db := store.NewMemory()
+	storage, err := content.New(t.TempDir(), store.NewMemory())
+	require.NoError(t, err)
+
+	tracker := newTracker()
+	pool := worker.NewPool(1, db, download.New(storage, http.DefaultClient, nil, nil, nil, nil), worker.RetryPolicy{}, nil, newQueue(), tracker)
+	go pool.Run()
+	defer pool.Stop(context.Background())
+
+	// keys are submitted out of key order, so a sort by key would give them back in the wrong order.
+	urls := []string{"http://www.c.com", "http://www.a.com", "http://www.b.com"}
+	for _, url := range urls {
+		httpmock.RegisterResponder("GET", url, httpmock.NewStringResponder(http.StatusOK, url))
+
+		job, err := pool.AddURL(url, models.URL{URL: url})
+		require.NoError(t, err)
+
+		require.Eventually(t, func() bool {
+			job, err = tracker.Get(job.ID)
+			require.NoError(t, err)
+			return job.State == jobs.StateSucceeded
+		}, 5*time.Second, 10*time.Millisecond)
+	}
+
+	t.Run("Latest returns URLs most recently saved first", func(t *testing.T) {
+		results, err := db.Latest(len(urls))
+		require.NoError(t, err)
+		require.Len(t, results, len(urls))
+
+		var latest []string
+		for _, bytes := range results {
+			var saved models.URL
+			require.NoError(t, json.Unmarshal(bytes, &saved))
+			latest = append(latest, saved.URL)
+		}
+		assert.Equal(t, []string{"http://www.b.com", "http://www.a.com", "http://www.c.com"}, latest)
+	})
+}
+
+func TestPool_Stop(t *testing.T) {
+	storage, err := content.New(t.TempDir(), store.NewMemory())
+	require.NoError(t, err)
+
+	pool := worker.NewPool(3, store.NewMemory(), download.New(storage, http.DefaultClient, nil, nil, nil, nil), worker.RetryPolicy{}, nil, newQueue(), newTracker())
+	go pool.Run()
+
+	t.Run("Stop waits for the workers to return", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+
+		assert.NoError(t, pool.Stop(ctx))
+	})
+
+	t.Run("URLs are rejected once the pool has stopped", func(t *testing.T) {
+		_, err := pool.AddURL("", models.URL{URL: "http://www.example.com"})
+		assert.ErrorIs(t, err, worker.ErrStopped)
+	})
+
+	t.Run("Pools that never ran stop straight away", func(t *testing.T) {
+		idle := worker.NewPool(3, store.NewMemory(), download.New(storage, http.DefaultClient, nil, nil, nil, nil), worker.RetryPolicy{}, nil, newQueue(), newTracker())
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+
+		assert.NoError(t, idle.Stop(ctx))
+		idle.Run()
+	})
+}
+
+func TestPool_Queue(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	db := store.NewMemory()
+	storage, err := content.New(t.TempDir(), store.NewMemory())
+	require.NoError(t, err)
+
+	pending := store.NewMemory()
+	tracker := newTracker()
+	q := queue.New(pending, queue.Options{VisibilityTimeout: time.Minute})
+	pool := worker.NewPool(1, db, download.New(storage, http.DefaultClient, nil, nil, nil, nil), worker.RetryPolicy{}, nil, q, tracker)
+	defer pool.Stop(context.Background())
+
+	url := models.URL{URL: "http://www.queued.com"}
+	var conditions []string
+	httpmock.RegisterResponder("GET", url.URL, func(req *http.Request) (*http.Response, error) {
+		conditions = append(conditions, req.Header.Get("If-None-Match"))
+		if req.Header.Get("If-None-Match") == `"v1"` {
+			return httpmock.NewStringResponse(http.StatusNotModified, ""), nil
+		}
+		resp := httpmock.NewStringResponse(http.StatusOK, `hello`)
+		resp.Header.Set("ETag", `"v1"`)
+		return resp, nil
+	})
+
+	job, err := pool.AddURL("job", url)
+	require.NoError(t, err)
+	assert.Equal(t, jobs.StateQueued, job.State)
+
+	t.Run("URLs queued before the pool runs are processed", func(t *testing.T) {
+		go pool.Run()
+
+		require.Eventually(t, func() bool {
+			bytes, err := db.Get(url.URL)
+			require.NoError(t, err)
+			return bytes != nil
+		}, 5*time.Second, 10*time.Millisecond)
+	})
+
+	t.Run("Processed jobs are acked", func(t *testing.T) {
+		require.Eventually(t, func() bool {
+			results, err := pending.GetAll()
+			require.NoError(t, err)
+			return len(results) == 0
+		}, 5*time.Second, 10*time.Millisecond)
+	})
+
+	t.Run("Jobs record where the body was written once they succeed", func(t *testing.T) {
+		require.Eventually(t, func() bool {
+			job, err := tracker.Get("job")
+			require.NoError(t, err)
+			return job.State == jobs.StateSucceeded
+		}, 5*time.Second, 10*time.Millisecond)
+
+		job, err := tracker.Get("job")
+		require.NoError(t, err)
+		assert.FileExists(t, job.FilePath)
+	})
+
+	t.Run("Resubmitted URLs are checked for changes and counted again", func(t *testing.T) {
+		first, err := tracker.Get("job")
+		require.NoError(t, err)
+
+		job, err := pool.AddURL("resubmitted", url)
+		require.NoError(t, err)
+
+		require.Eventually(t, func() bool {
+			job, err = tracker.Get(job.ID)
+			require.NoError(t, err)
+			return job.State == jobs.StateSucceeded
+		}, 5*time.Second, 10*time.Millisecond)
+
+		bytes, err := db.Get(url.URL)
+		require.NoError(t, err)
+
+		var saved models.URL
+		require.NoError(t, json.Unmarshal(bytes, &saved))
+		assert.Equal(t, 2, saved.Submitted)
+		assert.Equal(t, `"v1"`, saved.ETag)
+		assert.Equal(t, first.FilePath, job.FilePath)
+		assert.Equal(t, []string{"", `"v1"`}, conditions)
+	})
+}
+
+func TestPool_Lease(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		// outlast the visibility timeout and the interval a waiting worker polls for expired leases at.
+		time.Sleep(1500 * time.Millisecond)
+		_, _ = w.Write([]byte(`hello`))
+	}))
+	defer server.Close()
+
+	db := store.NewMemory()
+	storage, err := content.New(t.TempDir(), store.NewMemory())
+	require.NoError(t, err)
+
+	pending := store.NewMemory()
+	tracker := newTracker()
+	q := queue.New(pending, queue.Options{VisibilityTimeout: 100 * time.Millisecond})
+	pool := worker.NewPool(2, db, download.New(storage, http.DefaultClient, nil, nil, nil, nil), worker.RetryPolicy{}, nil, q, tracker)
+
+	go pool.Run()
+	defer pool.Stop(context.Background())
+
+	t.Run("Downloads that outlast the visibility timeout keep their lease", func(t *testing.T) {
+		job, err := pool.AddURL("job", models.URL{URL: server.URL})
+		require.NoError(t, err)
+
+		require.Eventually(t, func() bool {
+			job, err = tracker.Get(job.ID)
+			require.NoError(t, err)
+			return job.State == jobs.StateSucceeded
+		}, 5*time.Second, 10*time.Millisecond)
+
+		assert.Equal(t, int32(1), atomic.LoadInt32(&requests))
+
+		results, err := pending.GetAll()
+		require.NoError(t, err)
+		assert.Empty(t, results)
+	})
+}
+
+func TestPool_MaxDeliveries(t *testing.T) {
+	defer func() { queue.Now = time.Now }()
+
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		_, _ = w.Write([]byte(`hello`))
+	}))
+	defer server.Close()
+
+	storage, err := content.New(t.TempDir(), store.NewMemory())
+	require.NoError(t, err)
+
+	pending := store.NewMemory()
+	tracker := newTracker()
+	q := queue.New(pending, queue.Options{VisibilityTimeout: time.Minute, MaxDeliveries: 1})
+	pool := worker.NewPool(1, store.NewMemory(), download.New(storage, http.DefaultClient, nil, nil, nil, nil), worker.RetryPolicy{}, nil, q, tracker)
+	defer pool.Stop(context.Background())
+
+	job, err := pool.AddURL("job", models.URL{URL: server.URL})
+	require.NoError(t, err)
+
+	// a worker that died holding the job, whose lease then expired.
+	_, err = q.Lease(context.Background())
+	require.NoError(t, err)
+	queue.Now = func() time.Time { return time.Now().Add(2 * time.Minute) }
+
+	t.Run("Jobs that reach the maximum deliveries are failed rather than downloaded", func(t *testing.T) {
+		go pool.Run()
+
+		require.Eventually(t, func() bool {
+			job, err = tracker.Get(job.ID)
+			require.NoError(t, err)
+			return job.State == jobs.StateFailed
+		}, 5*time.Second, 10*time.Millisecond)
+
+		assert.Equal(t, worker.ReasonExhausted, job.Reason)
+		assert.Zero(t, atomic.LoadInt32(&requests))
+
+		results, err := pending.GetAll()
+		require.NoError(t, err)
+		assert.Empty(t, results)
+	})
+}
+
+func TestPool_Dedupe(t *testing.T) {
+	var requests int32
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		<-release
+		_, _ = w.Write([]byte(`hello`))
+	}))
+	defer server.Close()
+
+	db := store.NewMemory()
+	storage, err := content.New(t.TempDir(), store.NewMemory())
+	require.NoError(t, err)
+
+	dedupe, err := worker.NewDedupe(worker.DedupeInFlight, 0, 0)
+	require.NoError(t, err)
+
+	tracker := newTracker()
+	pool := worker.NewPool(2, db, download.New(storage, http.DefaultClient, nil, nil, nil, nil), worker.RetryPolicy{}, dedupe, newQueue(), tracker)
+	go pool.Run()
+	defer pool.Stop(context.Background())
+
+	t.Run("Concurrent submissions share a download and are all counted", func(t *testing.T) {
+		url := models.URL{URL: server.URL}
+		first, err := pool.AddURL("first", url)
+		require.NoError(t, err)
+		second, err := pool.AddURL("second", url)
+		require.NoError(t, err)
+
+		require.Eventually(t, func() bool {
+			job, err := tracker.Get(second.ID)
+			require.NoError(t, err)
+			return job.State == jobs.StateDownloading
+		}, 5*time.Second, 10*time.Millisecond)
+
+		// give the second worker time to start waiting on the first download before it finishes.
+		time.Sleep(50 * time.Millisecond)
+		close(release)
+
+		for _, id := range []string{first.ID, second.ID} {
+			require.Eventually(t, func() bool {
+				job, err := tracker.Get(id)
+				require.NoError(t, err)
+				return job.State == jobs.StateSucceeded
+			}, 5*time.Second, 10*time.Millisecond)
+		}
+
+		bytes, err := db.Get(url.URL)
+		require.NoError(t, err)
+
+		var saved models.URL
+		require.NoError(t, json.Unmarshal(bytes, &saved))
+		assert.Equal(t, 2, saved.Submitted)
+		assert.Equal(t, int32(1), atomic.LoadInt32(&requests))
+	})
+}
+
+func TestPool_Checksums(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		_, _ = w.Write([]byte(`hello world`))
+	}))
+	defer server.Close()
+
+	db := store.NewMemory()
+	storage, err := content.New(t.TempDir(), store.NewMemory())
+	require.NoError(t, err)
+
+	tracker := newTracker()
+	pool := worker.NewPool(1, db, download.New(storage, http.DefaultClient, nil, nil, nil, nil), worker.RetryPolicy{MaxAttempts: 3}, nil, newQueue(), tracker)
+	go pool.Run()
+	defer pool.Stop(context.Background())
+
+	checksums := models.Checksums{SHA256: "b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9"}
+
+	t.Run("Mismatched bodies fail the job with the checksum reason and aren't retried", func(t *testing.T) {
+		job, err := pool.AddURL("mismatched", models.URL{
+			URL:       server.URL,
+			Checksums: models.Checksums{MD5: "00000000000000000000000000000000"},
+		})
+		require.NoError(t, err)
+
+		require.Eventually(t, func() bool {
+			job, err = tracker.Get(job.ID)
+			require.NoError(t, err)
+			return job.State == jobs.StateFailed
+		}, 5*time.Second, 10*time.Millisecond)
+
+		assert.Equal(t, string(download.ReasonChecksum), job.Reason)
+		assert.Empty(t, job.FilePath)
+		assert.Equal(t, int32(1), atomic.LoadInt32(&requests))
+	})
+
+	t.Run("Matching bodies are stored with the checksums they were checked against", func(t *testing.T) {
+		job, err := pool.AddURL("matching", models.URL{URL: server.URL, Checksums: checksums})
+		require.NoError(t, err)
+
+		require.Eventually(t, func() bool {
+			job, err = tracker.Get(job.ID)
+			require.NoError(t, err)
+			return job.State == jobs.StateSucceeded
+		}, 5*time.Second, 10*time.Millisecond)
+
+		bytes, err := db.Get(server.URL)
+		require.NoError(t, err)
+
+		var saved models.URL
+		require.NoError(t, json.Unmarshal(bytes, &saved))
+		assert.Equal(t, checksums, saved.Checksums)
+		assert.Equal(t, checksums.SHA256, saved.ContentHash)
+	})
+}
+
+func TestPool_Validators(t *testing.T) {
+	var conditional int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") != "" {
+			atomic.AddInt32(&conditional, 1)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		_, _ = w.Write([]byte(`hello`))
+	}))
+	defer server.Close()
+
+	db := store.NewMemory()
+	storage, err := content.New(t.TempDir(), store.NewMemory())
+	require.NoError(t, err)
+
+	other, err := storage.Save(strings.NewReader("someone else's body"))
+	require.NoError(t, err)
+
+	tracker := newTracker()
+	pool := worker.NewPool(1, db, download.New(storage, http.DefaultClient, nil, nil, nil, nil), worker.RetryPolicy{}, nil, newQueue(), tracker)
+	go pool.Run()
+	defer pool.Stop(context.Background())
+
+	t.Run("Validators given with a submission are ignored", func(t *testing.T) {
+		job, err := pool.AddURL("job", models.URL{
+			URL:         server.URL,
+			ContentHash: other.Hash,
+			FilePath:    other.Path,
+			ETag:        `"v1"`,
+		})
+		require.NoError(t, err)
+
+		require.Eventually(t, func() bool {
+			job, err = tracker.Get(job.ID)
+			require.NoError(t, err)
+			return job.State == jobs.StateSucceeded
+		}, 5*time.Second, 10*time.Millisecond)
+
+		assert.Equal(t, int32(0), atomic.LoadInt32(&conditional))
+		assert.NotEqual(t, other.Path, job.FilePath)
+
+		bytes, err := db.Get(server.URL)
+		require.NoError(t, err)
+
+		var saved models.URL
+		require.NoError(t, json.Unmarshal(bytes, &saved))
+		assert.NotEqual(t, other.Hash, saved.ContentHash)
+	})
+}
+
+func newTracker() *jobs.Tracker {
+	return jobs.NewTracker(store.NewMemory(), 0)
+}
+
+func newQueue() *queue.Queue {
+	return queue.New(store.NewMemory(), queue.Options{VisibilityTimeout: time.Minute})
+}
+
+// expectUpdate expects a single update of key. The update function is passed old and must return want.
+func expectUpdate(t *testing.T, db *mocks.MockStore, key string, old, want []byte) {
+	db.EXPECT().Update(key, gomock.Any()).DoAndReturn(func(_ string, fn func([]byte) ([]byte, error)) error {
+		got, err := fn(old)
+		require.NoError(t, err)
+		assert.Equal(t, string(want), string(got))
+		return nil
+	})
+}
@@ -0,0 +1,91 @@
+package worker
+
+import (
+	"errors"
+	"math"
+	"math/rand"
+	"time"
+
+	"github.com/pocockn/downloader/download"
+)
+
+// RetryPolicy controls how the pool retries failed downloads. The zero value makes a single attempt.
+type RetryPolicy struct {
+	// MaxAttempts is the most times a URL is tried, including the first attempt.
+	MaxAttempts int
+	// BaseDelay is the wait before the first retry, it doubles on each retry after that.
+	BaseDelay time.Duration
+	// MaxDelay caps the exponential backoff. Failures the server asks us to wait longer than this for aren't retried.
+	MaxDelay time.Duration
+	// Jitter is the fraction, between 0 and 1, of each delay that is randomised so retries don't arrive in lockstep.
+	Jitter float64
+	// RetryableStatus are the response status codes worth retrying, such as 429 or 503.
+	RetryableStatus []int
+}
+
+// attempts returns how many times a URL should be tried.
+func (r RetryPolicy) attempts() int {
+	if r.MaxAttempts < 1 {
+		return 1
+	}
+	return r.MaxAttempts
+}
+
+// Retryable reports whether a download that failed with err is worth trying again. Timeouts, network errors and the
+// configured status codes are retried, cancelled downloads and storage failures are not. Nor is a failure whose
+// Retry-After is longer than MaxDelay, waiting that long would pin a worker and its job to a slow host.
+func (r RetryPolicy) Retryable(err error) bool {
+	if r.MaxDelay > 0 && retryAfter(err) > r.MaxDelay {
+		return false
+	}
+
+	switch download.ReasonFor(err) {
+	case download.ReasonTimeout, download.ReasonNetwork:
+		return true
+	case download.ReasonStatus:
+		status := statusCode(err)
+		for _, retryable := range r.RetryableStatus {
+			if status == retryable {
+				return true
+			}
+		}
+		return false
+	default:
+		return false
+	}
+}
+
+// Delay returns how long to wait before the given retry, where 1 is the first retry. It backs off exponentially from
+// BaseDelay up to MaxDelay with jitter applied, but waits at least as long as any Retry-After the server sent.
+func (r RetryPolicy) Delay(retry int, err error) time.Duration {
+	delay := float64(r.BaseDelay) * math.Pow(2, float64(retry-1))
+	if r.MaxDelay > 0 && delay > float64(r.MaxDelay) {
+		delay = float64(r.MaxDelay)
+	}
+
+	if r.Jitter > 0 {
+		delay -= delay * r.Jitter * rand.Float64()
+	}
+
+	if retryAfter := retryAfter(err); time.Duration(delay) < retryAfter {
+		return retryAfter
+	}
+
+	return time.Duration(delay)
+}
+
+func statusCode(err error) int {
+	var downloadErr *download.Error
+	if errors.As(err, &downloadErr) {
+		return downloadErr.StatusCode
+	}
+	return 0
+}
+
+func retryAfter(err error) time.Duration {
+	var downloadErr *download.Error
+	if errors.As(err, &downloadErr) {
+		return downloadErr.RetryAfter
+	}
+	return 0
+}
@@ -0,0 +1,70 @@
+package worker_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/pocockn/downloader/download"
+	"github.com/pocockn/downloader/worker"
+)
+
+func TestRetryPolicy(t *testing.T) {
+	policy := worker.RetryPolicy{
+		MaxAttempts:     3,
+		BaseDelay:       time.Second,
+		MaxDelay:        5 * time.Second,
+		RetryableStatus: []int{http.StatusTooManyRequests, http.StatusServiceUnavailable},
+	}
+
+	t.Run("Transient failures are retryable", func(t *testing.T) {
+		assert.True(t, policy.Retryable(&download.Error{Reason: download.ReasonTimeout}))
+		assert.True(t, policy.Retryable(&download.Error{Reason: download.ReasonNetwork}))
+		assert.True(t, policy.Retryable(&download.Error{
+			Reason:     download.ReasonStatus,
+			StatusCode: http.StatusServiceUnavailable,
+		}))
+	})
+
+	t.Run("Permanent failures are not retryable", func(t *testing.T) {
+		assert.False(t, policy.Retryable(&download.Error{Reason: download.ReasonCanceled, Err: context.Canceled}))
+		assert.False(t, policy.Retryable(&download.Error{Reason: download.ReasonStorage}))
+		assert.False(t, policy.Retryable(&download.Error{Reason: download.ReasonBlocked}))
+		assert.False(t, policy.Retryable(&download.Error{Reason: download.ReasonStatus, StatusCode: http.StatusNotFound}))
+		assert.False(t, policy.Retryable(errors.New("big error")))
+	})
+
+	t.Run("Delay backs off exponentially up to the max", func(t *testing.T) {
+		err := &download.Error{Reason: download.ReasonNetwork}
+		assert.Equal(t, time.Second, policy.Delay(1, err))
+		assert.Equal(t, 2*time.Second, policy.Delay(2, err))
+		assert.Equal(t, 4*time.Second, policy.Delay(3, err))
+		assert.Equal(t, 5*time.Second, policy.Delay(4, err))
+	})
+
+	t.Run("Jitter only ever shortens the delay", func(t *testing.T) {
+		jittered := policy
+		jittered.Jitter = 0.5
+
+		for i := 0; i < 100; i++ {
+			delay := jittered.Delay(2, &download.Error{Reason: download.ReasonNetwork})
+			assert.GreaterOrEqual(t, delay, time.Second)
+			assert.LessOrEqual(t, delay, 2*time.Second)
+		}
+	})
+
+	t.Run("Retry-After is honoured", func(t *testing.T) {
+		err := &download.Error{Reason: download.ReasonStatus, StatusCode: 429, RetryAfter: 4 * time.Second}
+		assert.True(t, policy.Retryable(err))
+		assert.Equal(t, 4*time.Second, policy.Delay(1, err))
+	})
+
+	t.Run("Failures with a Retry-After past the max delay are not retryable", func(t *testing.T) {
+		err := &download.Error{Reason: download.ReasonStatus, StatusCode: 503, RetryAfter: 24 * time.Hour}
+		assert.False(t, policy.Retryable(err))
+	})
+}